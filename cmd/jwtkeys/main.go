@@ -0,0 +1,125 @@
+// Command jwtkeys manages the keyring that signs access tokens.
+//
+// Usage:
+//
+//	jwtkeys init    create a keyring with a single, immediately active key
+//	jwtkeys rotate  add a key that becomes active after -activate-after;
+//	                the previous key keeps verifying
+//	jwtkeys prune   remove keys superseded longer ago than -max-token-lifetime
+//	jwtkeys list    show the keys without their secrets
+//
+// The keyring is the Secrets Manager secret JWT_KEYRING_SECRET_ID or the
+// file JWT_KEYRING_FILE. -activate-after must exceed JWT_KEYRING_REFRESH
+// (default 5m), so every Lambda can verify tokens of the new key before any
+// Lambda signs with it. Outstanding tokens are never invalidated by a
+// rotation, only by pruning their key, which waits until they have expired.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/awsbackend/internal/auth"
+)
+
+func main() {
+	activateAfter := flag.Duration("activate-after", 10*time.Minute, "rotate: delay before the new key starts signing")
+	maxTokenLifetime := flag.Duration("max-token-lifetime", 24*time.Hour, "prune: longest lifetime of any token signed by the keyring")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: jwtkeys [flags] init | rotate | prune | list\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	store, err := auth.KeyringStoreFromEnv()
+	if err != nil {
+		log.Fatalf("failed to initialize keyring store: %v", err)
+	}
+	if store == nil {
+		log.Fatalf("set JWT_KEYRING_SECRET_ID or JWT_KEYRING_FILE")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	switch flag.Arg(0) {
+	case "init":
+		if _, err := store.Load(ctx); err == nil {
+			log.Fatalf("a keyring already exists; use rotate")
+		}
+
+		keyring := &auth.Keyring{}
+		key, err := keyring.Rotate(time.Now(), 0)
+		if err != nil {
+			log.Fatalf("failed to create key: %v", err)
+		}
+		if err := store.Save(ctx, keyring); err != nil {
+			log.Fatalf("failed to save keyring: %v", err)
+		}
+		fmt.Printf("created keyring with active key %s\n", key.ID)
+
+	case "rotate":
+		keyring, err := store.Load(ctx)
+		if err != nil {
+			log.Fatalf("failed to load keyring: %v", err)
+		}
+
+		key, err := keyring.Rotate(time.Now(), *activateAfter)
+		if err != nil {
+			log.Fatalf("failed to create key: %v", err)
+		}
+		if err := store.Save(ctx, keyring); err != nil {
+			log.Fatalf("failed to save keyring: %v", err)
+		}
+		fmt.Printf("added key %s, active from %s\n", key.ID, key.ActivatesAt.Format(time.RFC3339))
+
+	case "prune":
+		keyring, err := store.Load(ctx)
+		if err != nil {
+			log.Fatalf("failed to load keyring: %v", err)
+		}
+
+		pruned := keyring.Prune(time.Now(), *maxTokenLifetime)
+		if len(pruned) == 0 {
+			fmt.Println("no keys to prune")
+			return
+		}
+		if err := store.Save(ctx, keyring); err != nil {
+			log.Fatalf("failed to save keyring: %v", err)
+		}
+		fmt.Printf("pruned %d keys: %v\n", len(pruned), pruned)
+
+	case "list":
+		keyring, err := store.Load(ctx)
+		if err != nil {
+			log.Fatalf("failed to load keyring: %v", err)
+		}
+
+		now := time.Now()
+		active, _ := keyring.Active(now)
+		for _, key := range keyring.Keys {
+			state := "retired"
+			switch {
+			case active != nil && key.ID == active.ID:
+				state = "active"
+			case key.ActivatesAt.After(now):
+				state = "pending"
+			}
+			fmt.Printf("%s  %-7s  created %s  activates %s\n", key.ID, state,
+				key.CreatedAt.Format(time.RFC3339), key.ActivatesAt.Format(time.RFC3339))
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
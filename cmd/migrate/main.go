@@ -0,0 +1,96 @@
+// Command migrate applies the embedded Postgres schema migrations.
+//
+// Usage:
+//
+//	migrate up            apply all pending migrations
+//	migrate down [steps]  roll back the last N migrations (default 1)
+//	migrate status        list migrations and whether they are applied
+//
+// The database is taken from DATABASE_URL.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/awsbackend/internal/db"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", 5*time.Minute, "overall timeout for the command")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: migrate [-timeout d] up | down [steps] | status\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("failed to initialize database: %v", err)
+	}
+	defer db.DB.Close()
+
+	migrator, err := db.NewMigrator(db.DB)
+	if err != nil {
+		log.Fatalf("failed to load migrations: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch flag.Arg(0) {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("migrate up failed: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+
+	case "down":
+		steps := 1
+		if flag.NArg() > 1 {
+			steps, err = strconv.Atoi(flag.Arg(1))
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid number of steps %q", flag.Arg(1))
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("rolled back %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatalf("migrate down failed: %v", err)
+		}
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatalf("migrate status failed: %v", err)
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-40s %s\n", s.Version, s.Name, state)
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
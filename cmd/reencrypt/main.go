@@ -0,0 +1,118 @@
+// Command reencrypt moves stored PHI to the current KMS key.
+//
+// Usage:
+//
+//	reencrypt run     re-encrypt every row not yet under KMS_KEY_ID,
+//	                  resuming the unfinished job for that key if any
+//	reencrypt status  list recent jobs and their per-table progress
+//	reencrypt reindex recompute journal entry blind indexes
+//
+// The database is taken from DATABASE_URL and the key from the usual
+// ENCRYPTION_PROVIDER / KMS_KEY_ID settings. Run one worker at a time.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/reencrypt"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", 6*time.Hour, "overall timeout for the command; an interrupted run can be resumed")
+	batchSize := flag.Int("batch-size", reencrypt.DefaultConfig.BatchSize, "rows per batch")
+	limit := flag.Int("limit", 10, "number of jobs shown by status")
+	after := flag.String("after", "", "reindex: continue after this entry ID")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: reencrypt [flags] run | status | reindex\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("failed to initialize database: %v", err)
+	}
+	defer db.DB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch flag.Arg(0) {
+	case "run":
+		encryptor, err := encryption.NewEncryptorFromEnv()
+		if err != nil {
+			log.Fatalf("failed to initialize encryption service: %v", err)
+		}
+
+		worker := reencrypt.NewWorker(encryptor, reencrypt.Config{BatchSize: *batchSize})
+		job, err := worker.Run(ctx)
+		if job != nil {
+			printJob(job)
+		}
+		if err != nil {
+			log.Fatalf("re-encryption failed: %v", err)
+		}
+
+	case "status":
+		jobs, err := db.NewReencryptionJobRepository(db.DB).List(ctx, *limit)
+		if err != nil {
+			log.Fatalf("failed to list jobs: %v", err)
+		}
+		if len(jobs) == 0 {
+			fmt.Println("no re-encryption jobs")
+		}
+		for _, job := range jobs {
+			printJob(job)
+		}
+
+	case "reindex":
+		encryptor, err := encryption.NewEncryptorFromEnv()
+		if err != nil {
+			log.Fatalf("failed to initialize encryption service: %v", err)
+		}
+		blindIndex, err := encryption.NewBlindIndexFromEnv(ctx)
+		if err != nil {
+			log.Fatalf("failed to initialize blind index: %v", err)
+		}
+		if blindIndex == nil {
+			log.Fatalf("no blind index key configured")
+		}
+
+		stats, err := reencrypt.NewReindexer(encryptor, blindIndex, *batchSize).Run(ctx, *after)
+		fmt.Printf("scanned=%d updated=%d unchanged=%d failed=%d last_id=%s\n",
+			stats.Scanned, stats.Updated, stats.Unchanged, stats.Failed, stats.LastID)
+		if err != nil {
+			log.Fatalf("reindex failed: %v", err)
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func printJob(job *db.ReencryptionJob) {
+	fmt.Printf("job %s  %s  target %s  started %s\n",
+		job.ID, job.Status, job.TargetKeyID, job.StartedAt.Format(time.RFC3339))
+	if job.CompletedAt != nil {
+		fmt.Printf("  completed %s\n", job.CompletedAt.Format(time.RFC3339))
+	}
+	if job.Error != "" {
+		fmt.Printf("  error: %s\n", job.Error)
+	}
+	for _, p := range job.Tables {
+		fmt.Printf("  %-16s scanned=%d reencrypted=%d skipped=%d conflicts=%d failed=%d done=%t\n",
+			p.Table, p.Scanned, p.Reencrypted, p.Skipped, p.Conflicts, p.Failed, p.Done)
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Keys of the context map the API Gateway authorizer attaches to a request.
+// API Gateway only passes strings, numbers and booleans, so lists are
+// comma-separated.
+const (
+	AuthorizerUserIDKey = "userId"
+	AuthorizerRolesKey  = "roles"
+	AuthorizerScopesKey = "scopes"
+	AuthorizerJTIKey    = "jti"
+	AuthorizerIATKey    = "iat"
+	AuthorizerExpKey    = "exp"
+)
+
+// BearerToken returns the token of the Authorization header, looked up
+// case-insensitively as HTTP header names are. The "Bearer " prefix is
+// optional.
+func BearerToken(headers map[string]string) (string, error) {
+	var header string
+	for name, value := range headers {
+		if strings.EqualFold(name, "Authorization") {
+			header = value
+			break
+		}
+	}
+	if header == "" {
+		return "", fmt.Errorf("missing authorization header")
+	}
+
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		header = header[7:]
+	}
+
+	return strings.TrimSpace(header), nil
+}
+
+// AuthorizerContext is the context map an authorizer returns for claims
+func AuthorizerContext(claims *Claims) map[string]interface{} {
+	authContext := map[string]interface{}{
+		AuthorizerUserIDKey: claims.UserID,
+		AuthorizerRolesKey:  strings.Join(claims.Roles, ","),
+		AuthorizerScopesKey: strings.Join(claims.Scopes, ","),
+		AuthorizerJTIKey:    claims.ID,
+	}
+	if claims.IssuedAt != nil {
+		authContext[AuthorizerIATKey] = claims.IssuedAt.Unix()
+	}
+	if claims.ExpiresAt != nil {
+		authContext[AuthorizerExpKey] = claims.ExpiresAt.Unix()
+	}
+	return authContext
+}
+
+// ClaimsFromAuthorizerContext rebuilds the claims of a request that passed
+// the authorizer, from request.RequestContext.Authorizer. The signature was
+// checked by the authorizer; revocation is checked again here, because
+// authorizer results are cached and a token revoked meanwhile would
+// otherwise be accepted until the cache entry expires.
+func ClaimsFromAuthorizerContext(ctx context.Context, authContext map[string]interface{}) (*Claims, error) {
+	userID := authorizerString(authContext[AuthorizerUserIDKey])
+	if userID == "" {
+		return nil, fmt.Errorf("authorizer context has no user ID")
+	}
+
+	claims := &Claims{
+		UserID: userID,
+		Roles:  splitList(authorizerString(authContext[AuthorizerRolesKey])),
+		Scopes: splitList(authorizerString(authContext[AuthorizerScopesKey])),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID: authorizerString(authContext[AuthorizerJTIKey]),
+		},
+	}
+	if iat, ok := authorizerUnix(authContext[AuthorizerIATKey]); ok {
+		claims.IssuedAt = jwt.NewNumericDate(iat)
+	}
+	if exp, ok := authorizerUnix(authContext[AuthorizerExpKey]); ok {
+		if !time.Now().Before(exp) {
+			return nil, fmt.Errorf("token is expired")
+		}
+		claims.ExpiresAt = jwt.NewNumericDate(exp)
+	}
+
+	revoker, err := DefaultRevoker()
+	if err != nil {
+		return nil, err
+	}
+	if revoker != nil {
+		if err := revoker.Check(ctx, claims); err != nil {
+			return nil, err
+		}
+	}
+
+	return claims, nil
+}
+
+// authorizerString reads a context value, which API Gateway may deliver as
+// a string or a JSON number
+func authorizerString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatInt(int64(v), 10)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func authorizerUnix(value interface{}) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(authorizerString(value), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWKSSource returns a JSON Web Key Set document
+type JWKSSource interface {
+	Fetch(ctx context.Context) ([]byte, error)
+}
+
+// HTTPJWKSSource fetches a JWKS from a URL, e.g. a Cognito user pool's
+// /.well-known/jwks.json
+type HTTPJWKSSource struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *HTTPJWKSSource) Fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JWKS request: %v", err)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s returned %d", s.URL, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS: %v", err)
+	}
+
+	return body, nil
+}
+
+// FileJWKSSource reads a JWKS from disk, for offline tests and local
+// development against tokens signed with a locally generated key
+type FileJWKSSource struct {
+	Path string
+}
+
+func (s *FileJWKSSource) Fetch(ctx context.Context) ([]byte, error) {
+	body, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+	}
+	return body, nil
+}
+
+// JWKSConfig describes the tokens a JWKSValidator accepts
+type JWKSConfig struct {
+	// Issuer is the expected iss, e.g.
+	// https://cognito-idp.eu-north-1.amazonaws.com/eu-north-1_AbCdEf
+	Issuer string
+
+	// ClientIDs are the app clients whose tokens are accepted. Cognito puts
+	// the client in aud for ID tokens and in client_id for access tokens.
+	ClientIDs []string
+
+	// TokenUses are the accepted token_use values, "access" and/or "id"
+	TokenUses []string
+
+	// CacheTTL is how long fetched keys are trusted before being refetched
+	CacheTTL time.Duration
+
+	// MinRefreshInterval is the minimum time between refetches, so tokens
+	// with made-up kids cannot hammer the JWKS endpoint
+	MinRefreshInterval time.Duration
+
+	// Leeway tolerates clock skew when checking exp, nbf and iat
+	Leeway time.Duration
+}
+
+// JWKSValidator verifies RS256 tokens against the keys of an OIDC issuer
+// such as a Cognito user pool. Keys are cached and looked up by kid; an
+// unknown kid triggers a refetch, which is how key rotation is picked up.
+// It is safe for concurrent use.
+type JWKSValidator struct {
+	config JWKSConfig
+	source JWKSSource
+	now    func() time.Time
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	refreshedAt time.Time // last attempt, successful or not
+	refreshMu   sync.Mutex
+}
+
+func NewJWKSValidator(config JWKSConfig, source JWKSSource) *JWKSValidator {
+	if config.CacheTTL == 0 {
+		config.CacheTTL = time.Hour
+	}
+	if config.MinRefreshInterval == 0 {
+		config.MinRefreshInterval = time.Minute
+	}
+	if len(config.TokenUses) == 0 {
+		config.TokenUses = []string{"access"}
+	}
+
+	return &JWKSValidator{
+		config: config,
+		source: source,
+		now:    time.Now,
+		keys:   map[string]*rsa.PublicKey{},
+	}
+}
+
+// NewJWKSValidatorFromEnv configures a validator for the Cognito user pool
+// COGNITO_USER_POOL_ID in COGNITO_REGION (default AWS_REGION), accepting
+// the comma-separated COGNITO_CLIENT_IDS and COGNITO_TOKEN_USE (default
+// "access"). JWKS_FILE replaces the pool's JWKS endpoint with a local file.
+// It returns nil if no user pool is configured.
+func NewJWKSValidatorFromEnv() (*JWKSValidator, error) {
+	poolID := os.Getenv("COGNITO_USER_POOL_ID")
+	if poolID == "" {
+		return nil, nil
+	}
+
+	region := os.Getenv("COGNITO_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		// Pool IDs are prefixed with their region, e.g. eu-north-1_AbCdEf
+		region, _, _ = strings.Cut(poolID, "_")
+	}
+
+	clientIDs := splitList(os.Getenv("COGNITO_CLIENT_IDS"))
+	if len(clientIDs) == 0 {
+		return nil, fmt.Errorf("COGNITO_CLIENT_IDS is required with COGNITO_USER_POOL_ID")
+	}
+
+	issuer := fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, poolID)
+
+	var source JWKSSource = &HTTPJWKSSource{
+		URL:    issuer + "/.well-known/jwks.json",
+		Client: &http.Client{Timeout: 5 * time.Second},
+	}
+	if path := os.Getenv("JWKS_FILE"); path != "" {
+		source = &FileJWKSSource{Path: path}
+	}
+
+	return NewJWKSValidator(JWKSConfig{
+		Issuer:    issuer,
+		ClientIDs: clientIDs,
+		TokenUses: splitList(os.Getenv("COGNITO_TOKEN_USE")),
+		Leeway:    30 * time.Second,
+	}, source), nil
+}
+
+// cognitoClaims are the claims of Cognito ID and access tokens we check
+type cognitoClaims struct {
+	TokenUse string   `json:"token_use"`
+	ClientID string   `json:"client_id"` // access tokens only
+	Groups   []string `json:"cognito:groups"`
+	Scope    string   `json:"scope"` // access tokens only, space-separated
+	jwt.RegisteredClaims
+}
+
+// ValidateToken verifies tokenString and maps it to Claims, with the
+// Cognito sub as UserID, the user's groups as Roles and the token's custom
+// scopes as Scopes
+func (v *JWKSValidator) ValidateToken(ctx context.Context, tokenString string) (*Claims, error) {
+	var claims cognitoClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				return nil, fmt.Errorf("token has no kid")
+			}
+			return v.key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.config.Leeway),
+		jwt.WithTimeFunc(v.now),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(v.config.TokenUses, claims.TokenUse) {
+		return nil, fmt.Errorf("token_use %q is not accepted", claims.TokenUse)
+	}
+
+	// ID tokens name the client in aud, access tokens in client_id
+	clientOK := slices.Contains(v.config.ClientIDs, claims.ClientID)
+	if claims.TokenUse == "id" {
+		clientOK = slices.ContainsFunc(claims.Audience, func(aud string) bool {
+			return slices.Contains(v.config.ClientIDs, aud)
+		})
+	}
+	if !clientOK {
+		return nil, fmt.Errorf("token was issued to an unknown client")
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("token has no sub")
+	}
+
+	return &Claims{
+		UserID:           claims.Subject,
+		Roles:            claims.Groups,
+		Scopes:           cognitoScopes(claims.Scope),
+		RegisteredClaims: claims.RegisteredClaims,
+	}, nil
+}
+
+// cognitoScopes returns the permissions among the scopes of a Cognito access
+// token. Custom scopes are prefixed with their resource server, e.g.
+// "https://api.therma.app/journal:read"; built-in scopes such as "openid"
+// are not permissions and are dropped.
+func cognitoScopes(scope string) []string {
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if i := strings.LastIndex(s, "/"); i >= 0 {
+			scopes = append(scopes, s[i+1:])
+		}
+	}
+	return scopes
+}
+
+// key returns the public key for kid, refetching the JWKS when the cache is
+// stale or does not know kid
+func (v *JWKSValidator) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	fresh := v.now().Sub(v.fetchedAt) < v.config.CacheTTL
+	v.mu.RUnlock()
+
+	if ok && fresh {
+		return key, nil
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		if ok {
+			// Keep using a known key while the endpoint is unavailable
+			log.Printf("jwks: refresh failed, using cached key %s: %v", kid, err)
+			return key, nil
+		}
+		return nil, err
+	}
+
+	v.mu.RLock()
+	key, ok = v.keys[kid]
+	v.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+// refresh refetches the key set, at most once per MinRefreshInterval so
+// tokens with made-up kids or an unavailable endpoint cannot cause a fetch
+// per request. Concurrent callers share one fetch.
+func (v *JWKSValidator) refresh(ctx context.Context) error {
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+
+	v.mu.RLock()
+	sinceAttempt := v.now().Sub(v.refreshedAt)
+	v.mu.RUnlock()
+
+	if sinceAttempt < v.config.MinRefreshInterval {
+		return nil
+	}
+
+	v.mu.Lock()
+	v.refreshedAt = v.now()
+	v.mu.Unlock()
+
+	body, err := v.source.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(body)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.fetchedAt = v.now()
+	v.mu.Unlock()
+
+	return nil
+}
+
+type jwks struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+// parseJWKS returns the RSA signing keys of a JWKS document by kid
+func parseJWKS(body []byte) (map[string]*rsa.PublicKey, error) {
+	var set jwks
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent for key %q: %v", k.Kid, err)
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("invalid exponent for key %q", k.Kid)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no RS256 signing keys")
+	}
+
+	return keys, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
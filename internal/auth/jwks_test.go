@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testIssuer = "https://cognito-idp.eu-north-1.amazonaws.com/eu-north-1_Test"
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	return key
+}
+
+// writeJWKS writes the public halves of keys, by kid, as a JWKS file
+func writeJWKS(t *testing.T, path string, keys map[string]*rsa.PrivateKey) {
+	t.Helper()
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, map[string]string{
+			"kid": kid,
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	body, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("failed to encode JWKS: %v", err)
+	}
+	if err := os.WriteFile(path, body, 0o600); err != nil {
+		t.Fatalf("failed to write JWKS: %v", err)
+	}
+}
+
+func signCognitoToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func accessTokenClaims(now time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            testIssuer,
+		"sub":            "cognito-user-1",
+		"token_use":      "access",
+		"client_id":      "client-1",
+		"cognito:groups": []string{"user"},
+		"scope":          "openid https://api.therma.app/journal:read",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWKSValidator(t *testing.T) {
+	key := testRSAKey(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"key-1": key})
+
+	v := NewJWKSValidator(JWKSConfig{
+		Issuer:    testIssuer,
+		ClientIDs: []string{"client-1"},
+		TokenUses: []string{"access", "id"},
+	}, &FileJWKSSource{Path: path})
+	now := time.Now()
+
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := accessTokenClaims(now)
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, accessTokenClaims(now)).SignedString(key.N.Bytes())
+	if err != nil {
+		t.Fatalf("failed to sign HS256 token: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"AccessToken", signCognitoToken(t, key, "key-1", accessTokenClaims(now)), false},
+		{"IDToken", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"token_use": "id", "client_id": nil, "aud": "client-1"})), false},
+		{"WrongIssuer", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"iss": "https://example.com"})), true},
+		{"UnknownClient", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"client_id": "client-2"})), true},
+		{"IDTokenForUnknownClient", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"token_use": "id", "aud": "client-2"})), true},
+		{"UnacceptedTokenUse", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"token_use": "refresh"})), true},
+		{"Expired", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()})), true},
+		{"NoExpiry", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"exp": nil})), true},
+		{"NoSubject", signCognitoToken(t, key, "key-1", with(jwt.MapClaims{"sub": nil})), true},
+		{"NoKid", signCognitoToken(t, key, "", accessTokenClaims(now)), true},
+		{"UnknownKid", signCognitoToken(t, key, "key-2", accessTokenClaims(now)), true},
+		{"OtherKey", signCognitoToken(t, testRSAKey(t), "key-1", accessTokenClaims(now)), true},
+		{"HS256", hs256, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.ValidateToken(context.Background(), tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ValidateToken = %+v, want an error", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateToken failed: %v", err)
+			}
+			if claims.UserID != "cognito-user-1" || !slices.Equal(claims.Roles, []string{"user"}) {
+				t.Errorf("ValidateToken = %+v, want user cognito-user-1 with role user", claims)
+			}
+		})
+	}
+}
+
+// TestJWKSValidatorPicksUpRotatedKeys checks that a token with a new kid
+// refetches the key set, but no more than once per MinRefreshInterval
+func TestJWKSValidatorPicksUpRotatedKeys(t *testing.T) {
+	oldKey, newKey := testRSAKey(t), testRSAKey(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"old": oldKey})
+
+	v := NewJWKSValidator(JWKSConfig{
+		Issuer:             testIssuer,
+		ClientIDs:          []string{"client-1"},
+		MinRefreshInterval: time.Minute,
+	}, &FileJWKSSource{Path: path})
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, err := v.ValidateToken(ctx, signCognitoToken(t, oldKey, "old", accessTokenClaims(now))); err != nil {
+		t.Fatalf("ValidateToken with the old key failed: %v", err)
+	}
+
+	writeJWKS(t, path, map[string]*rsa.PrivateKey{"old": oldKey, "new": newKey})
+	rotated := signCognitoToken(t, newKey, "new", accessTokenClaims(now))
+
+	if _, err := v.ValidateToken(ctx, rotated); err == nil {
+		t.Fatal("ValidateToken refetched the key set within MinRefreshInterval")
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := v.ValidateToken(ctx, rotated); err != nil {
+		t.Fatalf("ValidateToken with the rotated key failed: %v", err)
+	}
+
+	// A cached key keeps working while the source is unavailable
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove JWKS: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := v.ValidateToken(ctx, signCognitoToken(t, oldKey, "old", accessTokenClaims(now))); err != nil {
+		t.Errorf("ValidateToken with a cached key and no JWKS failed: %v", err)
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"NotJSON", "keys"},
+		{"NoKeys", `{"keys":[]}`},
+		{"OnlyEncryptionKeys", `{"keys":[{"kid":"k","kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"}]}`},
+		{"OnlyECKeys", `{"keys":[{"kid":"k","kty":"EC","use":"sig"}]}`},
+		{"BadModulus", `{"keys":[{"kid":"k","kty":"RSA","n":"!","e":"AQAB"}]}`},
+		{"SmallExponent", `{"keys":[{"kid":"k","kty":"RSA","n":"AQAB","e":"AQ"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if keys, err := parseJWKS([]byte(tt.body)); err == nil {
+				t.Errorf("parseJWKS = %v, want an error", keys)
+			}
+		})
+	}
+}
+
+func TestCognitoScopes(t *testing.T) {
+	got := cognitoScopes("openid email https://api.therma.app/journal:read https://api.therma.app/journal:write")
+	want := []string{"journal:read", "journal:write"}
+	if !slices.Equal(got, want) {
+		t.Errorf("cognitoScopes = %v, want %v", got, want)
+	}
+}
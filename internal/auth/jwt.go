@@ -1,19 +1,69 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// Claims are the claims of an access token. RegisteredClaims.ID is the jti,
+// which identifies the token for revocation. Roles and Scopes decide what
+// the caller may do; see Authorize.
 type Claims struct {
-	UserID string `json:"user_id"`
+	UserID   string   `json:"user_id"`
+	Roles    []string `json:"roles,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`    // Empty means every permission of the roles
+	TokenUse string   `json:"token_use,omitempty"` // Empty for access tokens; see TokenUseMFAPending
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID string) (string, error) {
+// TokenUseMFAPending marks the short-lived token login issues to users with
+// MFA. It proves the password was right and is accepted only by the MFA
+// endpoints, never as an access token.
+const TokenUseMFAPending = "mfa_pending"
+
+// MFAPendingTokenTTL is how long the user has to enter their second factor
+const MFAPendingTokenTTL = 5 * time.Minute
+
+// Account tokens are mailed to users. Like mfa_pending tokens they are
+// never access tokens; the mailing service also stores their hashes so each
+// can be used once.
+const (
+	TokenUseEmailVerification = "email_verification"
+	TokenUsePasswordReset     = "password_reset"
+
+	EmailVerificationTokenTTL = 24 * time.Hour
+	PasswordResetTokenTTL     = time.Hour
+)
+
+// TokenOption sets optional claims of a token from GenerateToken
+type TokenOption func(*Claims)
+
+// WithRoles sets the roles of the token's user
+func WithRoles(roles ...string) TokenOption {
+	return func(c *Claims) {
+		c.Roles = roles
+	}
+}
+
+// WithScopes restricts the token to the given permissions
+func WithScopes(scopes ...string) TokenOption {
+	return func(c *Claims) {
+		c.Scopes = scopes
+	}
+}
+
+// GenerateToken issues an HS256 access token for userID, valid for JWT_TTL.
+// It is signed with the keyring's active key, named in the kid header, or
+// with JWT_SECRET if no keyring is configured.
+func GenerateToken(userID string, opts ...TokenOption) (string, error) {
 	secret := os.Getenv("JWT_SECRET")
 	issuer := os.Getenv("JWT_ISSUER")
 	ttl := os.Getenv("JWT_TTL")
@@ -23,27 +73,205 @@ func GenerateToken(userID string) (string, error) {
 		return "", fmt.Errorf("invalid JWT_TTL: %v", err)
 	}
 
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("failed to generate token ID: %v", err)
+	}
+
 	claims := Claims{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    issuer,
 		},
 	}
+	for _, opt := range opts {
+		opt(&claims)
+	}
+
+	return signToken(claims, secret)
+}
+
+// GenerateMFAPendingToken issues the token login returns instead of an
+// access token when the user still has to pass MFA
+func GenerateMFAPendingToken(userID string) (string, error) {
+	return generateUseToken(userID, TokenUseMFAPending, MFAPendingTokenTTL)
+}
+
+// GenerateAccountToken issues an email verification or password reset
+// token for userID
+func GenerateAccountToken(userID, use string, ttl time.Duration) (string, error) {
+	if use != TokenUseEmailVerification && use != TokenUsePasswordReset {
+		return "", fmt.Errorf("unknown account token use %q", use)
+	}
+	return generateUseToken(userID, use, ttl)
+}
+
+// HashAccountToken returns the stored form of an account token
+func HashAccountToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateUseToken issues a token that is only accepted for use
+func generateUseToken(userID, use string, ttl time.Duration) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", fmt.Errorf("failed to generate token ID: %v", err)
+	}
+
+	claims := Claims{
+		UserID:   userID,
+		TokenUse: use,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(jti),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    os.Getenv("JWT_ISSUER"),
+		},
+	}
 
+	return signToken(claims, os.Getenv("JWT_SECRET"))
+}
+
+// signToken signs claims with the keyring's active key, or with secret if
+// no keyring is configured
+func signToken(claims Claims, secret string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+
+	keyring, err := defaultKeyring()
+	if err != nil {
+		return "", err
+	}
+	if keyring == nil {
+		return token.SignedString([]byte(secret))
+	}
+
+	key, err := keyring.SigningKey(context.Background())
+	if err != nil {
+		return "", err
+	}
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
 }
 
+// ValidateToken validates a bearer token. RS256 tokens are verified against
+// the Cognito user pool JWKS (see NewJWKSValidatorFromEnv); HS256 tokens
+// against the signing keyring or JWT_SECRET. Valid tokens are then checked against the
+// DefaultRevoker, if revocation is configured.
 func ValidateToken(tokenString string) (*Claims, error) {
-	secret := os.Getenv("JWT_SECRET")
+	claims, err := verifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenUse != "" {
+		return nil, fmt.Errorf("%s tokens are not access tokens", claims.TokenUse)
+	}
+
+	if err := checkRevocation(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// ValidateMFAPendingToken validates a token from GenerateMFAPendingToken
+func ValidateMFAPendingToken(tokenString string) (*Claims, error) {
+	claims, err := verifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
 
+	if claims.TokenUse != TokenUseMFAPending {
+		return nil, fmt.Errorf("not an MFA pending token")
+	}
+
+	if err := checkRevocation(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// ValidateAccountToken checks the signature, expiry and use of a token from
+// GenerateAccountToken. Whether it has already been used is up to the
+// caller's stored hash.
+func ValidateAccountToken(tokenString, use string) (*Claims, error) {
+	claims, err := verifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.TokenUse != use {
+		return nil, fmt.Errorf("not a %s token", use)
+	}
+
+	return claims, nil
+}
+
+// checkRevocation checks claims against the DefaultRevoker, if revocation
+// is configured
+func checkRevocation(claims *Claims) error {
+	revoker, err := DefaultRevoker()
+	if err != nil {
+		return err
+	}
+	if revoker == nil {
+		return nil
+	}
+	return revoker.Check(context.Background(), claims)
+}
+
+// verifyToken checks a token's signature and claims
+func verifyToken(tokenString string) (*Claims, error) {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Method.Alg() == jwt.SigningMethodRS256.Alg() {
+		validator, err := defaultJWKSValidator()
+		if err != nil {
+			return nil, err
+		}
+		if validator == nil {
+			return nil, fmt.Errorf("RS256 tokens are not accepted: no Cognito user pool configured")
+		}
+		return validator.ValidateToken(context.Background(), tokenString)
+	}
+
+	return validateHS256Token(tokenString)
+}
+
+// validateHS256Token verifies tokens with a kid against the keyring and
+// tokens without one against JWT_SECRET (see legacySecret)
+func validateHS256Token(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secret), nil
+
+		keyring, err := defaultKeyring()
+		if err != nil {
+			return nil, err
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			return legacySecret(keyring != nil, time.Now())
+		}
+
+		if keyring == nil {
+			return nil, fmt.Errorf("token has a kid but no keyring is configured")
+		}
+		key, err := keyring.VerificationKey(context.Background(), kid)
+		if err != nil {
+			return nil, err
+		}
+		return key.Secret, nil
 	})
 
 	if err != nil {
@@ -56,3 +284,46 @@ func ValidateToken(tokenString string) (*Claims, error) {
 
 	return nil, fmt.Errorf("invalid token")
 }
+
+// legacySecret returns the key tokens without a kid are verified with:
+// JWT_SECRET. Once a keyring is configured, JWT_SECRET only verifies until
+// JWT_LEGACY_SECRET_UNTIL (RFC 3339), so tokens issued before the keyring
+// stay valid until they expire but rotating to it retires the secret.
+func legacySecret(keyringConfigured bool, now time.Time) ([]byte, error) {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("token has no kid and JWT_SECRET is not set")
+	}
+	if !keyringConfigured {
+		return []byte(secret), nil
+	}
+
+	raw := os.Getenv("JWT_LEGACY_SECRET_UNTIL")
+	if raw == "" {
+		return nil, fmt.Errorf("token has no kid and JWT_SECRET is retired by the keyring")
+	}
+	until, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_LEGACY_SECRET_UNTIL: %v", err)
+	}
+	if !now.Before(until) {
+		return nil, fmt.Errorf("token has no kid and JWT_SECRET was retired at %s", raw)
+	}
+
+	return []byte(secret), nil
+}
+
+var jwksOnce struct {
+	sync.Once
+	validator *JWKSValidator
+	err       error
+}
+
+// defaultJWKSValidator is created from the environment on first use and
+// shared by every request of a warm Lambda, so its key cache persists
+func defaultJWKSValidator() (*JWKSValidator, error) {
+	jwksOnce.Do(func() {
+		jwksOnce.validator, jwksOnce.err = NewJWKSValidatorFromEnv()
+	})
+	return jwksOnce.validator, jwksOnce.err
+}
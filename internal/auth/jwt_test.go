@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testJWTSecret = "test-secret-0123456789abcdef0123456789"
+
+func setTestJWTEnv(t *testing.T) {
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	t.Setenv("JWT_ISSUER", "therma-test")
+	t.Setenv("JWT_TTL", "15m")
+}
+
+func signTestHS256(t *testing.T, claims Claims, secret string) string {
+	t.Helper()
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestGenerateAndValidateToken(t *testing.T) {
+	setTestJWTEnv(t)
+
+	token, err := GenerateToken("user-1", WithRoles("clinician"), WithScopes("journal:read"))
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken failed: %v", err)
+	}
+	if claims.UserID != "user-1" || !slices.Equal(claims.Roles, []string{"clinician"}) || !slices.Equal(claims.Scopes, []string{"journal:read"}) {
+		t.Errorf("ValidateToken = %+v, want user-1 with role clinician and scope journal:read", claims)
+	}
+	if claims.ID == "" || claims.Issuer != "therma-test" {
+		t.Errorf("ValidateToken = %+v, want a jti and issuer therma-test", claims)
+	}
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != 15*time.Minute {
+		t.Errorf("token lifetime = %v, want JWT_TTL", lifetime)
+	}
+
+	other, err := GenerateToken("user-1")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+	if otherClaims, err := ValidateToken(other); err != nil || otherClaims.ID == claims.ID {
+		t.Errorf("two tokens share jti %q (%v)", claims.ID, err)
+	}
+}
+
+func TestValidateTokenRejects(t *testing.T) {
+	setTestJWTEnv(t)
+	now := time.Now()
+
+	valid := Claims{
+		UserID: "user-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	expired := valid
+	expired.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("failed to sign none token: %v", err)
+	}
+
+	mfaPending, err := GenerateMFAPendingToken("user-1")
+	if err != nil {
+		t.Fatalf("GenerateMFAPendingToken failed: %v", err)
+	}
+	reset, err := GenerateAccountToken("user-1", TokenUsePasswordReset, PasswordResetTokenTTL)
+	if err != nil {
+		t.Fatalf("GenerateAccountToken failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"WrongSecret", signTestHS256(t, valid, "another-secret-0123456789abcdef012345")},
+		{"Expired", signTestHS256(t, expired, testJWTSecret)},
+		{"AlgNone", none},
+		{"Malformed", "not.a.jwt"},
+		{"MFAPendingToken", mfaPending},
+		{"AccountToken", reset},
+		{"UnknownKid", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, valid)
+			token.Header["kid"] = "retired"
+			signed, err := token.SignedString([]byte(testJWTSecret))
+			if err != nil {
+				t.Fatalf("failed to sign token: %v", err)
+			}
+			return signed
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if claims, err := ValidateToken(tt.token); err == nil {
+				t.Errorf("ValidateToken = %+v, want an error", claims)
+			}
+		})
+	}
+}
+
+func TestTokensAreLimitedToTheirUse(t *testing.T) {
+	setTestJWTEnv(t)
+
+	access, err := GenerateToken("user-1")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+	mfaPending, err := GenerateMFAPendingToken("user-1")
+	if err != nil {
+		t.Fatalf("GenerateMFAPendingToken failed: %v", err)
+	}
+	verification, err := GenerateAccountToken("user-1", TokenUseEmailVerification, EmailVerificationTokenTTL)
+	if err != nil {
+		t.Fatalf("GenerateAccountToken failed: %v", err)
+	}
+
+	if claims, err := ValidateMFAPendingToken(mfaPending); err != nil || claims.UserID != "user-1" {
+		t.Errorf("ValidateMFAPendingToken = %+v, %v; want user-1", claims, err)
+	}
+	if _, err := ValidateMFAPendingToken(access); err == nil {
+		t.Error("ValidateMFAPendingToken accepted an access token")
+	}
+
+	if claims, err := ValidateAccountToken(verification, TokenUseEmailVerification); err != nil || claims.UserID != "user-1" {
+		t.Errorf("ValidateAccountToken = %+v, %v; want user-1", claims, err)
+	}
+	if _, err := ValidateAccountToken(verification, TokenUsePasswordReset); err == nil {
+		t.Error("ValidateAccountToken accepted an email verification token as a password reset token")
+	}
+	if _, err := ValidateAccountToken(access, TokenUsePasswordReset); err == nil {
+		t.Error("ValidateAccountToken accepted an access token")
+	}
+
+	if _, err := GenerateAccountToken("user-1", TokenUseMFAPending, time.Minute); err == nil {
+		t.Error("GenerateAccountToken issued an mfa_pending token")
+	}
+}
+
+// useTestKeyring makes keyring the default keyring for the rest of the test
+func useTestKeyring(t *testing.T, keyring *Keyring) {
+	t.Helper()
+	store := &FileKeyringStore{Path: filepath.Join(t.TempDir(), "keyring.json")}
+	if err := store.Save(context.Background(), keyring); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	keyringOnce.Do(func() {})
+	cache, err := keyringOnce.cache, keyringOnce.err
+	keyringOnce.cache, keyringOnce.err = NewKeyringCache(store, time.Hour), nil
+	t.Cleanup(func() { keyringOnce.cache, keyringOnce.err = cache, err })
+}
+
+// TestKeyringRetiresLegacySecret checks that tokens without a kid stop
+// verifying with JWT_SECRET once a keyring is configured, unless the
+// JWT_LEGACY_SECRET_UNTIL window is still open
+func TestKeyringRetiresLegacySecret(t *testing.T) {
+	setTestJWTEnv(t)
+	now := time.Now()
+	legacy := signTestHS256(t, Claims{
+		UserID: "user-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}, testJWTSecret)
+
+	if _, err := ValidateToken(legacy); err != nil {
+		t.Fatalf("ValidateToken of a kid-less token without a keyring failed: %v", err)
+	}
+
+	useTestKeyring(t, &Keyring{Keys: []SigningKey{testSigningKey("a", now.Add(-time.Hour))}})
+
+	tests := []struct {
+		name  string
+		until string
+		valid bool
+	}{
+		{"NoWindow", "", false},
+		{"WindowOpen", now.Add(time.Hour).Format(time.RFC3339), true},
+		{"WindowClosed", now.Add(-time.Second).Format(time.RFC3339), false},
+		{"BadWindow", "tomorrow", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_LEGACY_SECRET_UNTIL", tt.until)
+			claims, err := ValidateToken(legacy)
+			if tt.valid && err != nil {
+				t.Errorf("ValidateToken failed: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("ValidateToken = %+v, want an error", claims)
+			}
+		})
+	}
+
+	// Tokens from the keyring verify regardless
+	token, err := GenerateToken("user-1")
+	if err != nil {
+		t.Fatalf("GenerateToken failed: %v", err)
+	}
+	if _, err := ValidateToken(token); err != nil {
+		t.Errorf("ValidateToken of a keyring token failed: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// minSigningKeyLen is the shortest HS256 signing secret accepted, in bytes
+const minSigningKeyLen = 32
+
+// SigningKey is one HS256 key of a Keyring. Tokens name the key that
+// signed them in their kid header.
+type SigningKey struct {
+	ID          string    `json:"kid"`
+	Secret      []byte    `json:"secret"` // base64 in JSON
+	CreatedAt   time.Time `json:"created_at"`
+	ActivatesAt time.Time `json:"activates_at"` // Signs from this time on; verifies from the moment it is added
+}
+
+// Keyring is the set of token signing keys, stored as JSON, e.g.
+//
+//	{"keys": [{"kid": "3f1c...", "secret": "<base64>", "activates_at": "..."}, ...]}
+//
+// Every key verifies tokens. The key with the latest ActivatesAt that has
+// passed signs new tokens; older keys are retired but keep verifying until
+// pruned. A rotated key is added with an activation time in the future, so
+// every Lambda has loaded it, and can verify its tokens, before any token
+// is signed with it.
+type Keyring struct {
+	Keys []SigningKey `json:"keys"`
+}
+
+// ParseKeyring decodes and validates a keyring document
+func ParseKeyring(data []byte) (*Keyring, error) {
+	var keyring Keyring
+	if err := json.Unmarshal(data, &keyring); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %v", err)
+	}
+	if err := keyring.validate(); err != nil {
+		return nil, err
+	}
+	return &keyring, nil
+}
+
+func (k *Keyring) validate() error {
+	if len(k.Keys) == 0 {
+		return fmt.Errorf("keyring has no keys")
+	}
+
+	seen := map[string]bool{}
+	for _, key := range k.Keys {
+		if key.ID == "" {
+			return fmt.Errorf("keyring has a key without kid")
+		}
+		if seen[key.ID] {
+			return fmt.Errorf("keyring has duplicate kid %q", key.ID)
+		}
+		if len(key.Secret) < minSigningKeyLen {
+			return fmt.Errorf("key %q is shorter than %d bytes", key.ID, minSigningKeyLen)
+		}
+		seen[key.ID] = true
+	}
+	return nil
+}
+
+// Key returns the key with the given kid
+func (k *Keyring) Key(kid string) (*SigningKey, bool) {
+	for i := range k.Keys {
+		if k.Keys[i].ID == kid {
+			return &k.Keys[i], true
+		}
+	}
+	return nil, false
+}
+
+// Active returns the key that signs tokens at now: the most recently
+// activated one
+func (k *Keyring) Active(now time.Time) (*SigningKey, bool) {
+	var active *SigningKey
+	for i := range k.Keys {
+		key := &k.Keys[i]
+		if key.ActivatesAt.After(now) {
+			continue
+		}
+		if active == nil || key.ActivatesAt.After(active.ActivatesAt) {
+			active = key
+		}
+	}
+	return active, active != nil
+}
+
+// Rotate adds a new key that becomes the active key after delay. Until
+// then it only verifies. The current key keeps verifying afterwards, so no
+// outstanding token is invalidated.
+func (k *Keyring) Rotate(now time.Time, delay time.Duration) (*SigningKey, error) {
+	secret := make([]byte, minSigningKeyLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate key ID: %v", err)
+	}
+
+	k.Keys = append(k.Keys, SigningKey{
+		ID:          hex.EncodeToString(id),
+		Secret:      secret,
+		CreatedAt:   now.UTC(),
+		ActivatesAt: now.Add(delay).UTC(),
+	})
+
+	return &k.Keys[len(k.Keys)-1], nil
+}
+
+// Prune removes keys that were superseded by a newer active key more than
+// maxTokenLifetime ago, so every token they signed has expired, and returns
+// their kids
+func (k *Keyring) Prune(now time.Time, maxTokenLifetime time.Duration) []string {
+	active, ok := k.Active(now)
+	if !ok {
+		return nil
+	}
+
+	var pruned []string
+	keys := k.Keys[:0]
+	for _, key := range k.Keys {
+		if key.ActivatesAt.Before(active.ActivatesAt) && now.Sub(k.supersededAt(key)) > maxTokenLifetime {
+			pruned = append(pruned, key.ID)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	k.Keys = keys
+	return pruned
+}
+
+// supersededAt returns when the first key activated after key did
+func (k *Keyring) supersededAt(key SigningKey) time.Time {
+	var at time.Time
+	for _, other := range k.Keys {
+		if other.ActivatesAt.After(key.ActivatesAt) && (at.IsZero() || other.ActivatesAt.Before(at)) {
+			at = other.ActivatesAt
+		}
+	}
+	return at
+}
+
+// KeyringStore loads and saves the keyring document
+type KeyringStore interface {
+	Load(ctx context.Context) (*Keyring, error)
+	Save(ctx context.Context, keyring *Keyring) error
+}
+
+// FileKeyringStore keeps the keyring in a local JSON file, for development
+type FileKeyringStore struct {
+	Path string
+}
+
+func (s *FileKeyringStore) Load(ctx context.Context) (*Keyring, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring file: %v", err)
+	}
+	return ParseKeyring(data)
+}
+
+func (s *FileKeyringStore) Save(ctx context.Context, keyring *Keyring) error {
+	if err := keyring.validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal keyring: %v", err)
+	}
+	if err := os.WriteFile(s.Path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write keyring file: %v", err)
+	}
+	return nil
+}
+
+// KeyringStoreFromEnv returns the store named by JWT_KEYRING_SECRET_ID (a
+// Secrets Manager secret) or JWT_KEYRING_FILE, or nil if neither is set
+func KeyringStoreFromEnv() (KeyringStore, error) {
+	if secretID := os.Getenv("JWT_KEYRING_SECRET_ID"); secretID != "" {
+		return NewSecretsManagerKeyringStore(secretID)
+	}
+	if path := os.Getenv("JWT_KEYRING_FILE"); path != "" {
+		return &FileKeyringStore{Path: path}, nil
+	}
+	return nil, nil
+}
+
+// KeyringCache serves signing and verification keys from a KeyringStore.
+// The keyring is reloaded every refresh interval, which must be shorter
+// than the activation delay of rotated keys, and when a token names an
+// unknown kid. It is safe for concurrent use.
+type KeyringCache struct {
+	store              KeyringStore
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	now                func() time.Time
+
+	mu          sync.RWMutex
+	keyring     *Keyring
+	loadedAt    time.Time
+	attemptedAt time.Time
+	loadMu      sync.Mutex
+}
+
+func NewKeyringCache(store KeyringStore, refreshInterval time.Duration) *KeyringCache {
+	if refreshInterval == 0 {
+		refreshInterval = 5 * time.Minute
+	}
+	return &KeyringCache{
+		store:              store,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: 30 * time.Second,
+		now:                time.Now,
+	}
+}
+
+// SigningKey returns the active key
+func (c *KeyringCache) SigningKey(ctx context.Context) (*SigningKey, error) {
+	keyring, err := c.current(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyring.Active(c.now())
+	if !ok {
+		return nil, fmt.Errorf("keyring has no active key yet")
+	}
+	return key, nil
+}
+
+// VerificationKey returns the key with the given kid, active or retired
+func (c *KeyringCache) VerificationKey(ctx context.Context, kid string) (*SigningKey, error) {
+	keyring, err := c.current(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keyring.Key(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// current returns the cached keyring, reloading it when stale or when it
+// does not contain kid
+func (c *KeyringCache) current(ctx context.Context, kid string) (*Keyring, error) {
+	c.mu.RLock()
+	keyring := c.keyring
+	fresh := c.now().Sub(c.loadedAt) < c.refreshInterval
+	c.mu.RUnlock()
+
+	if keyring != nil && fresh {
+		if _, ok := keyring.Key(kid); kid == "" || ok {
+			return keyring, nil
+		}
+	}
+
+	if err := c.reload(ctx); err != nil {
+		if keyring != nil {
+			// Keep serving the keys we have while the store is unavailable
+			log.Printf("keyring: reload failed, using cached keyring: %v", err)
+			return keyring, nil
+		}
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.keyring, nil
+}
+
+// reload loads the keyring, at most once per minRefreshInterval so tokens
+// with made-up kids cannot cause a store read per request
+func (c *KeyringCache) reload(ctx context.Context) error {
+	c.loadMu.Lock()
+	defer c.loadMu.Unlock()
+
+	c.mu.RLock()
+	loaded := c.keyring != nil
+	sinceAttempt := c.now().Sub(c.attemptedAt)
+	c.mu.RUnlock()
+
+	if loaded && sinceAttempt < c.minRefreshInterval {
+		return nil
+	}
+
+	c.mu.Lock()
+	c.attemptedAt = c.now()
+	c.mu.Unlock()
+
+	keyring, err := c.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.keyring = keyring
+	c.loadedAt = c.now()
+	c.mu.Unlock()
+
+	return nil
+}
+
+var keyringOnce struct {
+	sync.Once
+	cache *KeyringCache
+	err   error
+}
+
+// defaultKeyring is created from the environment on first use and shared by
+// every request of a warm Lambda. It is nil if no keyring is configured, in
+// which case tokens are signed with JWT_SECRET and carry no kid.
+func defaultKeyring() (*KeyringCache, error) {
+	keyringOnce.Do(func() {
+		store, err := KeyringStoreFromEnv()
+		if err != nil || store == nil {
+			keyringOnce.err = err
+			return
+		}
+
+		var refresh time.Duration
+		if raw := os.Getenv("JWT_KEYRING_REFRESH"); raw != "" {
+			refresh, err = time.ParseDuration(raw)
+			if err != nil || refresh <= 0 {
+				keyringOnce.err = fmt.Errorf("invalid JWT_KEYRING_REFRESH %q", raw)
+				return
+			}
+		}
+		keyringOnce.cache = NewKeyringCache(store, refresh)
+	})
+	return keyringOnce.cache, keyringOnce.err
+}
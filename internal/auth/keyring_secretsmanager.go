@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// SecretsManagerKeyringStore keeps the keyring as the JSON string of a
+// Secrets Manager secret. Every Save is a new secret version.
+type SecretsManagerKeyringStore struct {
+	client   *secretsmanager.Client
+	secretID string
+}
+
+func NewSecretsManagerKeyringStore(secretID string) (*SecretsManagerKeyringStore, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	return &SecretsManagerKeyringStore{
+		client:   secretsmanager.NewFromConfig(cfg),
+		secretID: secretID,
+	}, nil
+}
+
+func (s *SecretsManagerKeyringStore) Load(ctx context.Context) (*Keyring, error) {
+	result, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(s.secretID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get keyring secret: %v", err)
+	}
+	if result.SecretString == nil {
+		return nil, fmt.Errorf("keyring secret %s has no string value", s.secretID)
+	}
+
+	return ParseKeyring([]byte(*result.SecretString))
+}
+
+func (s *SecretsManagerKeyringStore) Save(ctx context.Context, keyring *Keyring) error {
+	if err := keyring.validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(keyring)
+	if err != nil {
+		return fmt.Errorf("failed to marshal keyring: %v", err)
+	}
+
+	_, err = s.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(s.secretID),
+		SecretString: aws.String(string(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save keyring secret: %v", err)
+	}
+
+	return nil
+}
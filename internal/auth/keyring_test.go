@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func testSigningKey(id string, activatesAt time.Time) SigningKey {
+	return SigningKey{ID: id, Secret: bytes.Repeat([]byte(id[:1]), minSigningKeyLen), CreatedAt: activatesAt, ActivatesAt: activatesAt}
+}
+
+func TestParseKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"Valid", `{"keys":[{"kid":"a","secret":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, false},
+		{"NotJSON", `keys`, true},
+		{"NoKeys", `{"keys":[]}`, true},
+		{"NoKid", `{"keys":[{"secret":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, true},
+		{"ShortSecret", `{"keys":[{"kid":"a","secret":"c2hvcnQ="}]}`, true},
+		{"DuplicateKid", `{"keys":[{"kid":"a","secret":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="},{"kid":"a","secret":"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseKeyring([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseKeyring error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	now := time.Now()
+	keyring := &Keyring{Keys: []SigningKey{testSigningKey("old", now.Add(-48*time.Hour))}}
+
+	rotated, err := keyring.Rotate(now, time.Hour)
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if err := keyring.validate(); err != nil {
+		t.Fatalf("keyring is invalid after Rotate: %v", err)
+	}
+
+	if active, _ := keyring.Active(now); active.ID != "old" {
+		t.Errorf("Active before the activation delay = %q, want old", active.ID)
+	}
+	if _, ok := keyring.Key(rotated.ID); !ok {
+		t.Error("rotated key does not verify before it activates")
+	}
+	if active, _ := keyring.Active(now.Add(time.Hour)); active.ID != rotated.ID {
+		t.Errorf("Active after the activation delay = %q, want %q", active.ID, rotated.ID)
+	}
+
+	// The old key signed tokens until the new one activated, so it is kept
+	// until those have expired
+	if pruned := keyring.Prune(now.Add(2*time.Hour), 24*time.Hour); len(pruned) != 0 {
+		t.Errorf("Prune within the token lifetime removed %v", pruned)
+	}
+	if pruned := keyring.Prune(now.Add(26*time.Hour), 24*time.Hour); !slices.Equal(pruned, []string{"old"}) {
+		t.Errorf("Prune = %v, want [old]", pruned)
+	}
+	if _, ok := keyring.Key(rotated.ID); !ok || len(keyring.Keys) != 1 {
+		t.Errorf("keys after Prune = %+v, want only the active key", keyring.Keys)
+	}
+
+	if _, ok := (&Keyring{Keys: []SigningKey{testSigningKey("future", now.Add(time.Hour))}}).Active(now); ok {
+		t.Error("Active returned a key that has not activated yet")
+	}
+}
+
+// TestKeyringCacheReloadsForUnknownKid checks that a token signed with a
+// key added since the last load is verified after a reload, and that made-up
+// kids do not reload more than once per minRefreshInterval
+func TestKeyringCacheReloadsForUnknownKid(t *testing.T) {
+	now := time.Now()
+	store := &FileKeyringStore{Path: filepath.Join(t.TempDir(), "keyring.json")}
+	ctx := context.Background()
+
+	keyring := &Keyring{Keys: []SigningKey{testSigningKey("a", now.Add(-time.Hour))}}
+	if err := store.Save(ctx, keyring); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	cache := NewKeyringCache(store, time.Hour)
+	cache.now = func() time.Time { return now }
+
+	if key, err := cache.SigningKey(ctx); err != nil || key.ID != "a" {
+		t.Fatalf("SigningKey = %v, %v; want a", key, err)
+	}
+
+	keyring.Keys = append(keyring.Keys, testSigningKey("b", now.Add(time.Hour)))
+	if err := store.Save(ctx, keyring); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	if _, err := cache.VerificationKey(ctx, "b"); err == nil {
+		t.Fatal("VerificationKey reloaded within minRefreshInterval")
+	}
+
+	now = now.Add(cache.minRefreshInterval)
+	if key, err := cache.VerificationKey(ctx, "b"); err != nil || key.ID != "b" {
+		t.Fatalf("VerificationKey after minRefreshInterval = %v, %v; want b", key, err)
+	}
+	if key, err := cache.SigningKey(ctx); err != nil || key.ID != "a" {
+		t.Errorf("SigningKey = %v, %v; want a until b activates", key, err)
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Role is what kind of user a caller is. Roles grant permissions; a token's
+// scopes can only narrow them.
+type Role string
+
+const (
+	// RolePatient keeps a journal. Tokens without roles are patients, as
+	// every account was before roles existed.
+	RolePatient Role = "patient"
+
+	// RoleClinician reads the journals patients share with them
+	RoleClinician Role = "clinician"
+
+	// RoleSupport operates accounts and must never see PHI
+	RoleSupport Role = "support"
+)
+
+// Permission is an action a handler checks before doing it. Permissions
+// double as the scope names of tokens.
+type Permission string
+
+const (
+	PermJournalRead       Permission = "journal:read"        // the caller's own entries
+	PermJournalWrite      Permission = "journal:write"       // the caller's own entries
+	PermSharedJournalRead Permission = "journal:read:shared" // entries patients shared with the caller
+	PermSharesWrite       Permission = "shares:write"        // grant and revoke access to the caller's journal
+	PermAccountDelete     Permission = "account:delete"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RolePatient: {
+		PermJournalRead,
+		PermJournalWrite,
+		PermSharesWrite,
+		PermAccountDelete,
+	},
+	RoleClinician: {
+		PermSharedJournalRead,
+	},
+	RoleSupport: {},
+}
+
+// PermissionError is returned by Authorize when the caller lacks a
+// permission
+type PermissionError struct {
+	Permission Permission
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("missing permission %s", e.Permission)
+}
+
+// EffectiveRoles returns the caller's roles, defaulting to patient
+func (c *Claims) EffectiveRoles() []Role {
+	if len(c.Roles) == 0 {
+		return []Role{RolePatient}
+	}
+
+	roles := make([]Role, 0, len(c.Roles))
+	for _, role := range c.Roles {
+		roles = append(roles, Role(role))
+	}
+	return roles
+}
+
+// HasPermission reports whether one of the caller's roles grants permission
+// and, if the token is scoped, the token carries it as a scope. Unknown
+// roles grant nothing.
+func (c *Claims) HasPermission(permission Permission) bool {
+	if len(c.Scopes) > 0 && !slices.Contains(c.Scopes, string(permission)) {
+		return false
+	}
+
+	for _, role := range c.EffectiveRoles() {
+		if slices.Contains(rolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns a *PermissionError naming the first of permissions the
+// caller lacks, or nil if it has them all
+func Authorize(claims *Claims, permissions ...Permission) error {
+	for _, permission := range permissions {
+		if !claims.HasPermission(permission) {
+			return &PermissionError{Permission: permission}
+		}
+	}
+	return nil
+}
+
+// IsValidRole reports whether role is one of the known roles
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[Role(role)]
+	return ok
+}
@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultRefreshTokenTTL is used when REFRESH_TOKEN_TTL is not set
+const DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// GenerateRefreshToken returns a new opaque refresh token and the hash to
+// store for it. The token itself is only ever given to the client.
+func GenerateRefreshToken() (token, tokenHash string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the stored form of a refresh token. Tokens carry
+// 256 bits of entropy, so an unsalted SHA-256 is enough to make a leaked
+// table useless.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshTokenTTL returns how long a refresh token can be used, from
+// REFRESH_TOKEN_TTL
+func RefreshTokenTTL() (time.Duration, error) {
+	ttl := os.Getenv("REFRESH_TOKEN_TTL")
+	if ttl == "" {
+		return DefaultRefreshTokenTTL, nil
+	}
+
+	duration, err := time.ParseDuration(ttl)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid REFRESH_TOKEN_TTL: %q", ttl)
+	}
+
+	return duration, nil
+}
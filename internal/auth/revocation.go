@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTokenRevoked is returned by ValidateToken for tokens that were revoked
+// by logout, or issued before the user logged out of all devices
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// ErrRevocationDisabled is returned when revoking without a configured
+// RevocationStore
+var ErrRevocationDisabled = errors.New("token revocation is not configured")
+
+// RevocationStore records revoked tokens until they would have expired
+// anyway. Entries past their expiry may be dropped at any time.
+type RevocationStore interface {
+	// RevokeToken revokes the token with the given jti
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+
+	// RevokeUser revokes every token of userID issued at or before
+	// revokedAt; the entry must be kept until expiresAt
+	RevokeUser(ctx context.Context, userID string, revokedAt, expiresAt time.Time) error
+
+	// Lookup returns the revocation state of a token. jti may be empty for
+	// tokens without one, in which case only the user is looked up.
+	Lookup(ctx context.Context, jti, userID string) (RevocationStatus, error)
+}
+
+// RevocationStatus is what a RevocationStore knows about one token
+type RevocationStatus struct {
+	TokenRevoked  bool
+	UserRevokedAt time.Time // Zero if the user never logged out of all devices
+}
+
+// Revoked reports whether a token issued at issuedAt is revoked. Times are
+// compared in whole seconds, like iat, so a token issued in the same second
+// as a log out of all devices is revoked too.
+func (s RevocationStatus) Revoked(issuedAt time.Time) bool {
+	if s.TokenRevoked {
+		return true
+	}
+	return !s.UserRevokedAt.IsZero() && issuedAt.Unix() <= s.UserRevokedAt.Unix()
+}
+
+// MemoryRevocationStore is an in-process RevocationStore for tests and local
+// development; revocations only apply within the process
+type MemoryRevocationStore struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time // jti -> expiresAt
+	users  map[string]memoryUserRevocation
+	now    func() time.Time
+}
+
+type memoryUserRevocation struct {
+	revokedAt time.Time
+	expiresAt time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		tokens: map[string]time.Time{},
+		users:  map[string]memoryUserRevocation{},
+		now:    time.Now,
+	}
+}
+
+func (s *MemoryRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	s.tokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(ctx context.Context, userID string, revokedAt, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	if current, ok := s.users[userID]; ok && current.revokedAt.After(revokedAt) {
+		return nil
+	}
+	s.users[userID] = memoryUserRevocation{revokedAt: revokedAt, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *MemoryRevocationStore) Lookup(ctx context.Context, jti, userID string) (RevocationStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var status RevocationStatus
+	now := s.now()
+	if expiresAt, ok := s.tokens[jti]; ok && jti != "" && now.Before(expiresAt) {
+		status.TokenRevoked = true
+	}
+	if user, ok := s.users[userID]; ok && now.Before(user.expiresAt) {
+		status.UserRevokedAt = user.revokedAt
+	}
+	return status, nil
+}
+
+// sweep drops expired entries, as the DynamoDB TTL does
+func (s *MemoryRevocationStore) sweep() {
+	now := s.now()
+	for jti, expiresAt := range s.tokens {
+		if !now.Before(expiresAt) {
+			delete(s.tokens, jti)
+		}
+	}
+	for userID, user := range s.users {
+		if !now.Before(user.expiresAt) {
+			delete(s.users, userID)
+		}
+	}
+}
+
+// RevokerConfig tunes a Revoker
+type RevokerConfig struct {
+	// CacheTTL is how long a lookup is reused. A revocation made by another
+	// Lambda instance takes up to this long to be seen here.
+	CacheTTL time.Duration
+
+	// MaxCacheEntries bounds the lookup cache
+	MaxCacheEntries int
+
+	// MaxTokenLifetime is the longest any accepted token lives; a log out
+	// of all devices is remembered this long
+	MaxTokenLifetime time.Duration
+}
+
+// DefaultRevokerConfig suits Cognito tokens, which live at most a day
+var DefaultRevokerConfig = RevokerConfig{
+	CacheTTL:         30 * time.Second,
+	MaxCacheEntries:  10000,
+	MaxTokenLifetime: 24 * time.Hour,
+}
+
+// Revoker revokes tokens and checks tokens against a RevocationStore,
+// caching lookups briefly so most requests do not reach the store. It is
+// safe for concurrent use.
+type Revoker struct {
+	store  RevocationStore
+	config RevokerConfig
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedRevocation
+}
+
+type cachedRevocation struct {
+	status    RevocationStatus
+	fetchedAt time.Time
+}
+
+func NewRevoker(store RevocationStore, config RevokerConfig) *Revoker {
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultRevokerConfig.CacheTTL
+	}
+	if config.MaxCacheEntries == 0 {
+		config.MaxCacheEntries = DefaultRevokerConfig.MaxCacheEntries
+	}
+	if config.MaxTokenLifetime == 0 {
+		config.MaxTokenLifetime = DefaultRevokerConfig.MaxTokenLifetime
+	}
+
+	return &Revoker{
+		store:  store,
+		config: config,
+		now:    time.Now,
+		cache:  map[string]cachedRevocation{},
+	}
+}
+
+// NewRevokerFromEnv configures a Revoker with the REVOCATION_STORE backend
+// ("dynamodb" or "memory") and REVOCATION_CACHE_TTL. MaxTokenLifetime is
+// raised to JWT_TTL if that is longer. It returns nil if REVOCATION_STORE is
+// not set.
+func NewRevokerFromEnv() (*Revoker, error) {
+	var store RevocationStore
+	switch backend := os.Getenv("REVOCATION_STORE"); backend {
+	case "":
+		return nil, nil
+	case "dynamodb":
+		dynamoStore, err := NewDynamoRevocationStore()
+		if err != nil {
+			return nil, err
+		}
+		store = dynamoStore
+	case "memory":
+		store = NewMemoryRevocationStore()
+	default:
+		return nil, fmt.Errorf("unknown REVOCATION_STORE %q", backend)
+	}
+
+	config := DefaultRevokerConfig
+	if raw := os.Getenv("REVOCATION_CACHE_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid REVOCATION_CACHE_TTL %q", raw)
+		}
+		config.CacheTTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("JWT_TTL")); err == nil && ttl > config.MaxTokenLifetime {
+		config.MaxTokenLifetime = ttl
+	}
+
+	return NewRevoker(store, config), nil
+}
+
+// Check returns ErrTokenRevoked if claims belong to a revoked token
+func (r *Revoker) Check(ctx context.Context, claims *Claims) error {
+	status, err := r.lookup(ctx, claims.ID, claims.UserID)
+	if err != nil {
+		return err
+	}
+
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	if status.Revoked(issuedAt) {
+		return ErrTokenRevoked
+	}
+
+	return nil
+}
+
+// RevokeToken revokes the token with the given claims until it expires
+func (r *Revoker) RevokeToken(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" {
+		return fmt.Errorf("token has no jti; log out of all devices instead")
+	}
+
+	expiresAt := r.now().Add(r.config.MaxTokenLifetime)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	if err := r.store.RevokeToken(ctx, claims.ID, expiresAt); err != nil {
+		return err
+	}
+
+	r.invalidate(func(key string) bool {
+		return key == cacheKey(claims.ID, claims.UserID)
+	})
+	return nil
+}
+
+// RevokeUser revokes every token of userID issued until now
+func (r *Revoker) RevokeUser(ctx context.Context, userID string) error {
+	now := r.now()
+	if err := r.store.RevokeUser(ctx, userID, now, now.Add(r.config.MaxTokenLifetime)); err != nil {
+		return err
+	}
+
+	r.invalidate(func(key string) bool {
+		return strings.HasSuffix(key, "|"+userID)
+	})
+	return nil
+}
+
+func (r *Revoker) lookup(ctx context.Context, jti, userID string) (RevocationStatus, error) {
+	key := cacheKey(jti, userID)
+	now := r.now()
+
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && now.Sub(cached.fetchedAt) < r.config.CacheTTL {
+		return cached.status, nil
+	}
+
+	status, err := r.store.Lookup(ctx, jti, userID)
+	if err != nil {
+		return RevocationStatus{}, fmt.Errorf("failed to check token revocation: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= r.config.MaxCacheEntries {
+		for k, entry := range r.cache {
+			if now.Sub(entry.fetchedAt) >= r.config.CacheTTL {
+				delete(r.cache, k)
+			}
+		}
+		if len(r.cache) >= r.config.MaxCacheEntries {
+			clear(r.cache)
+		}
+	}
+	r.cache[key] = cachedRevocation{status: status, fetchedAt: now}
+
+	return status, nil
+}
+
+// invalidate drops cached lookups so this instance sees its own
+// revocations immediately
+func (r *Revoker) invalidate(match func(key string) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.cache {
+		if match(key) {
+			delete(r.cache, key)
+		}
+	}
+}
+
+func cacheKey(jti, userID string) string {
+	return jti + "|" + userID
+}
+
+var revokerOnce struct {
+	sync.Once
+	revoker *Revoker
+	err     error
+}
+
+// DefaultRevoker is created from the environment on first use and shared
+// by every request of a warm Lambda. It is nil if revocation is not
+// configured.
+func DefaultRevoker() (*Revoker, error) {
+	revokerOnce.Do(func() {
+		revokerOnce.revoker, revokerOnce.err = NewRevokerFromEnv()
+	})
+	return revokerOnce.revoker, revokerOnce.err
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoRevocationStore keeps revocations in a DynamoDB table keyed by pk,
+// "token#<jti>" or "user#<user ID>". Items carry expires_at in Unix seconds,
+// which the table's TTL uses to delete them.
+type DynamoRevocationStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoRevocationStore() (*DynamoRevocationStore, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	tableName := "therma-token-revocations"
+	if envTable := os.Getenv("REVOCATIONS_TABLE_NAME"); envTable != "" {
+		tableName = envTable
+	}
+
+	return &DynamoRevocationStore{
+		client:    dynamodb.NewFromConfig(cfg),
+		tableName: tableName,
+	}, nil
+}
+
+func (s *DynamoRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]types.AttributeValue{
+			"pk":         &types.AttributeValueMemberS{Value: "token#" + jti},
+			"expires_at": unixAttribute(expiresAt),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %v", err)
+	}
+
+	return nil
+}
+
+// RevokeUser never moves revoked_at backwards, so concurrent log outs of
+// all devices keep the latest
+func (s *DynamoRevocationStore) RevokeUser(ctx context.Context, userID string, revokedAt, expiresAt time.Time) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: "user#" + userID},
+		},
+		UpdateExpression: aws.String("SET revoked_at = :revoked_at, expires_at = :expires_at"),
+		ConditionExpression: aws.String(
+			"attribute_not_exists(revoked_at) OR revoked_at <= :revoked_at"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked_at": unixAttribute(revokedAt),
+			":expires_at": unixAttribute(expiresAt),
+		},
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return nil
+		}
+		return fmt.Errorf("failed to revoke user tokens: %v", err)
+	}
+
+	return nil
+}
+
+// Lookup reads the token and user items in one strongly consistent batch
+func (s *DynamoRevocationStore) Lookup(ctx context.Context, jti, userID string) (RevocationStatus, error) {
+	keys := []map[string]types.AttributeValue{
+		{"pk": &types.AttributeValueMemberS{Value: "user#" + userID}},
+	}
+	if jti != "" {
+		keys = append(keys, map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: "token#" + jti},
+		})
+	}
+
+	result, err := s.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]types.KeysAndAttributes{
+			s.tableName: {Keys: keys, ConsistentRead: aws.Bool(true)},
+		},
+	})
+	if err != nil {
+		return RevocationStatus{}, fmt.Errorf("failed to look up revocations: %v", err)
+	}
+	if len(result.UnprocessedKeys) > 0 {
+		return RevocationStatus{}, fmt.Errorf("failed to look up revocations: request throttled")
+	}
+
+	var status RevocationStatus
+	now := time.Now()
+	for _, item := range result.Responses[s.tableName] {
+		// TTL deletion lags expiry by up to a couple of days
+		if expiresAt, ok := unixValue(item["expires_at"]); ok && !now.Before(expiresAt) {
+			continue
+		}
+
+		pk, _ := item["pk"].(*types.AttributeValueMemberS)
+		switch {
+		case pk == nil:
+		case pk.Value == "token#"+jti:
+			status.TokenRevoked = true
+		case pk.Value == "user#"+userID:
+			status.UserRevokedAt, _ = unixValue(item["revoked_at"])
+		}
+	}
+
+	return status, nil
+}
+
+func unixAttribute(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(t.Unix(), 10)}
+}
+
+func unixValue(value types.AttributeValue) (time.Time, bool) {
+	n, ok := value.(*types.AttributeValueMemberN)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(n.Value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testClaims(jti, userID string, issuedAt time.Time) *Claims {
+	return &Claims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(time.Hour)),
+		},
+	}
+}
+
+func TestRevokerRevokeToken(t *testing.T) {
+	r := NewRevoker(NewMemoryRevocationStore(), DefaultRevokerConfig)
+	ctx := context.Background()
+	now := time.Now()
+
+	revoked := testClaims("jti-1", "user-1", now)
+	other := testClaims("jti-2", "user-1", now)
+
+	// Look both up first, so the revocation must invalidate the cache
+	for _, claims := range []*Claims{revoked, other} {
+		if err := r.Check(ctx, claims); err != nil {
+			t.Fatalf("Check before revocation = %v, want nil", err)
+		}
+	}
+
+	if err := r.RevokeToken(ctx, revoked); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+
+	if err := r.Check(ctx, revoked); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Check of the revoked token = %v, want ErrTokenRevoked", err)
+	}
+	if err := r.Check(ctx, other); err != nil {
+		t.Errorf("Check of another token of the user = %v, want nil", err)
+	}
+
+	if err := r.RevokeToken(ctx, testClaims("", "user-1", now)); err == nil {
+		t.Error("RevokeToken of a token without jti succeeded")
+	}
+}
+
+func TestRevokerRevokeUser(t *testing.T) {
+	r := NewRevoker(NewMemoryRevocationStore(), DefaultRevokerConfig)
+	ctx := context.Background()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	before := testClaims("jti-1", "user-1", now.Add(-time.Minute))
+	sameSecond := testClaims("jti-2", "user-1", now)
+	after := testClaims("jti-3", "user-1", now.Add(time.Second))
+	otherUser := testClaims("jti-4", "user-2", now.Add(-time.Minute))
+
+	if err := r.Check(ctx, before); err != nil {
+		t.Fatalf("Check before revocation = %v, want nil", err)
+	}
+
+	if err := r.RevokeUser(ctx, "user-1"); err != nil {
+		t.Fatalf("RevokeUser failed: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		claims  *Claims
+		revoked bool
+	}{
+		{"IssuedBefore", before, true},
+		{"IssuedInSameSecond", sameSecond, true},
+		{"IssuedAfter", after, false},
+		{"OtherUser", otherUser, false},
+		{"NoIssuedAt", &Claims{UserID: "user-1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Check(ctx, tt.claims)
+			if tt.revoked && !errors.Is(err, ErrTokenRevoked) {
+				t.Errorf("Check = %v, want ErrTokenRevoked", err)
+			}
+			if !tt.revoked && err != nil {
+				t.Errorf("Check = %v, want nil", err)
+			}
+		})
+	}
+}
+
+// TestRevokerCachesLookups checks that a revocation made through another
+// instance is seen once the cached lookup expires
+func TestRevokerCachesLookups(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	config := RevokerConfig{CacheTTL: 30 * time.Second}
+	local, remote := NewRevoker(store, config), NewRevoker(store, config)
+	ctx := context.Background()
+	now := time.Now()
+	local.now = func() time.Time { return now }
+
+	claims := testClaims("jti-1", "user-1", now)
+	if err := local.Check(ctx, claims); err != nil {
+		t.Fatalf("Check before revocation = %v, want nil", err)
+	}
+
+	if err := remote.RevokeToken(ctx, claims); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+
+	if err := local.Check(ctx, claims); err != nil {
+		t.Errorf("Check within CacheTTL = %v, want the cached nil", err)
+	}
+
+	now = now.Add(config.CacheTTL)
+	if err := local.Check(ctx, claims); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("Check after CacheTTL = %v, want ErrTokenRevoked", err)
+	}
+}
+
+func TestMemoryRevocationStoreExpiry(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	ctx := context.Background()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	if err := store.RevokeToken(ctx, "jti-1", now.Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	if err := store.RevokeUser(ctx, "user-1", now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeUser failed: %v", err)
+	}
+
+	// An older log out of all devices does not replace a newer one
+	if err := store.RevokeUser(ctx, "user-1", now.Add(-time.Minute), now.Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeUser failed: %v", err)
+	}
+
+	status, err := store.Lookup(ctx, "jti-1", "user-1")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if !status.TokenRevoked || !status.UserRevokedAt.Equal(now) {
+		t.Errorf("Lookup = %+v, want the token revoked and the user revoked at %v", status, now)
+	}
+
+	if status, err := store.Lookup(ctx, "", "user-2"); err != nil || status.TokenRevoked || !status.UserRevokedAt.IsZero() {
+		t.Errorf("Lookup of an unknown user = %+v, %v; want nothing revoked", status, err)
+	}
+
+	now = now.Add(time.Hour)
+	status, err = store.Lookup(ctx, "jti-1", "user-1")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if status.TokenRevoked || !status.UserRevokedAt.IsZero() {
+		t.Errorf("Lookup after expiry = %+v, want nothing revoked", status)
+	}
+}
+
+func TestNewRevokerFromEnv(t *testing.T) {
+	t.Setenv("REVOCATION_STORE", "")
+	if r, err := NewRevokerFromEnv(); r != nil || err != nil {
+		t.Errorf("NewRevokerFromEnv without REVOCATION_STORE = %v, %v; want nil, nil", r, err)
+	}
+
+	t.Setenv("REVOCATION_STORE", "memory")
+	t.Setenv("REVOCATION_CACHE_TTL", "5s")
+	t.Setenv("JWT_TTL", "48h")
+	r, err := NewRevokerFromEnv()
+	if err != nil {
+		t.Fatalf("NewRevokerFromEnv failed: %v", err)
+	}
+	if r.config.CacheTTL != 5*time.Second || r.config.MaxTokenLifetime != 48*time.Hour {
+		t.Errorf("config = %+v, want a 5s cache and 48h token lifetime", r.config)
+	}
+
+	t.Setenv("REVOCATION_CACHE_TTL", "soon")
+	if _, err := NewRevokerFromEnv(); err == nil {
+		t.Error("NewRevokerFromEnv with an invalid REVOCATION_CACHE_TTL succeeded")
+	}
+
+	t.Setenv("REVOCATION_STORE", "redis")
+	if _, err := NewRevokerFromEnv(); err == nil {
+		t.Error("NewRevokerFromEnv with an unknown REVOCATION_STORE succeeded")
+	}
+}
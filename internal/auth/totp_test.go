@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors,
+// "12345678901234567890", base32-encoded
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTPRFC6238Vectors(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, tt.code, now, 0)
+		if !ok {
+			t.Errorf("ValidateTOTP(%q) at %d rejected the RFC 6238 code", tt.code, tt.unix)
+			continue
+		}
+		if want := tt.unix / 30; step != want {
+			t.Errorf("ValidateTOTP at %d = step %d, want %d", tt.unix, step, want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret failed: %v", err)
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q is not base32: %v", secret, err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	current := now.Unix() / 30
+	code := totpCode(key, current)
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		want     bool
+	}{
+		{"Current", secret, code, 0, true},
+		{"Spaced", secret, code[:3] + " " + code[3:], 0, true},
+		{"LowercaseSecret", strings.ToLower(secret), code, 0, true},
+		{"PreviousStep", secret, totpCode(key, current-1), 0, true},
+		{"NextStep", secret, totpCode(key, current+1), 0, true},
+		{"TooOld", secret, totpCode(key, current-2), 0, false},
+		{"TooEarly", secret, totpCode(key, current+2), 0, false},
+		{"Replayed", secret, code, current, false},
+		{"OlderThanLastUsed", secret, totpCode(key, current-1), current, false},
+		{"WrongLength", secret, code[:5], 0, false},
+		{"BadSecret", "not base32!", code, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok := ValidateTOTP(tt.secret, tt.code, now, tt.lastStep); ok != tt.want {
+				t.Errorf("ValidateTOTP = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(TOTPURI("Therma", "ann@example.com", rfc6238Secret))
+	if err != nil {
+		t.Fatalf("TOTPURI is not a URI: %v", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Therma:ann@example.com" {
+		t.Errorf("TOTPURI = %s, want otpauth://totp/Therma:ann@example.com", uri)
+	}
+	query := uri.Query()
+	if query.Get("secret") != rfc6238Secret || query.Get("issuer") != "Therma" || query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Errorf("TOTPURI query = %v", query)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes failed: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("GenerateRecoveryCodes returned %d codes, want 10", len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Errorf("recovery code %q is not four groups of four", code)
+		}
+		if seen[code] {
+			t.Errorf("recovery code %q was generated twice", code)
+		}
+		seen[code] = true
+	}
+
+	code := codes[0]
+	loose := strings.ToUpper(strings.ReplaceAll(code, "-", " "))
+	if HashRecoveryCode(loose) != HashRecoveryCode(code) {
+		t.Errorf("HashRecoveryCode(%q) differs from HashRecoveryCode(%q)", loose, code)
+	}
+	if HashRecoveryCode(codes[1]) == HashRecoveryCode(code) {
+		t.Error("two recovery codes have the same hash")
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+)
+
+const accountTokenColumns = `id, user_id, purpose, token_hash, created_at, expires_at, used_at`
+
+// AccountTokenRepository stores the hashes of mailed email verification and
+// password reset tokens
+type AccountTokenRepository struct {
+	db DBTX
+}
+
+func NewAccountTokenRepository(db DBTX) *AccountTokenRepository {
+	return &AccountTokenRepository{db: db}
+}
+
+// Create inserts a token, filling in ID and CreatedAt
+func (r *AccountTokenRepository) Create(ctx context.Context, token *models.AccountToken) error {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO account_tokens (user_id, purpose, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		token.UserID, token.Purpose, token.TokenHash, token.ExpiresAt,
+	).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert account token: %v", err)
+	}
+
+	return nil
+}
+
+// CountSince returns how many tokens for purpose the user was sent since
+// the given time, for rate limiting
+func (r *AccountTokenRepository) CountSince(ctx context.Context, userID, purpose string, since time.Time) (int, error) {
+	var count int
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM account_tokens
+		WHERE user_id = $1 AND purpose = $2 AND created_at > $3`,
+		userID, purpose, since,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count account tokens: %v", err)
+	}
+
+	return count, nil
+}
+
+// Consume marks the unused, unexpired token with the given hash and purpose
+// as used and returns it. It returns ErrNotFound for unknown, used and
+// expired tokens; of two concurrent uses, only one succeeds.
+func (r *AccountTokenRepository) Consume(ctx context.Context, tokenHash, purpose string) (*models.AccountToken, error) {
+	token, err := scanAccountToken(r.db.QueryRowContext(ctx, `
+		UPDATE account_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING `+accountTokenColumns, tokenHash, purpose))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume account token: %v", err)
+	}
+
+	return token, nil
+}
+
+// InvalidateForUser marks every unused token for purpose of the user as
+// used, e.g. all outstanding reset links once the password has changed
+func (r *AccountTokenRepository) InvalidateForUser(ctx context.Context, userID, purpose string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE account_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`,
+		userID, purpose)
+	if err != nil {
+		return 0, fmt.Errorf("failed to invalidate account tokens: %v", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func scanAccountToken(row interface{ Scan(...interface{}) error }) (*models.AccountToken, error) {
+	var token models.AccountToken
+	var usedAt sql.NullTime
+
+	err := row.Scan(&token.ID, &token.UserID, &token.Purpose, &token.TokenHash, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+
+	return &token, nil
+}
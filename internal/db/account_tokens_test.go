@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+)
+
+func TestAccountTokens(t *testing.T) {
+	conn := migratedTestDB(t)
+	ctx := context.Background()
+	repo := NewAccountTokenRepository(conn)
+
+	alice := createTestUser(t, conn, "alice@example.com")
+	bob := createTestUser(t, conn, "bob@example.com")
+	start := time.Now().Add(-time.Minute)
+
+	create := func(userID, purpose, hash string, expiresAt time.Time) {
+		t.Helper()
+		token := &models.AccountToken{UserID: userID, Purpose: purpose, TokenHash: hash, ExpiresAt: expiresAt}
+		if err := repo.Create(ctx, token); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	hour := time.Now().Add(time.Hour)
+	create(alice, "password_reset", "reset-1", hour)
+	create(alice, "password_reset", "reset-2", hour)
+	create(alice, "password_reset", "expired", time.Now().Add(-time.Minute))
+	create(alice, "email_verification", "verify-1", hour)
+	create(bob, "password_reset", "bob-reset", hour)
+
+	if count, err := repo.CountSince(ctx, alice, "password_reset", start); err != nil || count != 3 {
+		t.Errorf("CountSince = %d, %v; want 3", count, err)
+	}
+
+	token, err := repo.Consume(ctx, "reset-1", "password_reset")
+	if err != nil || token.UserID != alice {
+		t.Fatalf("Consume = %+v, %v; want alice's token", token, err)
+	}
+
+	tests := []struct {
+		name    string
+		hash    string
+		purpose string
+	}{
+		{"Used", "reset-1", "password_reset"},
+		{"Expired", "expired", "password_reset"},
+		{"WrongPurpose", "verify-1", "password_reset"},
+		{"Unknown", "nope", "password_reset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := repo.Consume(ctx, tt.hash, tt.purpose); err != ErrNotFound {
+				t.Errorf("Consume = %v, want ErrNotFound", err)
+			}
+		})
+	}
+
+	// reset-2 is the only unused reset token of alice's; bob's is untouched
+	if invalidated, err := repo.InvalidateForUser(ctx, alice, "password_reset"); err != nil || invalidated != 2 {
+		t.Errorf("InvalidateForUser = %d, %v; want reset-2 and the expired token", invalidated, err)
+	}
+	if _, err := repo.Consume(ctx, "reset-2", "password_reset"); err != ErrNotFound {
+		t.Errorf("Consume of an invalidated token = %v, want ErrNotFound", err)
+	}
+	if _, err := repo.Consume(ctx, "bob-reset", "password_reset"); err != nil {
+		t.Errorf("Consume of another user's token after InvalidateForUser failed: %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 
@@ -10,6 +12,22 @@ import (
 
 var DB *sql.DB
 
+// ErrNotFound is returned by repositories when no row matches; lookups are
+// owner-scoped, so it also covers rows that belong to another user
+var ErrNotFound = errors.New("record not found")
+
+// ErrConflict is returned by version-checked writes when the row changed
+// after it was read
+var ErrConflict = errors.New("record was modified concurrently")
+
+// DBTX is implemented by both *sql.DB and *sql.Tx so repositories can run
+// either standalone or inside a transaction
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 func InitDB() error {
 	dbURL := os.Getenv("DATABASE_URL")
 	if dbURL == "" {
@@ -26,45 +44,76 @@ func InitDB() error {
 		return fmt.Errorf("error connecting to the database: %v", err)
 	}
 
-	// Create tables if they don't exist
-	if err := createTables(); err != nil {
-		return fmt.Errorf("error creating tables: %v", err)
-	}
-
 	return nil
 }
 
-func createTables() error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			email VARCHAR(255) UNIQUE NOT NULL,
-			password VARCHAR(255) NOT NULL,
-			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS profiles (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			user_id UUID REFERENCES users(id),
-			interests TEXT[],
-			preferences TEXT[],
-			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS matches (
-			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-			user1_id UUID REFERENCES users(id),
-			user2_id UUID REFERENCES users(id),
-			score FLOAT,
-			created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-		)`,
+type txContextKey struct{}
+
+// ContextWithTx returns a context carrying tx, for code that runs inside a
+// transaction it was not handed, such as a handler wrapped by middleware
+func ContextWithTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// Conn returns the transaction carried by ctx, or DB if there is none
+func Conn(ctx context.Context) DBTX {
+	if tx, ok := ctx.Value(txContextKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return DB
+}
+
+// WithTx runs fn inside a transaction, committing if fn succeeds and
+// rolling back otherwise. If ctx already carries a transaction (see
+// ContextWithTx), fn joins it and its owner commits or rolls back.
+func WithTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if tx, ok := ctx.Value(txContextKey{}).(*sql.Tx); ok {
+		return fn(tx)
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
 	}
 
-	for _, query := range queries {
-		if _, err := DB.Exec(query); err != nil {
-			return err
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
 		}
+		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+
+	return nil
+}
+
+// expectOneRow maps an UPDATE/DELETE that touched no rows to ErrNotFound
+func expectOneRow(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error reading rows affected: %v", err)
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
+
+// expectOneRowVersioned is expectOneRow for an UPDATE guarded by a version
+// check, where no rows means either a missing row or a stale version
+func expectOneRowVersioned(result sql.Result) error {
+	if err := expectOneRow(result); err == ErrNotFound {
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// nullString stores empty strings as NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,334 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+	"github.com/lib/pq"
+)
+
+// JournalEntryRepository stores journal entries in the journal_entries table.
+// PHI fields are expected to already be encrypted by the caller; the
+// repository only ever sees ciphertext.
+type JournalEntryRepository struct {
+	db DBTX
+}
+
+func NewJournalEntryRepository(db DBTX) *JournalEntryRepository {
+	return &JournalEntryRepository{db: db}
+}
+
+// Create inserts a new journal entry
+func (r *JournalEntryRepository) Create(ctx context.Context, entry *models.JournalEntry) error {
+	query := `
+		INSERT INTO journal_entries (
+			id, user_id, content_ciphertext, mood_ciphertext, tags_ciphertext,
+			encrypted, kms_key_id, encrypted_data_key, created_at, updated_at,
+			mood_index, tag_indexes
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	_, err := r.db.ExecContext(ctx, query,
+		entry.ID,
+		entry.UserID,
+		entry.Content,
+		entry.Mood,
+		pq.Array(entry.Tags),
+		entry.Encrypted,
+		entry.KeyID,
+		nullString(entry.DataKey),
+		entry.CreatedAt,
+		entry.UpdatedAt,
+		nullString(entry.MoodIndex),
+		pq.Array(nonNil(entry.TagIndexes)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert journal entry: %v", err)
+	}
+
+	return nil
+}
+
+// JournalEntryCursor marks a position in a user's entries, ordered newest first
+type JournalEntryCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// ListJournalEntriesOptions controls pagination and filtering for List
+type ListJournalEntriesOptions struct {
+	Limit int
+	After *JournalEntryCursor // return entries strictly older than this position
+
+	MoodIndex  string   // only entries with this mood blind index
+	TagIndexes []string // only entries carrying all of these tag blind indexes
+}
+
+const journalEntryColumns = `id, user_id, content_ciphertext, mood_ciphertext, tags_ciphertext,
+	encrypted, kms_key_id, encrypted_data_key, created_at, updated_at, version,
+	mood_index, tag_indexes`
+
+// GetByID returns the entry with the given ID if it belongs to userID
+func (r *JournalEntryRepository) GetByID(ctx context.Context, userID, id string) (*models.JournalEntry, error) {
+	query := `SELECT ` + journalEntryColumns + ` FROM journal_entries WHERE id = $1 AND user_id = $2`
+
+	entry, err := scanJournalEntry(r.db.QueryRowContext(ctx, query, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get journal entry: %v", err)
+	}
+
+	return entry, nil
+}
+
+// GetByIDForUpdate is GetByID with a row lock; it must be called inside a transaction
+func (r *JournalEntryRepository) GetByIDForUpdate(ctx context.Context, userID, id string) (*models.JournalEntry, error) {
+	query := `SELECT ` + journalEntryColumns + ` FROM journal_entries WHERE id = $1 AND user_id = $2 FOR UPDATE`
+
+	entry, err := scanJournalEntry(r.db.QueryRowContext(ctx, query, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get journal entry: %v", err)
+	}
+
+	return entry, nil
+}
+
+// List returns a page of the user's entries, newest first
+func (r *JournalEntryRepository) List(ctx context.Context, userID string, opts ListJournalEntriesOptions) ([]*models.JournalEntry, error) {
+	args := []interface{}{userID}
+	query := `SELECT ` + journalEntryColumns + ` FROM journal_entries WHERE user_id = $1`
+
+	if opts.After != nil {
+		query += fmt.Sprintf(` AND (created_at, id) < ($%d, $%d)`, len(args)+1, len(args)+2)
+		args = append(args, opts.After.CreatedAt, opts.After.ID)
+	}
+	if opts.MoodIndex != "" {
+		query += fmt.Sprintf(` AND mood_index = $%d`, len(args)+1)
+		args = append(args, opts.MoodIndex)
+	}
+	if len(opts.TagIndexes) > 0 {
+		query += fmt.Sprintf(` AND tag_indexes @> $%d`, len(args)+1)
+		args = append(args, pq.Array(opts.TagIndexes))
+	}
+
+	query += fmt.Sprintf(` ORDER BY created_at DESC, id DESC LIMIT $%d`, len(args)+1)
+	args = append(args, opts.Limit)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal entries: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []*models.JournalEntry{}
+	for rows.Next() {
+		entry, err := scanJournalEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan journal entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list journal entries: %v", err)
+	}
+
+	return entries, nil
+}
+
+// Update overwrites the encrypted fields of an existing entry owned by entry.UserID
+func (r *JournalEntryRepository) Update(ctx context.Context, entry *models.JournalEntry) error {
+	query := `
+		UPDATE journal_entries
+		SET content_ciphertext = $3, mood_ciphertext = $4, tags_ciphertext = $5,
+			encrypted = $6, kms_key_id = $7, encrypted_data_key = $8, updated_at = $9,
+			mood_index = $10, tag_indexes = $11, version = version + 1
+		WHERE id = $1 AND user_id = $2`
+
+	result, err := r.db.ExecContext(ctx, query,
+		entry.ID,
+		entry.UserID,
+		entry.Content,
+		entry.Mood,
+		pq.Array(entry.Tags),
+		entry.Encrypted,
+		entry.KeyID,
+		nullString(entry.DataKey),
+		entry.UpdatedAt,
+		nullString(entry.MoodIndex),
+		pq.Array(nonNil(entry.TagIndexes)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update journal entry: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// ListForReencryption returns up to limit entries of every user with IDs
+// greater than afterID, in ID order, for background key rotation
+func (r *JournalEntryRepository) ListForReencryption(ctx context.Context, afterID string, limit int) ([]*models.JournalEntry, error) {
+	args := []interface{}{limit}
+	query := `SELECT ` + journalEntryColumns + ` FROM journal_entries`
+
+	if afterID != "" {
+		query += ` WHERE id > $2`
+		args = append(args, afterID)
+	}
+	query += ` ORDER BY id LIMIT $1`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal entries: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []*models.JournalEntry{}
+	for rows.Next() {
+		entry, err := scanJournalEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan journal entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list journal entries: %v", err)
+	}
+
+	return entries, nil
+}
+
+// UpdateCiphertexts rewrites the encrypted fields of entry only if the row
+// is still at entry.Version, returning ErrConflict otherwise. updated_at is
+// left alone since the plaintext has not changed.
+func (r *JournalEntryRepository) UpdateCiphertexts(ctx context.Context, entry *models.JournalEntry) error {
+	query := `
+		UPDATE journal_entries
+		SET content_ciphertext = $3, mood_ciphertext = $4, tags_ciphertext = $5,
+			encrypted = $6, kms_key_id = $7, encrypted_data_key = $8,
+			version = version + 1
+		WHERE id = $1 AND version = $2`
+
+	result, err := r.db.ExecContext(ctx, query,
+		entry.ID,
+		entry.Version,
+		entry.Content,
+		entry.Mood,
+		pq.Array(entry.Tags),
+		entry.Encrypted,
+		entry.KeyID,
+		nullString(entry.DataKey),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update journal entry: %v", err)
+	}
+
+	if err := expectOneRowVersioned(result); err != nil {
+		return err
+	}
+
+	entry.Version++
+	return nil
+}
+
+// Delete removes the entry with the given ID if it belongs to userID
+func (r *JournalEntryRepository) Delete(ctx context.Context, userID, id string) error {
+	result, err := r.db.ExecContext(ctx,
+		`DELETE FROM journal_entries WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete journal entry: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// UpdateIndexes rewrites the blind indexes of entry only if the row is
+// still at entry.Version, returning ErrConflict otherwise
+func (r *JournalEntryRepository) UpdateIndexes(ctx context.Context, entry *models.JournalEntry) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE journal_entries
+		SET mood_index = $3, tag_indexes = $4, version = version + 1
+		WHERE id = $1 AND version = $2`,
+		entry.ID,
+		entry.Version,
+		nullString(entry.MoodIndex),
+		pq.Array(nonNil(entry.TagIndexes)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update journal entry indexes: %v", err)
+	}
+
+	if err := expectOneRowVersioned(result); err != nil {
+		return err
+	}
+
+	entry.Version++
+	return nil
+}
+
+// DeleteAllForUser removes every row owned by userID and returns how many
+// there were
+func (r *JournalEntryRepository) DeleteAllForUser(ctx context.Context, userID string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM journal_entries WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete journal entries: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error reading rows affected: %v", err)
+	}
+
+	return deleted, nil
+}
+
+// scanJournalEntry reads a row selected with journalEntryColumns
+func scanJournalEntry(row interface{ Scan(...interface{}) error }) (*models.JournalEntry, error) {
+	var entry models.JournalEntry
+	var mood, keyID, dataKey, moodIndex sql.NullString
+
+	err := row.Scan(
+		&entry.ID,
+		&entry.UserID,
+		&entry.Content,
+		&mood,
+		pq.Array(&entry.Tags),
+		&entry.Encrypted,
+		&keyID,
+		&dataKey,
+		&entry.CreatedAt,
+		&entry.UpdatedAt,
+		&entry.Version,
+		&moodIndex,
+		pq.Array(&entry.TagIndexes),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Mood = mood.String
+	entry.MoodIndex = moodIndex.String
+	entry.KeyID = keyID.String
+	entry.DataKey = dataKey.String
+	entry.Tags = nonNil(entry.Tags)
+	entry.TagIndexes = nonNil(entry.TagIndexes)
+
+	return &entry, nil
+}
+
+// nonNil maps a nil slice to an empty one, so TEXT[] NOT NULL columns get
+// '{}' rather than NULL
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
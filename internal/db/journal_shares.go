@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awsbackend/internal/models"
+)
+
+type JournalShareRepository struct {
+	db DBTX
+}
+
+func NewJournalShareRepository(db DBTX) *JournalShareRepository {
+	return &JournalShareRepository{db: db}
+}
+
+// Create shares the patient's journal with the clinician. Sharing again
+// keeps the original share and its CreatedAt.
+func (r *JournalShareRepository) Create(ctx context.Context, share *models.JournalShare) error {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO journal_shares (patient_id, clinician_id) VALUES ($1, $2)
+		ON CONFLICT (patient_id, clinician_id) DO UPDATE SET patient_id = EXCLUDED.patient_id
+		RETURNING created_at`,
+		share.PatientID, share.ClinicianID,
+	).Scan(&share.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to share journal: %v", err)
+	}
+
+	return nil
+}
+
+// Exists reports whether the patient shares their journal with the clinician
+func (r *JournalShareRepository) Exists(ctx context.Context, patientID, clinicianID string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM journal_shares WHERE patient_id = $1 AND clinician_id = $2)`,
+		patientID, clinicianID,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check journal share: %v", err)
+	}
+
+	return exists, nil
+}
+
+// ListForPatient returns the clinicians the patient shares their journal
+// with, oldest first
+func (r *JournalShareRepository) ListForPatient(ctx context.Context, patientID string) ([]*models.JournalShare, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT patient_id, clinician_id, created_at FROM journal_shares
+		WHERE patient_id = $1 ORDER BY created_at, clinician_id`, patientID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list journal shares: %v", err)
+	}
+	defer rows.Close()
+
+	var shares []*models.JournalShare
+	for rows.Next() {
+		var share models.JournalShare
+		if err := rows.Scan(&share.PatientID, &share.ClinicianID, &share.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan journal share: %v", err)
+		}
+		shares = append(shares, &share)
+	}
+
+	return shares, rows.Err()
+}
+
+// Delete stops sharing the patient's journal with the clinician
+func (r *JournalShareRepository) Delete(ctx context.Context, patientID, clinicianID string) error {
+	result, err := r.db.ExecContext(ctx, `
+		DELETE FROM journal_shares WHERE patient_id = $1 AND clinician_id = $2`,
+		patientID, clinicianID)
+	if err != nil {
+		return fmt.Errorf("failed to delete journal share: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// DeleteAllForUser removes every share the user is part of, as patient or
+// clinician
+func (r *JournalShareRepository) DeleteAllForUser(ctx context.Context, userID string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		DELETE FROM journal_shares WHERE patient_id = $1 OR clinician_id = $1`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete journal shares: %v", err)
+	}
+
+	return result.RowsAffected()
+}
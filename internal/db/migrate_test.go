@@ -0,0 +1,204 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+)
+
+// testDB returns a connection to TEST_DATABASE_URL whose search_path is a
+// fresh schema, dropped when the test ends. Tests using it are skipped when
+// the variable is unset.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL must be a postgres:// URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	conn, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("failed to open test schema: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// migratedTestDB returns a testDB with every migration applied
+func migratedTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	conn := testDB(t)
+
+	m, err := NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	return conn
+}
+
+// createTestUser inserts a password user and returns their ID
+func createTestUser(t *testing.T, conn DBTX, email string) string {
+	t.Helper()
+	user := &models.User{Email: email, Password: "hash"}
+	if err := NewUserRepository(conn).Create(context.Background(), user); err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	return user.ID
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_second.up.sql":   {Data: []byte("CREATE TABLE b ();")},
+		"0002_second.down.sql": {Data: []byte("DROP TABLE b;")},
+		"0001_first.up.sql":    {Data: []byte("CREATE TABLE a ();")},
+		"0001_first.down.sql":  {Data: []byte("DROP TABLE a;")},
+	}
+
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("LoadMigrations failed: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Version != 2 {
+		t.Fatalf("LoadMigrations = %+v, want versions 1 and 2 in order", migrations)
+	}
+	if migrations[0].Name != "first" || migrations[0].Down != "DROP TABLE a;" {
+		t.Errorf("migration 1 = %+v", migrations[0])
+	}
+	if migrations[0].Checksum == "" || migrations[0].Checksum == migrations[1].Checksum {
+		t.Errorf("checksums %q and %q should be set and differ", migrations[0].Checksum, migrations[1].Checksum)
+	}
+}
+
+func TestLoadMigrationsRejectsBadSets(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{"BadName", fstest.MapFS{"first.up.sql": {}}},
+		{"MissingDown", fstest.MapFS{"0001_first.up.sql": {Data: []byte("SELECT 1;")}}},
+		{"MissingUp", fstest.MapFS{"0001_first.down.sql": {Data: []byte("SELECT 1;")}}},
+		{"ConflictingNames", fstest.MapFS{
+			"0001_first.up.sql":   {Data: []byte("SELECT 1;")},
+			"0001_other.down.sql": {Data: []byte("SELECT 1;")},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadMigrations(tt.fsys); err == nil {
+				t.Error("LoadMigrations succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrationsAreContiguous(t *testing.T) {
+	m, err := NewMigrator(nil)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+
+	for i, migration := range m.migrations {
+		if migration.Version != int64(i+1) {
+			t.Fatalf("migration %d_%s is at position %d; versions must run 1, 2, 3, ...", migration.Version, migration.Name, i+1)
+		}
+	}
+}
+
+// TestMigrateUpDownUp applies every migration, rolls all of them back and
+// applies them again, so each down script must undo its up script exactly
+func TestMigrateUpDownUp(t *testing.T) {
+	conn := testDB(t)
+	ctx := context.Background()
+
+	m, err := NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatalf("first Up failed: %v", err)
+	}
+	if len(applied) != len(m.migrations) {
+		t.Fatalf("first Up applied %d migrations, want %d", len(applied), len(m.migrations))
+	}
+
+	reverted, err := m.Down(ctx, len(m.migrations))
+	if err != nil {
+		t.Fatalf("Down to version 0 failed: %v", err)
+	}
+	if len(reverted) != len(m.migrations) {
+		t.Fatalf("Down reverted %d migrations, want %d", len(reverted), len(m.migrations))
+	}
+
+	var tables []string
+	rows, err := conn.QueryContext(ctx, `
+		SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations'`)
+	if err != nil {
+		t.Fatalf("failed to list tables: %v", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("failed to scan table name: %v", err)
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if len(tables) > 0 {
+		t.Errorf("tables left after Down to version 0: %s", strings.Join(tables, ", "))
+	}
+
+	if applied, err = m.Up(ctx); err != nil {
+		t.Fatalf("second Up failed: %v", err)
+	}
+	if len(applied) != len(m.migrations) {
+		t.Fatalf("second Up applied %d migrations, want %d", len(applied), len(m.migrations))
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("migration %d_%s is not applied after the second Up", status.Version, status.Name)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+-- Rolling back 0002 recreates profiles and matches, which reference users,
+-- so they have to go before it.
+DROP TABLE IF EXISTS matches;
+DROP TABLE IF EXISTS profiles;
+DROP TABLE IF EXISTS mood_check_ins;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS users;
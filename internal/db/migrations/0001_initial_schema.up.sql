@@ -0,0 +1,38 @@
+-- Core schema for users, journal entries and mood check-ins.
+-- IF NOT EXISTS lets this adopt databases created by the old createTables.
+CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email VARCHAR(255) UNIQUE NOT NULL,
+    password VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id UUID PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    content_ciphertext TEXT NOT NULL,
+    mood_ciphertext TEXT,
+    tags_ciphertext TEXT[] NOT NULL DEFAULT '{}',
+    encrypted BOOLEAN NOT NULL DEFAULT TRUE,
+    kms_key_id TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS journal_entries_user_created_idx
+    ON journal_entries (user_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS mood_check_ins (
+    id UUID PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    mood_score_ciphertext TEXT NOT NULL,
+    notes_ciphertext TEXT,
+    encrypted BOOLEAN NOT NULL DEFAULT TRUE,
+    kms_key_id TEXT,
+    checked_in_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS mood_check_ins_user_checked_in_idx
+    ON mood_check_ins (user_id, checked_in_at DESC);
@@ -0,0 +1,4 @@
+-- profiles and matches were created by the old createTables but are not
+-- part of the Therma data model.
+DROP TABLE IF EXISTS matches;
+DROP TABLE IF EXISTS profiles;
@@ -0,0 +1,2 @@
+ALTER TABLE mood_check_ins DROP COLUMN IF EXISTS encrypted_data_key;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS encrypted_data_key;
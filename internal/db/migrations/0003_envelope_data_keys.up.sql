@@ -0,0 +1,5 @@
+-- KMS-wrapped AES-256 data key that seals every PHI field of the row.
+-- NULL means the row predates envelope encryption and each field is a
+-- standalone KMS ciphertext.
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS encrypted_data_key TEXT;
+ALTER TABLE mood_check_ins ADD COLUMN IF NOT EXISTS encrypted_data_key TEXT;
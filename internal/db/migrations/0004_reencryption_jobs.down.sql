@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS reencryption_job_tables;
+DROP TABLE IF EXISTS reencryption_jobs;
+ALTER TABLE mood_check_ins DROP COLUMN IF EXISTS version;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS version;
@@ -0,0 +1,35 @@
+-- Row versions for optimistic concurrency: every write bumps version, and
+-- background rewrites only succeed if the row is unchanged since it was read.
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE mood_check_ins ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- One run of the re-encryption worker moving PHI to target_key_id. Rows are
+-- kept after completion as the audit trail for key rotations.
+CREATE TABLE IF NOT EXISTS reencryption_jobs (
+    id UUID PRIMARY KEY,
+    target_key_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    error TEXT,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS reencryption_jobs_target_status_idx
+    ON reencryption_jobs (target_key_id, status);
+
+-- Per-table progress of a job. last_id is the resume point: rows are walked
+-- in id order and every row up to and including last_id has been handled.
+CREATE TABLE IF NOT EXISTS reencryption_job_tables (
+    job_id UUID NOT NULL REFERENCES reencryption_jobs (id) ON DELETE CASCADE,
+    table_name TEXT NOT NULL,
+    last_id UUID,
+    scanned BIGINT NOT NULL DEFAULT 0,
+    reencrypted BIGINT NOT NULL DEFAULT 0,
+    skipped BIGINT NOT NULL DEFAULT 0,
+    conflicts BIGINT NOT NULL DEFAULT 0,
+    failed BIGINT NOT NULL DEFAULT 0,
+    done BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (job_id, table_name)
+);
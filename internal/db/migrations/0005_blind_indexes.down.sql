@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS journal_entries_tag_indexes_idx;
+DROP INDEX IF EXISTS journal_entries_user_mood_idx;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS tag_indexes;
+ALTER TABLE journal_entries DROP COLUMN IF EXISTS mood_index;
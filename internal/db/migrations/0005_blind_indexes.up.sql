@@ -0,0 +1,10 @@
+-- Keyed HMAC blind indexes of journal entry mood and tags, computed per user
+-- (see encryption.BlindIndex), so entries can be filtered without decrypting.
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS mood_index TEXT;
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS tag_indexes TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS journal_entries_user_mood_idx
+    ON journal_entries (user_id, mood_index) WHERE mood_index IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS journal_entries_tag_indexes_idx
+    ON journal_entries USING GIN (tag_indexes);
@@ -0,0 +1,3 @@
+-- Emails are unique regardless of case. The signup handler lowercases
+-- addresses, but rows created before it may not be.
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_key ON users (lower(email));
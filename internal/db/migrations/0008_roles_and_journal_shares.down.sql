@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS journal_shares;
+ALTER TABLE users DROP COLUMN IF EXISTS role;
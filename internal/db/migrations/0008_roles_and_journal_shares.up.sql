@@ -0,0 +1,15 @@
+-- Roles of email/password accounts (see auth.Role). Cognito users get their
+-- roles from user pool groups instead.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'patient'
+    CHECK (role IN ('patient', 'clinician', 'support'));
+
+-- Clinicians a patient has shared their journal with. Reading requires both
+-- a row here and the journal:read:shared permission.
+CREATE TABLE IF NOT EXISTS journal_shares (
+    patient_id TEXT NOT NULL,
+    clinician_id TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (patient_id, clinician_id)
+);
+
+CREATE INDEX IF NOT EXISTS journal_shares_clinician_idx ON journal_shares (clinician_id);
@@ -0,0 +1,16 @@
+-- TOTP second factor of email/password accounts. The secret is sealed with
+-- internal/encryption like PHI; recovery codes are stored as SHA-256 hashes
+-- and removed from the array when used.
+CREATE TABLE IF NOT EXISTS user_mfa (
+    user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret_ciphertext TEXT NOT NULL,
+    kms_key_id TEXT,
+    data_key TEXT,
+    enabled_at TIMESTAMP WITH TIME ZONE,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    recovery_code_hashes TEXT[] NOT NULL DEFAULT '{}',
+    failed_attempts INT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
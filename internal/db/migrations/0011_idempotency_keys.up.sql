@@ -0,0 +1,23 @@
+-- Idempotency records for IDEMPOTENCY_STORE=postgres. Claiming a key in the
+-- same transaction as the handler's writes makes them commit together. Rows
+-- are not removed automatically; expired ones are reclaimed by the next
+-- claim of their key and pruned by PostgresStore.DeleteExpired.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idempotency_key TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('pending', 'completed', 'failed')),
+    response TEXT,
+    response_status INT,
+    response_headers JSONB,
+    error TEXT,
+    lease_expires_at TIMESTAMP WITH TIME ZONE,
+    fencing_token BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+CREATE INDEX IF NOT EXISTS idempotency_keys_user_idx ON idempotency_keys (user_id);
@@ -0,0 +1,4 @@
+-- jti of the last mfa_pending token exchanged for tokens, so a login's
+-- token cannot complete it twice whether or not token revocation is
+-- configured
+ALTER TABLE user_mfa ADD COLUMN IF NOT EXISTS last_pending_jti TEXT;
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/awsbackend/internal/models"
+)
+
+// MoodCheckInRepository stores mood check-ins in the mood_check_ins table.
+// Like JournalEntryRepository it only ever sees ciphertext.
+type MoodCheckInRepository struct {
+	db DBTX
+}
+
+func NewMoodCheckInRepository(db DBTX) *MoodCheckInRepository {
+	return &MoodCheckInRepository{db: db}
+}
+
+const moodCheckInColumns = `id, user_id, mood_score_ciphertext, notes_ciphertext,
+	encrypted, kms_key_id, encrypted_data_key, checked_in_at, created_at, version`
+
+// GetByID returns the check-in with the given ID if it belongs to userID
+func (r *MoodCheckInRepository) GetByID(ctx context.Context, userID, id string) (*models.MoodCheckInRecord, error) {
+	query := `SELECT ` + moodCheckInColumns + ` FROM mood_check_ins WHERE id = $1 AND user_id = $2`
+
+	checkIn, err := scanMoodCheckIn(r.db.QueryRowContext(ctx, query, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get mood check-in: %v", err)
+	}
+
+	return checkIn, nil
+}
+
+// ListForReencryption returns up to limit check-ins of every user with IDs
+// greater than afterID, in ID order, for background key rotation
+func (r *MoodCheckInRepository) ListForReencryption(ctx context.Context, afterID string, limit int) ([]*models.MoodCheckInRecord, error) {
+	args := []interface{}{limit}
+	query := `SELECT ` + moodCheckInColumns + ` FROM mood_check_ins`
+
+	if afterID != "" {
+		query += ` WHERE id > $2`
+		args = append(args, afterID)
+	}
+	query += ` ORDER BY id LIMIT $1`
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mood check-ins: %v", err)
+	}
+	defer rows.Close()
+
+	checkIns := []*models.MoodCheckInRecord{}
+	for rows.Next() {
+		checkIn, err := scanMoodCheckIn(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan mood check-in: %v", err)
+		}
+		checkIns = append(checkIns, checkIn)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list mood check-ins: %v", err)
+	}
+
+	return checkIns, nil
+}
+
+// UpdateCiphertexts rewrites the encrypted fields of checkIn only if the row
+// is still at checkIn.Version, returning ErrConflict otherwise
+func (r *MoodCheckInRepository) UpdateCiphertexts(ctx context.Context, checkIn *models.MoodCheckInRecord) error {
+	query := `
+		UPDATE mood_check_ins
+		SET mood_score_ciphertext = $3, notes_ciphertext = $4,
+			encrypted = $5, kms_key_id = $6, encrypted_data_key = $7,
+			version = version + 1
+		WHERE id = $1 AND version = $2`
+
+	result, err := r.db.ExecContext(ctx, query,
+		checkIn.ID,
+		checkIn.Version,
+		checkIn.MoodScore,
+		nullString(checkIn.Notes),
+		checkIn.Encrypted,
+		checkIn.KeyID,
+		nullString(checkIn.DataKey),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update mood check-in: %v", err)
+	}
+
+	if err := expectOneRowVersioned(result); err != nil {
+		return err
+	}
+
+	checkIn.Version++
+	return nil
+}
+
+// DeleteAllForUser removes every row owned by userID and returns how many
+// there were
+func (r *MoodCheckInRepository) DeleteAllForUser(ctx context.Context, userID string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM mood_check_ins WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete mood check-ins: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error reading rows affected: %v", err)
+	}
+
+	return deleted, nil
+}
+
+// scanMoodCheckIn reads a row selected with moodCheckInColumns
+func scanMoodCheckIn(row interface{ Scan(...interface{}) error }) (*models.MoodCheckInRecord, error) {
+	var checkIn models.MoodCheckInRecord
+	var notes, keyID, dataKey sql.NullString
+
+	err := row.Scan(
+		&checkIn.ID,
+		&checkIn.UserID,
+		&checkIn.MoodScore,
+		&notes,
+		&checkIn.Encrypted,
+		&keyID,
+		&dataKey,
+		&checkIn.CheckedInAt,
+		&checkIn.CreatedAt,
+		&checkIn.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	checkIn.Notes = notes.String
+	checkIn.KeyID = keyID.String
+	checkIn.DataKey = dataKey.String
+
+	return &checkIn, nil
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Re-encryption job statuses
+const (
+	ReencryptionJobRunning   = "running"
+	ReencryptionJobCompleted = "completed"
+	ReencryptionJobFailed    = "failed"
+)
+
+// ReencryptionJob is one run of the key rotation worker
+type ReencryptionJob struct {
+	ID          string
+	TargetKeyID string
+	Status      string
+	Error       string
+	StartedAt   time.Time
+	UpdatedAt   time.Time
+	CompletedAt *time.Time
+	Tables      []*ReencryptionTableProgress
+}
+
+// ReencryptionTableProgress is how far a job has walked one table
+type ReencryptionTableProgress struct {
+	Table       string
+	LastID      string // every row with id <= LastID has been handled
+	Scanned     int64
+	Reencrypted int64
+	Skipped     int64 // already under the target key
+	Conflicts   int64 // modified concurrently on every attempt
+	Failed      int64
+	Done        bool
+}
+
+// Progress returns the progress of table, or nil if the job does not cover it
+func (j *ReencryptionJob) Progress(table string) *ReencryptionTableProgress {
+	for _, p := range j.Tables {
+		if p.Table == table {
+			return p
+		}
+	}
+	return nil
+}
+
+// ReencryptionJobRepository stores jobs in reencryption_jobs and their
+// per-table progress in reencryption_job_tables
+type ReencryptionJobRepository struct {
+	db DBTX
+}
+
+func NewReencryptionJobRepository(db DBTX) *ReencryptionJobRepository {
+	return &ReencryptionJobRepository{db: db}
+}
+
+// Create inserts a running job with a zero progress row per table
+func (r *ReencryptionJobRepository) Create(ctx context.Context, job *ReencryptionJob) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO reencryption_jobs (id, target_key_id, status, started_at, updated_at)
+		VALUES ($1, $2, $3, $4, $4)`,
+		job.ID, job.TargetKeyID, job.Status, job.StartedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert re-encryption job: %v", err)
+	}
+
+	for _, p := range job.Tables {
+		if err := r.SaveProgress(ctx, job.ID, p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindUnfinished returns the most recent job for targetKeyID that has not
+// completed, so an interrupted or failed run can be resumed
+func (r *ReencryptionJobRepository) FindUnfinished(ctx context.Context, targetKeyID string) (*ReencryptionJob, error) {
+	var id string
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id FROM reencryption_jobs
+		WHERE target_key_id = $1 AND status <> $2
+		ORDER BY started_at DESC LIMIT 1`,
+		targetKeyID, ReencryptionJobCompleted).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find re-encryption job: %v", err)
+	}
+
+	return r.Get(ctx, id)
+}
+
+// Get returns a job and its progress
+func (r *ReencryptionJobRepository) Get(ctx context.Context, id string) (*ReencryptionJob, error) {
+	job, err := scanReencryptionJob(r.db.QueryRowContext(ctx,
+		`SELECT `+reencryptionJobColumns+` FROM reencryption_jobs WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get re-encryption job: %v", err)
+	}
+
+	if err := r.loadProgress(ctx, job); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// List returns the most recent jobs, newest first
+func (r *ReencryptionJobRepository) List(ctx context.Context, limit int) ([]*ReencryptionJob, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`SELECT `+reencryptionJobColumns+` FROM reencryption_jobs ORDER BY started_at DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list re-encryption jobs: %v", err)
+	}
+	defer rows.Close()
+
+	jobs := []*ReencryptionJob{}
+	for rows.Next() {
+		job, err := scanReencryptionJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan re-encryption job: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list re-encryption jobs: %v", err)
+	}
+
+	for _, job := range jobs {
+		if err := r.loadProgress(ctx, job); err != nil {
+			return nil, err
+		}
+	}
+
+	return jobs, nil
+}
+
+// SaveProgress records how far the job has walked one table
+func (r *ReencryptionJobRepository) SaveProgress(ctx context.Context, jobID string, p *ReencryptionTableProgress) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO reencryption_job_tables (
+			job_id, table_name, last_id, scanned, reencrypted, skipped, conflicts, failed, done, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, CURRENT_TIMESTAMP)
+		ON CONFLICT (job_id, table_name) DO UPDATE SET
+			last_id = EXCLUDED.last_id, scanned = EXCLUDED.scanned,
+			reencrypted = EXCLUDED.reencrypted, skipped = EXCLUDED.skipped,
+			conflicts = EXCLUDED.conflicts, failed = EXCLUDED.failed,
+			done = EXCLUDED.done, updated_at = EXCLUDED.updated_at`,
+		jobID, p.Table, nullString(p.LastID),
+		p.Scanned, p.Reencrypted, p.Skipped, p.Conflicts, p.Failed, p.Done)
+	if err != nil {
+		return fmt.Errorf("failed to save re-encryption progress: %v", err)
+	}
+
+	_, err = r.db.ExecContext(ctx,
+		`UPDATE reencryption_jobs SET updated_at = CURRENT_TIMESTAMP WHERE id = $1`, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to touch re-encryption job: %v", err)
+	}
+
+	return nil
+}
+
+// SetStatus moves a job to status, recording errMsg for failures and the
+// completion time for completed jobs
+func (r *ReencryptionJobRepository) SetStatus(ctx context.Context, jobID, status, errMsg string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE reencryption_jobs
+		SET status = $2, error = $3, updated_at = CURRENT_TIMESTAMP,
+			completed_at = CASE WHEN $2 = 'completed' THEN CURRENT_TIMESTAMP END
+		WHERE id = $1`,
+		jobID, status, nullString(errMsg))
+	if err != nil {
+		return fmt.Errorf("failed to update re-encryption job: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+const reencryptionJobColumns = `id, target_key_id, status, error, started_at, updated_at, completed_at`
+
+func scanReencryptionJob(row interface{ Scan(...interface{}) error }) (*ReencryptionJob, error) {
+	var job ReencryptionJob
+	var errMsg sql.NullString
+	var completedAt sql.NullTime
+
+	err := row.Scan(&job.ID, &job.TargetKeyID, &job.Status, &errMsg,
+		&job.StartedAt, &job.UpdatedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Error = errMsg.String
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+
+	return &job, nil
+}
+
+func (r *ReencryptionJobRepository) loadProgress(ctx context.Context, job *ReencryptionJob) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT table_name, last_id, scanned, reencrypted, skipped, conflicts, failed, done
+		FROM reencryption_job_tables WHERE job_id = $1 ORDER BY table_name`, job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load re-encryption progress: %v", err)
+	}
+	defer rows.Close()
+
+	job.Tables = nil
+	for rows.Next() {
+		var p ReencryptionTableProgress
+		var lastID sql.NullString
+		err := rows.Scan(&p.Table, &lastID, &p.Scanned, &p.Reencrypted,
+			&p.Skipped, &p.Conflicts, &p.Failed, &p.Done)
+		if err != nil {
+			return fmt.Errorf("failed to scan re-encryption progress: %v", err)
+		}
+		p.LastID = lastID.String
+		job.Tables = append(job.Tables, &p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load re-encryption progress: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/awsbackend/internal/models"
+)
+
+const refreshTokenColumns = `id, user_id, family_id, parent_id, token_hash, created_at, expires_at, used_at, revoked_at`
+
+type RefreshTokenRepository struct {
+	db DBTX
+}
+
+func NewRefreshTokenRepository(db DBTX) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db}
+}
+
+// Create inserts a refresh token, filling in ID and CreatedAt. An empty
+// FamilyID starts a new family.
+func (r *RefreshTokenRepository) Create(ctx context.Context, token *models.RefreshToken) error {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO refresh_tokens (user_id, family_id, parent_id, token_hash, expires_at)
+		VALUES ($1, COALESCE($2::uuid, gen_random_uuid()), $3, $4, $5)
+		RETURNING id, family_id, created_at`,
+		token.UserID, nullString(token.FamilyID), nullString(token.ParentID), token.TokenHash, token.ExpiresAt,
+	).Scan(&token.ID, &token.FamilyID, &token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to insert refresh token: %v", err)
+	}
+
+	return nil
+}
+
+// GetByHashForUpdate returns the token with the given hash and locks it
+// until the surrounding transaction ends, so concurrent uses of one token
+// are serialized
+func (r *RefreshTokenRepository) GetByHashForUpdate(ctx context.Context, tokenHash string) (*models.RefreshToken, error) {
+	token, err := scanRefreshToken(r.db.QueryRowContext(ctx, `
+		SELECT `+refreshTokenColumns+`
+		FROM refresh_tokens WHERE token_hash = $1
+		FOR UPDATE`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get refresh token: %v", err)
+	}
+
+	return token, nil
+}
+
+// MarkUsed records that a token has been rotated
+func (r *RefreshTokenRepository) MarkUsed(ctx context.Context, id string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL`, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark refresh token used: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// RevokeFamily revokes every token of a family and returns how many were
+// still live
+func (r *RefreshTokenRepository) RevokeFamily(ctx context.Context, familyID string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE family_id = $1 AND revoked_at IS NULL`, familyID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke refresh token family: %v", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func scanRefreshToken(row interface{ Scan(...interface{}) error }) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+	var parentID sql.NullString
+	var usedAt, revokedAt sql.NullTime
+
+	err := row.Scan(&token.ID, &token.UserID, &token.FamilyID, &parentID, &token.TokenHash,
+		&token.CreatedAt, &token.ExpiresAt, &usedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	token.ParentID = parentID.String
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
+	if revokedAt.Valid {
+		token.RevokedAt = &revokedAt.Time
+	}
+
+	return &token, nil
+}
+
+// RevokeFamilyOf revokes the family of the user's token with the given hash,
+// for logging out one session
+func (r *RefreshTokenRepository) RevokeFamilyOf(ctx context.Context, userID, tokenHash string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE family_id = (
+			SELECT family_id FROM refresh_tokens
+			WHERE token_hash = $1 AND user_id = $2
+		) AND revoked_at IS NULL`, tokenHash, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke refresh token family: %v", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// RevokeAllForUser revokes every refresh token of the user
+func (r *RefreshTokenRepository) RevokeAllForUser(ctx context.Context, userID string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke refresh tokens: %v", err)
+	}
+
+	return result.RowsAffected()
+}
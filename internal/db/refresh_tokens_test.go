@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+)
+
+func createTestRefreshToken(t *testing.T, repo *RefreshTokenRepository, userID, familyID, hash string) *models.RefreshToken {
+	t.Helper()
+	token := &models.RefreshToken{UserID: userID, FamilyID: familyID, TokenHash: hash, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := repo.Create(context.Background(), token); err != nil {
+		t.Fatalf("failed to create refresh token: %v", err)
+	}
+	return token
+}
+
+func TestRefreshTokenRevocation(t *testing.T) {
+	conn := migratedTestDB(t)
+	ctx := context.Background()
+	repo := NewRefreshTokenRepository(conn)
+
+	alice := createTestUser(t, conn, "alice@example.com")
+	bob := createTestUser(t, conn, "bob@example.com")
+
+	phone := createTestRefreshToken(t, repo, alice, "", "alice-phone-1")
+	createTestRefreshToken(t, repo, alice, phone.FamilyID, "alice-phone-2")
+	createTestRefreshToken(t, repo, alice, "", "alice-laptop")
+	createTestRefreshToken(t, repo, bob, "", "bob-phone")
+
+	// Another user's token hash does not log anyone out
+	if revoked, err := repo.RevokeFamilyOf(ctx, bob, "alice-phone-1"); err != nil || revoked != 0 {
+		t.Fatalf("RevokeFamilyOf with another user's token = %d, %v; want 0", revoked, err)
+	}
+
+	if revoked, err := repo.RevokeFamilyOf(ctx, alice, "alice-phone-1"); err != nil || revoked != 2 {
+		t.Fatalf("RevokeFamilyOf = %d, %v; want the 2 tokens of the family", revoked, err)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	laptop, err := NewRefreshTokenRepository(tx).GetByHashForUpdate(ctx, "alice-laptop")
+	if err != nil {
+		t.Fatalf("GetByHashForUpdate failed: %v", err)
+	}
+	if laptop.RevokedAt != nil {
+		t.Error("RevokeFamilyOf revoked a token of another family")
+	}
+	tx.Rollback()
+
+	if revoked, err := repo.RevokeAllForUser(ctx, alice); err != nil || revoked != 1 {
+		t.Fatalf("RevokeAllForUser = %d, %v; want the 1 live token left", revoked, err)
+	}
+	if revoked, err := repo.RevokeAllForUser(ctx, bob); err != nil || revoked != 1 {
+		t.Fatalf("RevokeAllForUser for another user = %d, %v; want 1", revoked, err)
+	}
+}
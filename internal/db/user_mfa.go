@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+	"github.com/lib/pq"
+)
+
+const userMFAColumns = `user_id, secret_ciphertext, kms_key_id, data_key, enabled_at, last_used_step,
+	recovery_code_hashes, failed_attempts, locked_until, last_pending_jti, created_at, updated_at`
+
+type UserMFARepository struct {
+	db DBTX
+}
+
+func NewUserMFARepository(db DBTX) *UserMFARepository {
+	return &UserMFARepository{db: db}
+}
+
+// Get returns the user's MFA enrollment
+func (r *UserMFARepository) Get(ctx context.Context, userID string) (*models.UserMFA, error) {
+	return r.get(ctx, `SELECT `+userMFAColumns+` FROM user_mfa WHERE user_id = $1`, userID)
+}
+
+// GetForUpdate returns the user's MFA enrollment and locks it until the
+// surrounding transaction ends, so a code cannot be accepted twice by
+// concurrent requests
+func (r *UserMFARepository) GetForUpdate(ctx context.Context, userID string) (*models.UserMFA, error) {
+	return r.get(ctx, `SELECT `+userMFAColumns+` FROM user_mfa WHERE user_id = $1 FOR UPDATE`, userID)
+}
+
+func (r *UserMFARepository) get(ctx context.Context, query, userID string) (*models.UserMFA, error) {
+	mfa, err := scanUserMFA(r.db.QueryRowContext(ctx, query, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get MFA enrollment: %v", err)
+	}
+	return mfa, nil
+}
+
+// Enroll stores a new, not yet enabled secret for the user, replacing an
+// earlier unfinished enrollment. It returns ErrConflict if MFA is already
+// enabled.
+func (r *UserMFARepository) Enroll(ctx context.Context, mfa *models.UserMFA) error {
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO user_mfa (user_id, secret_ciphertext, kms_key_id, data_key)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET
+			secret_ciphertext = EXCLUDED.secret_ciphertext,
+			kms_key_id = EXCLUDED.kms_key_id,
+			data_key = EXCLUDED.data_key,
+			last_used_step = 0,
+			failed_attempts = 0,
+			locked_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE user_mfa.enabled_at IS NULL`,
+		mfa.UserID, mfa.Secret, nullString(mfa.KeyID), nullString(mfa.DataKey),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store MFA enrollment: %v", err)
+	}
+
+	if err := expectOneRow(result); err == ErrNotFound {
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Enable turns on MFA after the first valid code, storing the recovery code
+// hashes
+func (r *UserMFARepository) Enable(ctx context.Context, userID string, step int64, recoveryCodeHashes []string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE user_mfa SET
+			enabled_at = CURRENT_TIMESTAMP,
+			last_used_step = $2,
+			recovery_code_hashes = $3,
+			failed_attempts = 0,
+			locked_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND enabled_at IS NULL`,
+		userID, step, pq.Array(recoveryCodeHashes),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to enable MFA: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// RecordSuccess stores the step of an accepted code and clears failures
+func (r *UserMFARepository) RecordSuccess(ctx context.Context, userID string, step int64) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE user_mfa SET
+			last_used_step = GREATEST(last_used_step, $2),
+			failed_attempts = 0,
+			locked_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1`,
+		userID, step,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record MFA success: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// CompletePendingLogin records that the mfa_pending token with the given
+// jti was exchanged for tokens. It returns ErrConflict if it already was.
+func (r *UserMFARepository) CompletePendingLogin(ctx context.Context, userID, jti string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE user_mfa SET last_pending_jti = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND last_pending_jti IS DISTINCT FROM $2`,
+		userID, jti,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record MFA login: %v", err)
+	}
+
+	if err := expectOneRow(result); err == ErrNotFound {
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecordFailure counts a wrong code. The maxAttempts-th failure in a row
+// locks MFA for lockout and starts counting again.
+func (r *UserMFARepository) RecordFailure(ctx context.Context, userID string, maxAttempts int, lockout time.Duration) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE user_mfa SET
+			failed_attempts = CASE WHEN failed_attempts + 1 >= $2 THEN 0 ELSE failed_attempts + 1 END,
+			locked_until = CASE WHEN failed_attempts + 1 >= $2
+				THEN CURRENT_TIMESTAMP + $3 * INTERVAL '1 second' ELSE locked_until END,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1`,
+		userID, maxAttempts, int64(lockout.Seconds()),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record MFA failure: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash. It
+// returns ErrNotFound if the user has no such unused code.
+func (r *UserMFARepository) UseRecoveryCode(ctx context.Context, userID, codeHash string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE user_mfa SET
+			recovery_code_hashes = array_remove(recovery_code_hashes, $2),
+			failed_attempts = 0,
+			locked_until = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND enabled_at IS NOT NULL AND $2 = ANY(recovery_code_hashes)`,
+		userID, codeHash,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to use recovery code: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+func scanUserMFA(row interface{ Scan(...interface{}) error }) (*models.UserMFA, error) {
+	var mfa models.UserMFA
+	var keyID, dataKey, lastPendingJTI sql.NullString
+	var enabledAt, lockedUntil sql.NullTime
+
+	err := row.Scan(&mfa.UserID, &mfa.Secret, &keyID, &dataKey, &enabledAt, &mfa.LastUsedStep,
+		pq.Array(&mfa.RecoveryCodeHashes), &mfa.FailedAttempts, &lockedUntil, &lastPendingJTI, &mfa.CreatedAt, &mfa.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	mfa.KeyID = keyID.String
+	mfa.DataKey = dataKey.String
+	mfa.LastPendingJTI = lastPendingJTI.String
+	if enabledAt.Valid {
+		mfa.EnabledAt = &enabledAt.Time
+	}
+	if lockedUntil.Valid {
+		mfa.LockedUntil = &lockedUntil.Time
+	}
+
+	return &mfa, nil
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/awsbackend/internal/models"
+)
+
+func TestUserMFACompletePendingLogin(t *testing.T) {
+	conn := migratedTestDB(t)
+	ctx := context.Background()
+	repo := NewUserMFARepository(conn)
+
+	userID := createTestUser(t, conn, "clinician@example.com")
+	if err := repo.Enroll(ctx, &models.UserMFA{UserID: userID, Secret: "sealed"}); err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	if err := repo.Enable(ctx, userID, 1, []string{"hash"}); err != nil {
+		t.Fatalf("Enable failed: %v", err)
+	}
+
+	if err := repo.CompletePendingLogin(ctx, userID, "jti-1"); err != nil {
+		t.Fatalf("CompletePendingLogin failed: %v", err)
+	}
+	if err := repo.CompletePendingLogin(ctx, userID, "jti-1"); err != ErrConflict {
+		t.Errorf("CompletePendingLogin with a used jti = %v, want ErrConflict", err)
+	}
+	if err := repo.CompletePendingLogin(ctx, userID, "jti-2"); err != nil {
+		t.Errorf("CompletePendingLogin with the next login's jti failed: %v", err)
+	}
+
+	mfa, err := repo.Get(ctx, userID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if mfa.LastPendingJTI != "jti-2" || mfa.EnabledAt == nil || mfa.LastUsedStep != 1 {
+		t.Errorf("Get = %+v, want MFA enabled at step 1 with last pending jti jti-2", mfa)
+	}
+
+	if err := repo.RecordSuccess(ctx, userID, 2); err != nil {
+		t.Errorf("RecordSuccess failed: %v", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, userID, "hash"); err != nil {
+		t.Errorf("UseRecoveryCode failed: %v", err)
+	}
+	if err := repo.UseRecoveryCode(ctx, userID, "hash"); err != ErrNotFound {
+		t.Errorf("UseRecoveryCode with a used code = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/awsbackend/internal/models"
+	"github.com/lib/pq"
+)
+
+// ErrEmailTaken is returned by UserRepository.Create when another account
+// already uses the email address
+var ErrEmailTaken = errors.New("email address already registered")
+
+const userColumns = `id, email, password, role, email_verified_at, created_at, updated_at`
+
+// UserRepository stores accounts in the users table. Emails are unique and
+// looked up case-insensitively.
+type UserRepository struct {
+	db DBTX
+}
+
+func NewUserRepository(db DBTX) *UserRepository {
+	return &UserRepository{db: db}
+}
+
+// Create inserts a new user, filling in ID, CreatedAt and UpdatedAt. An
+// empty Role is stored as the default, patient.
+func (r *UserRepository) Create(ctx context.Context, user *models.User) error {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO users (email, password, role) VALUES ($1, $2, COALESCE($3, 'patient'))
+		RETURNING id, role, created_at, updated_at`,
+		user.Email, user.Password, nullString(user.Role),
+	).Scan(&user.ID, &user.Role, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("failed to insert user: %v", err)
+	}
+
+	return nil
+}
+
+// GetByID returns the user with the given ID
+func (r *UserRepository) GetByID(ctx context.Context, id string) (*models.User, error) {
+	user, err := scanUser(r.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	return user, nil
+}
+
+// GetByEmail returns the user with the given email address, ignoring case
+func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	user, err := scanUser(r.db.QueryRowContext(ctx, `
+		SELECT `+userColumns+` FROM users WHERE lower(email) = lower($1)`, email))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+
+	return user, nil
+}
+
+// UpdatePassword replaces the user's password hash
+func (r *UserRepository) UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE users SET password = $2, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, id, passwordHash)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// MarkEmailVerified records that the user controls their email address. It
+// keeps the time of the first verification.
+func (r *UserRepository) MarkEmailVerified(ctx context.Context, id string) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE users SET
+			email_verified_at = COALESCE(email_verified_at, CURRENT_TIMESTAMP),
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to mark email verified: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// Delete removes the account with the given ID
+func (r *UserRepository) Delete(ctx context.Context, id string) error {
+	result, err := r.db.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+
+	return expectOneRow(result)
+}
+
+// IsUUID reports whether id has the form of a users ID. Callers check IDs
+// taken from tokens first: users that only ever authenticated with a token
+// can have IDs of any form, have no users row, and Postgres rejects them as
+// a uuid parameter.
+func IsUUID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return false
+			}
+		case (c < '0' || c > '9') && (c < 'a' || c > 'f') && (c < 'A' || c > 'F'):
+			return false
+		}
+	}
+	return true
+}
+
+func scanUser(row interface{ Scan(...interface{}) error }) (*models.User, error) {
+	var user models.User
+	var emailVerifiedAt sql.NullTime
+	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.Role, &emailVerifiedAt, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if emailVerifiedAt.Valid {
+		user.EmailVerifiedAt = &emailVerifiedAt.Time
+	}
+	return &user, nil
+}
@@ -0,0 +1,26 @@
+package db
+
+import "testing"
+
+func TestIsUUID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"6f1c2a8e-3b4d-4c5e-9f60-718293a4b5c6", true},
+		{"6F1C2A8E-3B4D-4C5E-9F60-718293A4B5C6", true},
+		{"", false},
+		{"user-123", false},
+		{"6f1c2a8e3b4d4c5e9f60718293a4b5c6", false},
+		{"6f1c2a8e-3b4d-4c5e-9f60-718293a4b5c", false},
+		{"6f1c2a8e-3b4d-4c5e-9f60-718293a4b5cg", false},
+		{"6f1c2a8e-3b4d-4c5e_9f60-718293a4b5c6", false},
+		{"6f1c2a8e-3b4d-4c5e-9f60-718293a4b5c6 ", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsUUID(tt.id); got != tt.want {
+			t.Errorf("IsUUID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
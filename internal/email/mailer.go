@@ -0,0 +1,90 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends outbound email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewMailerFromEnv returns the Mailer selected by MAILER: "ses" (sending
+// from MAIL_FROM), "file" (writing to MAIL_DIR) or "log". It returns nil if
+// MAILER is not set, which disables outbound email.
+func NewMailerFromEnv() (Mailer, error) {
+	switch backend := os.Getenv("MAILER"); backend {
+	case "":
+		return nil, nil
+	case "ses":
+		from := os.Getenv("MAIL_FROM")
+		if from == "" {
+			return nil, fmt.Errorf("MAIL_FROM is required with MAILER=ses")
+		}
+		return NewSESMailer(from, os.Getenv("SES_CONFIGURATION_SET"))
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("MAIL_DIR is required with MAILER=file")
+		}
+		return NewFileMailer(dir)
+	case "log":
+		return LogMailer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", backend)
+	}
+}
+
+// LogMailer writes messages to the log instead of sending them, for local
+// development. Messages carry secrets such as reset links, so it must not
+// be used where logs are shipped anywhere.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileMailer writes each message to its own file in Dir, where tests and
+// local tooling can pick it up. Files are named by send time, so they sort
+// in the order messages were sent.
+type FileMailer struct {
+	Dir string
+	seq atomic.Uint64
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %v", err)
+	}
+	return &FileMailer{Dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	name := fmt.Sprintf("%s-%06d.eml", time.Now().UTC().Format("20060102T150405.000000000Z"), m.seq.Add(1))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(msg.Body)
+
+	if err := os.WriteFile(filepath.Join(m.Dir, name), []byte(b.String()), 0o600); err != nil {
+		return fmt.Errorf("failed to write email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package email
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// SESMailer sends email through Amazon SES from a verified sender identity
+type SESMailer struct {
+	client           *sesv2.Client
+	from             string
+	configurationSet string // optional, for bounce and complaint tracking
+}
+
+func NewSESMailer(from, configurationSet string) (*SESMailer, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	return &SESMailer{
+		client:           sesv2.NewFromConfig(cfg),
+		from:             from,
+		configurationSet: configurationSet,
+	}, nil
+}
+
+func (m *SESMailer) Send(ctx context.Context, msg Message) error {
+	input := &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(m.from),
+		Destination:      &types.Destination{ToAddresses: []string{msg.To}},
+		Content: &types.EmailContent{
+			Simple: &types.Message{
+				Subject: &types.Content{Data: aws.String(msg.Subject), Charset: aws.String("UTF-8")},
+				Body: &types.Body{
+					Text: &types.Content{Data: aws.String(msg.Body), Charset: aws.String("UTF-8")},
+				},
+			},
+		},
+	}
+	if m.configurationSet != "" {
+		input.ConfigurationSetName = aws.String(m.configurationSet)
+	}
+
+	if _, err := m.client.SendEmail(ctx, input); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package encryption
+
+import (
+	"encoding/binary"
+)
+
+// Binding ties a ciphertext to the user, record and field it belongs to.
+//
+// The user ID is part of the KMS encryption context of the data key, so it
+// shows up in CloudTrail for every GenerateDataKey and Decrypt call and a
+// data key cannot be unwrapped on behalf of another user. The record ID and
+// field name go into the AES-GCM associated data of each value, so a
+// ciphertext copied to another row or column fails to decrypt even though it
+// is under the same user.
+type Binding struct {
+	UserID   string
+	RecordID string
+	Field    string
+}
+
+// encryptionContext is the KMS encryption context for PHI data keys. The key
+// policy only allows Lambda access when Purpose and Service are present.
+// Passing an empty userID gives the fixed context used before per-user
+// binding existed.
+func encryptionContext(userID string) map[string]string {
+	encCtx := map[string]string{
+		"Purpose": "PHI-Encryption",
+		"Service": "Therma-Backend",
+	}
+	if userID != "" {
+		encCtx["UserID"] = userID
+	}
+	return encCtx
+}
+
+// userKeyContext is the KMS encryption context for a user's key-encryption
+// key. KeyType keeps it distinct from the context of that user's data keys.
+func userKeyContext(userID string) map[string]string {
+	encCtx := encryptionContext(userID)
+	encCtx["KeyType"] = "UserKEK"
+	return encCtx
+}
+
+// associatedData is the GCM associated data for a value: the ciphertext
+// header followed by the length-prefixed record ID and field name
+func associatedData(header []byte, recordID, field string) []byte {
+	aad := make([]byte, 0, len(header)+4+len(recordID)+len(field))
+	aad = append(aad, header...)
+	aad = binary.BigEndian.AppendUint16(aad, uint16(len(recordID)))
+	aad = append(aad, recordID...)
+	aad = binary.BigEndian.AppendUint16(aad, uint16(len(field)))
+	aad = append(aad, field...)
+	return aad
+}
@@ -0,0 +1,132 @@
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestBindingMismatchFailsToDecrypt(t *testing.T) {
+	e := NewEncryptor(testProvider(t))
+	ctx := context.Background()
+	sealedFor := Binding{UserID: "user-1", RecordID: "record-1", Field: "content"}
+
+	ciphertext, err := e.EncryptPHI(ctx, sealedFor, "private")
+	if err != nil {
+		t.Fatalf("EncryptPHI failed: %v", err)
+	}
+
+	if got, err := e.DecryptPHI(ctx, sealedFor, ciphertext); err != nil || got != "private" {
+		t.Fatalf("DecryptPHI with the sealing binding = %q, %v; want %q", got, err, "private")
+	}
+
+	tests := []struct {
+		name string
+		b    Binding
+	}{
+		{"OtherUser", Binding{UserID: "user-2", RecordID: "record-1", Field: "content"}},
+		{"OtherRecord", Binding{UserID: "user-1", RecordID: "record-2", Field: "content"}},
+		{"OtherField", Binding{UserID: "user-1", RecordID: "record-1", Field: "mood"}},
+		{"NoUser", Binding{RecordID: "record-1", Field: "content"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := e.DecryptPHI(ctx, tt.b, ciphertext); err == nil {
+				t.Errorf("DecryptPHI with %+v = %q, want an error", tt.b, got)
+			}
+		})
+	}
+}
+
+func TestTamperedHeaderFailsToDecrypt(t *testing.T) {
+	e := NewEncryptor(testProvider(t))
+	ctx := context.Background()
+	b := Binding{UserID: "user-1", RecordID: "record-1", Field: "content"}
+
+	ciphertext, err := e.EncryptPHI(ctx, b, "private")
+	if err != nil {
+		t.Fatalf("EncryptPHI failed: %v", err)
+	}
+	parsed, err := ParseCiphertext(ciphertext)
+	if err != nil {
+		t.Fatalf("ParseCiphertext failed: %v", err)
+	}
+
+	// Downgrading to version 1 drops the record and field from the
+	// associated data, but the header is authenticated too
+	parsed.Version = FormatV1
+	downgraded, err := parsed.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if got, err := e.DecryptPHI(ctx, b, downgraded); err == nil {
+		t.Errorf("DecryptPHI of a downgraded ciphertext = %q, want an error", got)
+	}
+
+	parsed.Version = FormatV2
+	parsed.Sealed[0] ^= 1
+	flipped, err := parsed.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if got, err := e.DecryptPHI(ctx, b, flipped); err == nil {
+		t.Errorf("DecryptPHI of a modified ciphertext = %q, want an error", got)
+	}
+}
+
+// TestOpenV1Ciphertext checks that version 1 values, whose data keys were
+// generated without the user in the encryption context, still open
+func TestOpenV1Ciphertext(t *testing.T) {
+	provider := testProvider(t)
+	e := NewEncryptor(provider)
+	ctx := context.Background()
+
+	dataKey, err := provider.GenerateDataKey(ctx, encryptionContext(""))
+	if err != nil {
+		t.Fatalf("GenerateDataKey failed: %v", err)
+	}
+	envelope, err := newEnvelope(dataKey, "record-1")
+	if err != nil {
+		t.Fatalf("newEnvelope failed: %v", err)
+	}
+
+	c := &Ciphertext{Version: FormatV1, Algorithm: AlgorithmAES256GCMKMS, KeyID: dataKey.KeyID, WrappedKey: dataKey.Wrapped, Nonce: make([]byte, 12)}
+	header, err := c.header()
+	if err != nil {
+		t.Fatalf("header failed: %v", err)
+	}
+	c.Sealed = envelope.aead.Seal(nil, c.Nonce, []byte("v1 value"), header)
+	ciphertext, err := c.Encode()
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	opener := e.OpenRecord("user-1", "record-1", base64.StdEncoding.EncodeToString(dataKey.Wrapped))
+	defer opener.Close()
+
+	got, err := opener.Open(ctx, "content", ciphertext)
+	if err != nil {
+		t.Fatalf("Open of a version 1 value failed: %v", err)
+	}
+	if got != "v1 value" {
+		t.Errorf("Open = %q, want %q", got, "v1 value")
+	}
+}
+
+func TestDataKeyIsBoundToUser(t *testing.T) {
+	provider := testProvider(t)
+	ctx := context.Background()
+
+	dataKey, err := provider.GenerateDataKey(ctx, encryptionContext("user-1"))
+	if err != nil {
+		t.Fatalf("GenerateDataKey failed: %v", err)
+	}
+
+	if _, err := provider.DecryptDataKey(ctx, dataKey.Wrapped, encryptionContext("user-2")); err == nil {
+		t.Error("DecryptDataKey with another user's context succeeded")
+	}
+	if _, err := provider.DecryptDataKey(ctx, dataKey.Wrapped, encryptionContext("user-1")); err != nil {
+		t.Errorf("DecryptDataKey with the owner's context failed: %v", err)
+	}
+}
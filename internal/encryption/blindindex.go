@@ -0,0 +1,136 @@
+package encryption
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// BlindIndex computes keyed HMAC-SHA256 tokens of PHI values so rows can be
+// looked up by exact value (e.g. tag = "anxiety") without storing or
+// revealing the value itself.
+//
+// The index key is separate from every encryption key, so the tokens reveal
+// nothing about the ciphertexts and the key can be rotated on its own. Each
+// user gets their own HMAC key derived from the index key and their ID: the
+// same tag gives unrelated tokens for different users, so the database
+// cannot tell how many users share a tag or correlate entries across users.
+// Within one user, equal values still give equal tokens; that is what makes
+// the index searchable.
+type BlindIndex struct {
+	key []byte
+}
+
+// minBlindIndexKeyLen is the shortest index key accepted, in bytes
+const minBlindIndexKeyLen = 32
+
+func NewBlindIndex(key []byte) (*BlindIndex, error) {
+	if len(key) < minBlindIndexKeyLen {
+		return nil, fmt.Errorf("blind index key must be at least %d bytes, got %d", minBlindIndexKeyLen, len(key))
+	}
+	return &BlindIndex{key: append([]byte(nil), key...)}, nil
+}
+
+// NewBlindIndexFromEnv loads the index key from BLIND_INDEX_KEY (base64) or
+// BLIND_INDEX_KEY_CIPHERTEXT (base64 KMS ciphertext of the key, unwrapped
+// once through the ENCRYPTION_PROVIDER key provider). With neither set it
+// returns nil, and search is unavailable. The fixed, public development key
+// is only used with ENCRYPTION_PROVIDER=local and ENCRYPTION_ALLOW_DEV_KEY
+// set, since tokens under it can be recomputed by anyone.
+func NewBlindIndexFromEnv(ctx context.Context) (*BlindIndex, error) {
+	if encoded := os.Getenv("BLIND_INDEX_KEY"); encoded != "" {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("BLIND_INDEX_KEY is not valid base64: %v", err)
+		}
+		return NewBlindIndex(key)
+	}
+
+	if encoded := os.Getenv("BLIND_INDEX_KEY_CIPHERTEXT"); encoded != "" {
+		wrapped, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("BLIND_INDEX_KEY_CIPHERTEXT is not valid base64: %v", err)
+		}
+
+		provider, err := keyProviderFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := provider.DecryptDataKey(ctx, wrapped, blindIndexKeyContext())
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap blind index key: %v", err)
+		}
+		defer func() {
+			for i := range key.Plaintext {
+				key.Plaintext[i] = 0
+			}
+		}()
+
+		return NewBlindIndex(key.Plaintext)
+	}
+
+	if os.Getenv("ENCRYPTION_PROVIDER") == "local" && devKeyAllowed() {
+		key := sha256.Sum256([]byte("therma-local-blind-index-key:development"))
+		return NewBlindIndex(key[:])
+	}
+
+	return nil, nil
+}
+
+// blindIndexKeyContext is the KMS encryption context the index key is
+// wrapped under
+func blindIndexKeyContext() map[string]string {
+	encCtx := encryptionContext("")
+	encCtx["KeyType"] = "BlindIndex"
+	return encCtx
+}
+
+// Token returns the index token of value in field for userID, or "" for an
+// empty value. Values are compared case-insensitively with surrounding and
+// repeated whitespace ignored.
+func (b *BlindIndex) Token(userID, field, value string) string {
+	value = normalizeIndexValue(value)
+	if value == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, b.userKey(userID))
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Tokens returns the distinct non-empty tokens of values, in order of first
+// appearance
+func (b *BlindIndex) Tokens(userID, field string, values []string) []string {
+	tokens := []string{}
+	seen := map[string]bool{}
+	for _, value := range values {
+		token := b.Token(userID, field, value)
+		if token == "" || seen[token] {
+			continue
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// userKey derives the per-user HMAC key
+func (b *BlindIndex) userKey(userID string) []byte {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte("therma-blind-index-v1|"))
+	mac.Write([]byte(userID))
+	return mac.Sum(nil)
+}
+
+func normalizeIndexValue(value string) string {
+	return strings.ToLower(strings.Join(strings.Fields(value), " "))
+}
@@ -0,0 +1,130 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func testBlindIndex(t *testing.T) *BlindIndex {
+	t.Helper()
+	index, err := NewBlindIndex(bytes.Repeat([]byte{7}, minBlindIndexKeyLen))
+	if err != nil {
+		t.Fatalf("NewBlindIndex failed: %v", err)
+	}
+	return index
+}
+
+func TestBlindIndexTokenNormalizes(t *testing.T) {
+	index := testBlindIndex(t)
+	want := index.Token("user-1", "tag", "panic attack")
+
+	for _, value := range []string{"panic attack", "Panic Attack", "PANIC ATTACK", "  panic   attack ", "panic\tattack"} {
+		if got := index.Token("user-1", "tag", value); got != want {
+			t.Errorf("Token(%q) = %q, want %q", value, got, want)
+		}
+	}
+
+	for _, value := range []string{"panic", "panicattack", "panic attacks"} {
+		if got := index.Token("user-1", "tag", value); got == want {
+			t.Errorf("Token(%q) matches the token of %q", value, "panic attack")
+		}
+	}
+
+	for _, value := range []string{"", "   "} {
+		if got := index.Token("user-1", "tag", value); got != "" {
+			t.Errorf("Token(%q) = %q, want \"\"", value, got)
+		}
+	}
+}
+
+func TestBlindIndexTokenSeparation(t *testing.T) {
+	index := testBlindIndex(t)
+	token := index.Token("user-1", "tag", "anxiety")
+
+	tests := []struct {
+		name  string
+		other string
+	}{
+		{"OtherUser", index.Token("user-2", "tag", "anxiety")},
+		{"OtherField", index.Token("user-1", "mood", "anxiety")},
+		{"OtherKey", func() string {
+			other, err := NewBlindIndex(bytes.Repeat([]byte{8}, minBlindIndexKeyLen))
+			if err != nil {
+				t.Fatalf("NewBlindIndex failed: %v", err)
+			}
+			return other.Token("user-1", "tag", "anxiety")
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.other == token {
+				t.Errorf("token %q is shared with user-1's tag token", tt.other)
+			}
+		})
+	}
+}
+
+func TestBlindIndexTokens(t *testing.T) {
+	index := testBlindIndex(t)
+
+	got := index.Tokens("user-1", "tag", []string{"sleep", "Anxiety", "", "SLEEP", "anxiety ", "work"})
+	want := []string{
+		index.Token("user-1", "tag", "sleep"),
+		index.Token("user-1", "tag", "anxiety"),
+		index.Token("user-1", "tag", "work"),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Tokens = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Tokens[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if empty := index.Tokens("user-1", "tag", nil); empty == nil || len(empty) != 0 {
+		t.Errorf("Tokens(nil) = %#v, want an empty, non-nil slice", empty)
+	}
+}
+
+func TestNewBlindIndexRejectsShortKey(t *testing.T) {
+	if _, err := NewBlindIndex(make([]byte, minBlindIndexKeyLen-1)); err == nil {
+		t.Error("NewBlindIndex with a short key succeeded")
+	}
+}
+
+func TestBlindIndexFromEnvRequiresKey(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("ENCRYPTION_PROVIDER", "local")
+	t.Setenv("BLIND_INDEX_KEY", "")
+	t.Setenv("BLIND_INDEX_KEY_CIPHERTEXT", "")
+	t.Setenv("ENCRYPTION_ALLOW_DEV_KEY", "")
+
+	index, err := NewBlindIndexFromEnv(ctx)
+	if err != nil || index != nil {
+		t.Fatalf("NewBlindIndexFromEnv without a key = %v, %v; want nil, nil", index, err)
+	}
+
+	t.Setenv("ENCRYPTION_ALLOW_DEV_KEY", "true")
+	if index, err := NewBlindIndexFromEnv(ctx); err != nil || index == nil {
+		t.Fatalf("NewBlindIndexFromEnv with ENCRYPTION_ALLOW_DEV_KEY = %v, %v; want the development index", index, err)
+	}
+
+	t.Setenv("ENCRYPTION_ALLOW_DEV_KEY", "")
+	t.Setenv("BLIND_INDEX_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, minBlindIndexKeyLen)))
+	index, err = NewBlindIndexFromEnv(ctx)
+	if err != nil || index == nil {
+		t.Fatalf("NewBlindIndexFromEnv with BLIND_INDEX_KEY = %v, %v", index, err)
+	}
+	if got, want := index.Token("user-1", "tag", "sleep"), testBlindIndex(t).Token("user-1", "tag", "sleep"); got != want {
+		t.Errorf("Token = %q, want %q", got, want)
+	}
+
+	t.Setenv("BLIND_INDEX_KEY", "not base64!")
+	if _, err := NewBlindIndexFromEnv(ctx); err == nil {
+		t.Error("NewBlindIndexFromEnv with a malformed BLIND_INDEX_KEY succeeded")
+	}
+}
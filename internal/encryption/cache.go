@@ -0,0 +1,236 @@
+package encryption
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheConfig bounds a CachingKeyProvider
+type CacheConfig struct {
+	// Capacity is the maximum number of cached data keys (encryption and
+	// decryption combined); the least recently used key is evicted first
+	Capacity int
+
+	// MaxAge is how long a data key may be served from the cache
+	MaxAge time.Duration
+
+	// MaxMessagesPerKey is how many GenerateDataKey calls one cached
+	// encryption key may satisfy, i.e. how many records may share it
+	MaxMessagesPerKey uint64
+}
+
+// DefaultCacheConfig keeps key reuse modest: a data key protects at most
+// 100 records and is never used for longer than five minutes
+var DefaultCacheConfig = CacheConfig{
+	Capacity:          100,
+	MaxAge:            5 * time.Minute,
+	MaxMessagesPerKey: 100,
+}
+
+// CacheStats is a snapshot of cache activity since creation
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+}
+
+// CachingKeyProvider wraps a KeyProvider with a bounded in-memory cache of
+// data keys, in the spirit of the AWS Encryption SDK caching materials
+// manager. Encryption keys are cached per encryption context and reused for
+// up to MaxMessagesPerKey records; unwrapped keys are cached per wrapped
+// key and context. Entries expire after MaxAge. It is safe for concurrent
+// use, so a warm Lambda can share one instance across invocations.
+type CachingKeyProvider struct {
+	provider KeyProvider
+	config   CacheConfig
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+type cacheEntry struct {
+	key       string
+	dataKey   *DataKey
+	createdAt time.Time
+	uses      uint64
+}
+
+func NewCachingKeyProvider(provider KeyProvider, config CacheConfig) *CachingKeyProvider {
+	return &CachingKeyProvider{
+		provider: provider,
+		config:   config,
+		now:      time.Now,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// KeyID returns the wrapped provider's master key ID
+func (c *CachingKeyProvider) KeyID() string {
+	return c.provider.KeyID()
+}
+
+// Uncached returns the wrapped provider, for decrypts whose results must
+// never be cached
+func (c *CachingKeyProvider) Uncached() KeyProvider {
+	return c.provider
+}
+
+// GenerateDataKey returns a cached encryption key for encCtx if one is still
+// within its age and usage limits, and asks the wrapped provider otherwise
+func (c *CachingKeyProvider) GenerateDataKey(ctx context.Context, encCtx map[string]string) (*DataKey, error) {
+	key := "enc|" + string(canonicalContext(encCtx))
+
+	if dataKey, ok := c.get(key, true); ok {
+		return dataKey, nil
+	}
+
+	dataKey, err := c.provider.GenerateDataKey(ctx, encCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(key, dataKey, 1)
+	return copyDataKey(dataKey), nil
+}
+
+// DecryptDataKey returns a cached plaintext key if this wrapped key was
+// unwrapped recently under the same context
+func (c *CachingKeyProvider) DecryptDataKey(ctx context.Context, wrappedKey []byte, encCtx map[string]string) (*DataKey, error) {
+	sum := sha256.Sum256(append(canonicalContext(encCtx), wrappedKey...))
+	key := "dec|" + string(sum[:])
+
+	if dataKey, ok := c.get(key, false); ok {
+		return dataKey, nil
+	}
+
+	dataKey, err := c.provider.DecryptDataKey(ctx, wrappedKey, encCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.put(key, dataKey, 0)
+	return copyDataKey(dataKey), nil
+}
+
+// Stats returns the cache counters
+func (c *CachingKeyProvider) Stats() CacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   entries,
+	}
+}
+
+// Clear evicts and zeroes every cached key
+func (c *CachingKeyProvider) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// get returns a copy of a live cached key. For encryption keys (countUse)
+// it also consumes one use and evicts the key once its budget is spent.
+func (c *CachingKeyProvider) get(key string, countUse bool) (*DataKey, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if c.now().Sub(entry.createdAt) >= c.config.MaxAge {
+		c.remove(elem)
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	dataKey := copyDataKey(entry.dataKey)
+	if countUse {
+		entry.uses++
+		if entry.uses >= c.config.MaxMessagesPerKey {
+			c.remove(elem)
+		}
+	}
+	if _, live := c.entries[key]; live {
+		c.lru.MoveToFront(elem)
+	}
+
+	c.hits.Add(1)
+	return dataKey, true
+}
+
+func (c *CachingKeyProvider) put(key string, dataKey *DataKey, uses uint64) {
+	if c.config.Capacity <= 0 || (uses > 0 && uses >= c.config.MaxMessagesPerKey) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+
+	entry := &cacheEntry{
+		key:       key,
+		dataKey:   copyDataKey(dataKey),
+		createdAt: c.now(),
+		uses:      uses,
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.config.Capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry and zeroes its key; callers hold c.mu
+func (c *CachingKeyProvider) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	for i := range entry.dataKey.Plaintext {
+		entry.dataKey.Plaintext[i] = 0
+	}
+	c.evictions.Add(1)
+}
+
+// copyDataKey gives each caller its own plaintext, since Envelope.Destroy
+// zeroes the key it was given
+func copyDataKey(dataKey *DataKey) *DataKey {
+	return &DataKey{
+		Plaintext: append([]byte(nil), dataKey.Plaintext...),
+		Wrapped:   dataKey.Wrapped,
+		KeyID:     dataKey.KeyID,
+	}
+}
+
+// uncached strips a caching layer from provider, if present
+func uncached(provider KeyProvider) KeyProvider {
+	if c, ok := provider.(*CachingKeyProvider); ok {
+		return c.Uncached()
+	}
+	return provider
+}
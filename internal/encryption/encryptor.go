@@ -0,0 +1,320 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Encryptor is the PHI encryption API used by handlers
+type Encryptor interface {
+	// KeyID identifies the master key new data is encrypted under
+	KeyID() string
+
+	// ResolveKeyID returns the canonical ID of that key, the form recorded
+	// on sealed records
+	ResolveKeyID(ctx context.Context) (string, error)
+
+	// NewEnvelope generates a data key for sealing the fields of one record
+	NewEnvelope(ctx context.Context, userID, recordID string) (*Envelope, error)
+
+	// OpenRecord returns an opener for the fields of one stored record
+	OpenRecord(userID, recordID, storedDataKey string) *RecordOpener
+
+	// ShredUser destroys the user's key, making all of their PHI sealed
+	// under it permanently unreadable
+	ShredUser(ctx context.Context, userID string) error
+
+	EncryptPHI(ctx context.Context, b Binding, plaintext string) (string, error)
+	DecryptPHI(ctx context.Context, b Binding, ciphertext string) (string, error)
+	EncryptPHIArray(ctx context.Context, b Binding, plaintexts []string) ([]string, error)
+	DecryptPHIArray(ctx context.Context, b Binding, ciphertexts []string) ([]string, error)
+}
+
+// EnvelopeEncryptor implements Encryptor with envelope encryption on top of
+// any KeyProvider
+type EnvelopeEncryptor struct {
+	provider KeyProvider
+	userKeys *userKeyring
+}
+
+func NewEncryptor(provider KeyProvider) *EnvelopeEncryptor {
+	return &EnvelopeEncryptor{provider: provider}
+}
+
+// WithUserKeys seals new records under keys derived from a per-user
+// key-encryption key kept in store (format version 3) instead of a KMS data
+// key per record. Records sealed before remain readable.
+func (e *EnvelopeEncryptor) WithUserKeys(store UserKeyStore) *EnvelopeEncryptor {
+	e.userKeys = &userKeyring{store: store, provider: e.provider}
+	return e
+}
+
+// NewEncryptorFromEnv builds the encryptor selected by ENCRYPTION_PROVIDER:
+// "kms" (the default) uses KMS_KEY_ID, and "local" uses the base64 32-byte
+// LOCAL_MASTER_KEY. Without LOCAL_MASTER_KEY it fails unless
+// ENCRYPTION_ALLOW_DEV_KEY=true opts into a fixed development key. Data keys
+// are cached according to the DATA_KEY_CACHE_* settings (see
+// cacheConfigFromEnv); DATA_KEY_CACHE_CAPACITY=0 disables the cache.
+// USER_KEY_STORE enables per-user keys (see userKeyStoreFromEnv).
+func NewEncryptorFromEnv() (*EnvelopeEncryptor, error) {
+	provider, err := keyProviderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := cacheConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if config.Capacity > 0 {
+		provider = NewCachingKeyProvider(provider, config)
+	}
+
+	encryptor := NewEncryptor(provider)
+
+	store, err := userKeyStoreFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		encryptor.WithUserKeys(store)
+	}
+
+	return encryptor, nil
+}
+
+func keyProviderFromEnv() (KeyProvider, error) {
+	switch provider := os.Getenv("ENCRYPTION_PROVIDER"); provider {
+	case "", "kms":
+		return NewKMSClient()
+
+	case "local":
+		encoded := os.Getenv("LOCAL_MASTER_KEY")
+		if encoded == "" {
+			// The development key is public, so falling back to it silently
+			// would let a misconfigured deploy seal PHI under it
+			if !devKeyAllowed() {
+				return nil, fmt.Errorf("ENCRYPTION_PROVIDER=local requires LOCAL_MASTER_KEY (or ENCRYPTION_ALLOW_DEV_KEY=true for local development)")
+			}
+			return NewLocalKeyProviderFromSeed("development"), nil
+		}
+		masterKey, err := decodeLocalMasterKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		return NewLocalKeyProvider(masterKey)
+
+	default:
+		return nil, fmt.Errorf("unknown ENCRYPTION_PROVIDER %q", provider)
+	}
+}
+
+// devKeyAllowed reports whether ENCRYPTION_ALLOW_DEV_KEY permits the fixed
+// development keys of the local provider and blind index
+func devKeyAllowed() bool {
+	raw := os.Getenv("ENCRYPTION_ALLOW_DEV_KEY")
+	return raw == "true" || raw == "1"
+}
+
+// userKeyStoreFromEnv returns the store selected by USER_KEY_STORE:
+// "dynamodb" (table USER_KEYS_TABLE_NAME), "memory", or nil when unset,
+// which disables per-user keys
+func userKeyStoreFromEnv() (UserKeyStore, error) {
+	switch store := os.Getenv("USER_KEY_STORE"); store {
+	case "":
+		return nil, nil
+	case "dynamodb":
+		return NewDynamoUserKeyStore()
+	case "memory":
+		return NewMemoryUserKeyStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown USER_KEY_STORE %q", store)
+	}
+}
+
+// cacheConfigFromEnv overrides DefaultCacheConfig with DATA_KEY_CACHE_CAPACITY,
+// DATA_KEY_CACHE_MAX_AGE (a Go duration) and DATA_KEY_CACHE_MAX_MESSAGES
+func cacheConfigFromEnv() (CacheConfig, error) {
+	config := DefaultCacheConfig
+
+	if raw := os.Getenv("DATA_KEY_CACHE_CAPACITY"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return config, fmt.Errorf("invalid DATA_KEY_CACHE_CAPACITY %q", raw)
+		}
+		config.Capacity = n
+	}
+
+	if raw := os.Getenv("DATA_KEY_CACHE_MAX_AGE"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("invalid DATA_KEY_CACHE_MAX_AGE %q", raw)
+		}
+		config.MaxAge = d
+	}
+
+	if raw := os.Getenv("DATA_KEY_CACHE_MAX_MESSAGES"); raw != "" {
+		n, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil || n == 0 {
+			return config, fmt.Errorf("invalid DATA_KEY_CACHE_MAX_MESSAGES %q", raw)
+		}
+		config.MaxMessagesPerKey = n
+	}
+
+	return config, nil
+}
+
+// CacheStats returns the data key cache counters, or false if the encryptor
+// does not cache data keys
+func (e *EnvelopeEncryptor) CacheStats() (CacheStats, bool) {
+	if c, ok := e.provider.(*CachingKeyProvider); ok {
+		return c.Stats(), true
+	}
+	return CacheStats{}, false
+}
+
+// KeyID returns the provider's master key ID
+func (e *EnvelopeEncryptor) KeyID() string {
+	return e.provider.KeyID()
+}
+
+// ResolveKeyID returns the canonical form of KeyID. Providers whose key IDs
+// may be aliases implement keyResolver; for the rest KeyID is canonical.
+func (e *EnvelopeEncryptor) ResolveKeyID(ctx context.Context) (string, error) {
+	if resolver, ok := uncached(e.provider).(keyResolver); ok {
+		return resolver.ResolveKeyID(ctx)
+	}
+	return e.provider.KeyID(), nil
+}
+
+type keyResolver interface {
+	ResolveKeyID(ctx context.Context) (string, error)
+}
+
+// NewEnvelope generates a fresh data key for sealing the fields of one
+// record owned by userID. With per-user keys the data key is derived from
+// the user's key and a random salt; it fails with ErrUserKeyShredded for
+// users whose key has been destroyed.
+func (e *EnvelopeEncryptor) NewEnvelope(ctx context.Context, userID, recordID string) (*Envelope, error) {
+	if e.userKeys != nil {
+		userKey, err := e.userKeys.current(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		defer userKey.destroy()
+
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("failed to generate salt: %v", err)
+		}
+
+		return newUserKeyEnvelope(userKey, salt, recordID)
+	}
+
+	dataKey, err := e.provider.GenerateDataKey(ctx, encryptionContext(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	return newEnvelope(dataKey, recordID)
+}
+
+// OpenRecord returns an opener for the record recordID owned by userID.
+// storedDataKey is the record's WrappedKey column; it is only needed for
+// values written before ciphertexts carried their own header and may be
+// empty otherwise.
+func (e *EnvelopeEncryptor) OpenRecord(userID, recordID, storedDataKey string) *RecordOpener {
+	return &RecordOpener{
+		provider:      e.provider,
+		userKeys:      e.userKeys,
+		userID:        userID,
+		recordID:      recordID,
+		storedDataKey: storedDataKey,
+		envelopes:     map[string]*Envelope{},
+	}
+}
+
+// UsesUserKeys reports whether new records are sealed under per-user keys
+func (e *EnvelopeEncryptor) UsesUserKeys() bool {
+	return e.userKeys != nil
+}
+
+// ErrUserKeysDisabled is returned by ShredUser when the encryptor does not
+// use per-user keys, so there is no key to destroy
+var ErrUserKeysDisabled = errors.New("per-user keys are not enabled")
+
+// ShredUser destroys the user's key. Afterwards the user's version 3
+// ciphertexts cannot be opened and no new PHI can be sealed for them.
+func (e *EnvelopeEncryptor) ShredUser(ctx context.Context, userID string) error {
+	if e.userKeys == nil {
+		return ErrUserKeysDisabled
+	}
+	return e.userKeys.shred(ctx, userID)
+}
+
+// EncryptPHI encrypts a single PHI value under its own data key, returning
+// a self-describing ciphertext bound to b. Records with several fields
+// should use NewEnvelope so they share one data key and one KMS call.
+func (e *EnvelopeEncryptor) EncryptPHI(ctx context.Context, b Binding, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	envelope, err := e.NewEnvelope(ctx, b.UserID, b.RecordID)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt PHI: %v", err)
+	}
+	defer envelope.Destroy()
+
+	return envelope.Seal(b.Field, plaintext)
+}
+
+// DecryptPHI decrypts a value produced by EncryptPHI or Envelope.Seal,
+// dispatching on the ciphertext header. Legacy bare KMS blobs are still
+// accepted. Decryption fails if b does not match the binding the value was
+// sealed with.
+func (e *EnvelopeEncryptor) DecryptPHI(ctx context.Context, b Binding, ciphertext string) (string, error) {
+	opener := e.OpenRecord(b.UserID, b.RecordID, "")
+	defer opener.Close()
+
+	return opener.Open(ctx, b.Field, ciphertext)
+}
+
+// EncryptPHIArray encrypts an array of PHI strings under one data key
+func (e *EnvelopeEncryptor) EncryptPHIArray(ctx context.Context, b Binding, plaintexts []string) ([]string, error) {
+	if len(plaintexts) == 0 {
+		return []string{}, nil
+	}
+
+	envelope, err := e.NewEnvelope(ctx, b.UserID, b.RecordID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt PHI: %v", err)
+	}
+	defer envelope.Destroy()
+
+	return envelope.SealArray(b.Field, plaintexts)
+}
+
+// DecryptPHIArray decrypts an array of PHI strings
+func (e *EnvelopeEncryptor) DecryptPHIArray(ctx context.Context, b Binding, ciphertexts []string) ([]string, error) {
+	opener := e.OpenRecord(b.UserID, b.RecordID, "")
+	defer opener.Close()
+
+	return opener.OpenArray(ctx, b.Field, ciphertexts)
+}
+
+var (
+	_ Encryptor   = (*EnvelopeEncryptor)(nil)
+	_ KeyProvider = (*KMSClient)(nil)
+	_ KeyProvider = (*LocalKeyProvider)(nil)
+	_ KeyProvider = (*CachingKeyProvider)(nil)
+	_ keyResolver = (*KMSClient)(nil)
+
+	_ UserKeyStore = (*MemoryUserKeyStore)(nil)
+	_ UserKeyStore = (*DynamoUserKeyStore)(nil)
+)
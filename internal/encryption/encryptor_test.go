@@ -0,0 +1,41 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestLocalProviderRequiresMasterKey(t *testing.T) {
+	t.Setenv("ENCRYPTION_PROVIDER", "local")
+	t.Setenv("LOCAL_MASTER_KEY", "")
+	t.Setenv("ENCRYPTION_ALLOW_DEV_KEY", "")
+
+	if _, err := keyProviderFromEnv(); err == nil || !strings.Contains(err.Error(), "LOCAL_MASTER_KEY") {
+		t.Errorf("keyProviderFromEnv without LOCAL_MASTER_KEY = %v, want an error naming it", err)
+	}
+
+	t.Setenv("ENCRYPTION_ALLOW_DEV_KEY", "true")
+	provider, err := keyProviderFromEnv()
+	if err != nil {
+		t.Fatalf("keyProviderFromEnv with ENCRYPTION_ALLOW_DEV_KEY failed: %v", err)
+	}
+	if provider.KeyID() != NewLocalKeyProviderFromSeed("development").KeyID() {
+		t.Errorf("KeyID = %q, want the development key", provider.KeyID())
+	}
+
+	masterKey := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	t.Setenv("LOCAL_MASTER_KEY", masterKey)
+	provider, err = keyProviderFromEnv()
+	if err != nil {
+		t.Fatalf("keyProviderFromEnv with LOCAL_MASTER_KEY failed: %v", err)
+	}
+	if provider.KeyID() == NewLocalKeyProviderFromSeed("development").KeyID() {
+		t.Error("LOCAL_MASTER_KEY was ignored in favor of the development key")
+	}
+
+	t.Setenv("LOCAL_MASTER_KEY", base64.StdEncoding.EncodeToString([]byte("short")))
+	if _, err := keyProviderFromEnv(); err == nil {
+		t.Error("keyProviderFromEnv with a short LOCAL_MASTER_KEY succeeded")
+	}
+}
@@ -0,0 +1,343 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// Envelope seals the PHI fields of a single record with one data key.
+// Creating an envelope costs exactly one KMS call; every field after that is
+// encrypted locally with AES-256-GCM, so there is no per-field round trip and
+// no 4 KB KMS plaintext limit.
+//
+// Each sealed value is self-describing (see format.go) and carries the
+// wrapped data key, so it can be decrypted on its own. The record should
+// still store WrappedKey next to its ciphertexts.
+type Envelope struct {
+	version    byte
+	algorithm  Algorithm
+	key        []byte
+	aead       cipher.AEAD
+	wrappedKey []byte // for version 3, the HKDF salt
+	keyID      string
+	recordID   string
+}
+
+func newEnvelope(dataKey *DataKey, recordID string) (*Envelope, error) {
+	aead, err := newAEAD(dataKey.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		version:    FormatV2,
+		algorithm:  AlgorithmAES256GCMKMS,
+		key:        dataKey.Plaintext,
+		aead:       aead,
+		wrappedKey: dataKey.Wrapped,
+		keyID:      dataKey.KeyID,
+		recordID:   recordID,
+	}, nil
+}
+
+// newUserKeyEnvelope derives the data key for one record from the owner's
+// key-encryption key and a salt; the same inputs always give the same key
+func newUserKeyEnvelope(userKey *unwrappedUserKey, salt []byte, recordID string) (*Envelope, error) {
+	key, err := hkdf.Key(sha256.New, userKey.plaintext, salt, "therma-phi-v3|"+userKey.userID, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive data key: %v", err)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		version:    FormatV3,
+		algorithm:  AlgorithmAES256GCMUserKey,
+		key:        key,
+		aead:       aead,
+		wrappedKey: salt,
+		keyID:      userKey.keyID,
+		recordID:   recordID,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	return aead, nil
+}
+
+// WrappedKey returns the KMS-wrapped data key, base64 encoded for storage.
+// It is empty for envelopes derived from a user key, which have nothing to
+// store beyond the ciphertexts themselves.
+func (e *Envelope) WrappedKey() string {
+	if e.version == FormatV3 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(e.wrappedKey)
+}
+
+// KeyID returns the master key the data key is wrapped under, as reported by
+// the provider (for KMS, the key ARN even if an alias was configured), or
+// the user key it was derived from
+func (e *Envelope) KeyID() string {
+	return e.keyID
+}
+
+// Seal encrypts the value of one field into the self-describing ciphertext
+// format, bound to the envelope's record and the field name
+func (e *Envelope) Seal(field, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	c := &Ciphertext{
+		Version:    e.version,
+		Algorithm:  e.algorithm,
+		KeyID:      e.keyID,
+		WrappedKey: e.wrappedKey,
+		Nonce:      nonce,
+	}
+
+	header, err := c.header()
+	if err != nil {
+		return "", err
+	}
+
+	c.Sealed = e.aead.Seal(nil, nonce, []byte(plaintext), associatedData(header, e.recordID, field))
+	return c.Encode()
+}
+
+// SealArray encrypts every element of an array field
+func (e *Envelope) SealArray(field string, plaintexts []string) ([]string, error) {
+	sealed := make([]string, len(plaintexts))
+	for i, plaintext := range plaintexts {
+		s, err := e.Seal(field, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt array element %d: %v", i, err)
+		}
+		sealed[i] = s
+	}
+
+	return sealed, nil
+}
+
+// open decrypts a parsed ciphertext whose data key this envelope holds
+func (e *Envelope) open(c *Ciphertext, field string) (string, error) {
+	header, err := c.header()
+	if err != nil {
+		return "", err
+	}
+
+	aad := header
+	if c.Version >= FormatV2 {
+		aad = associatedData(header, e.recordID, field)
+	}
+	if len(c.Nonce) != e.aead.NonceSize() {
+		return "", fmt.Errorf("failed to decrypt PHI: %d-byte nonce", len(c.Nonce))
+	}
+
+	plaintext, err := e.aead.Open(nil, c.Nonce, c.Sealed, aad)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt PHI: %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// openUnversioned decrypts base64(nonce || ciphertext) values written by the
+// first envelope implementation, before ciphertexts carried a header
+func (e *Envelope) openUnversioned(ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %v", err)
+	}
+
+	nonceSize := e.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+
+	plaintext, err := e.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt PHI: %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Destroy zeroes the plaintext data key; the envelope is unusable afterwards
+func (e *Envelope) Destroy() {
+	for i := range e.key {
+		e.key[i] = 0
+	}
+	e.aead = nil
+}
+
+// RecordOpener decrypts the fields of one record. Every distinct data key is
+// unwrapped once and reused for all fields sealed under it, so opening a
+// record sealed by a single Envelope costs one KMS call.
+type RecordOpener struct {
+	provider      KeyProvider
+	userKeys      *userKeyring // nil when per-user keys are disabled
+	userID        string
+	recordID      string
+	storedDataKey string
+	envelopes     map[string]*Envelope
+}
+
+// Open decrypts the value of one field, dispatching on its format
+func (o *RecordOpener) Open(ctx context.Context, field, ciphertext string) (string, error) {
+	if ciphertext == "" {
+		return "", nil
+	}
+
+	if IsLegacyCiphertext(ciphertext) {
+		if o.storedDataKey == "" {
+			return o.openLegacy(ctx, ciphertext)
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(o.storedDataKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode wrapped data key: %v", err)
+		}
+		envelope, err := o.envelope(ctx, "", wrapped)
+		if err != nil {
+			return "", err
+		}
+		return envelope.openUnversioned(ciphertext)
+	}
+
+	parsed, err := ParseCiphertext(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Version == FormatV3 {
+		envelope, err := o.userKeyEnvelope(ctx, parsed)
+		if err != nil {
+			return "", err
+		}
+		return envelope.open(parsed, field)
+	}
+
+	// Version 1 data keys were generated without the user in the encryption context
+	userID := o.userID
+	if parsed.Version == FormatV1 {
+		userID = ""
+	}
+
+	envelope, err := o.envelope(ctx, userID, parsed.WrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	return envelope.open(parsed, field)
+}
+
+// OpenArray decrypts every element of an array field
+func (o *RecordOpener) OpenArray(ctx context.Context, field string, ciphertexts []string) ([]string, error) {
+	opened := make([]string, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		plaintext, err := o.Open(ctx, field, ciphertext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt array element %d: %v", i, err)
+		}
+		opened[i] = plaintext
+	}
+
+	return opened, nil
+}
+
+// Close destroys every data key the opener unwrapped
+func (o *RecordOpener) Close() {
+	for _, envelope := range o.envelopes {
+		envelope.Destroy()
+	}
+	o.envelopes = map[string]*Envelope{}
+}
+
+func (o *RecordOpener) envelope(ctx context.Context, userID string, wrapped []byte) (*Envelope, error) {
+	cacheKey := userID + "|" + string(wrapped)
+	if envelope, ok := o.envelopes[cacheKey]; ok {
+		return envelope, nil
+	}
+
+	dataKey, err := o.provider.DecryptDataKey(ctx, wrapped, encryptionContext(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err := newEnvelope(dataKey, o.recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	o.envelopes[cacheKey] = envelope
+	return envelope, nil
+}
+
+func (o *RecordOpener) userKeyEnvelope(ctx context.Context, c *Ciphertext) (*Envelope, error) {
+	cacheKey := "v3|" + c.KeyID + "|" + string(c.WrappedKey)
+	if envelope, ok := o.envelopes[cacheKey]; ok {
+		return envelope, nil
+	}
+
+	if o.userKeys == nil {
+		return nil, fmt.Errorf("ciphertext is sealed under a user key but per-user keys are not enabled")
+	}
+
+	userKey, err := o.userKeys.open(ctx, o.userID, c.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer userKey.destroy()
+
+	envelope, err := newUserKeyEnvelope(userKey, c.WrappedKey, o.recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	o.envelopes[cacheKey] = envelope
+	return envelope, nil
+}
+
+// openLegacy decrypts a bare KMS ciphertext blob written by the original
+// per-field kms.Encrypt implementation. Such a blob is unwrapped exactly like
+// a data key; the "key" is the PHI value itself.
+func (o *RecordOpener) openLegacy(ctx context.Context, ciphertext string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %v", err)
+	}
+
+	// Never cache this result: the unwrapped "key" is PHI, not a data key
+	result, err := uncached(o.provider).DecryptDataKey(ctx, blob, encryptionContext(""))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt PHI: %v", err)
+	}
+
+	return string(result.Plaintext), nil
+}
@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Self-describing ciphertext format
+//
+// Every value sealed by this package is stored as
+//
+//	"tev:" + base64(header || sealed)
+//
+// where header is
+//
+//	version    1 byte
+//	algorithm  1 byte
+//	key ID     2-byte big-endian length + bytes (KMS key ARN or alias)
+//	data key   2-byte big-endian length + bytes (KMS-wrapped DEK, or the
+//	           HKDF salt in version 3)
+//	nonce      1-byte length + bytes
+//
+// and sealed is the AES-GCM ciphertext and tag. The header is passed to GCM
+// as associated data, so it cannot be altered without failing decryption.
+//
+// Version 1 data keys use the fixed service encryption context and the GCM
+// associated data is the header alone. Version 2 adds the owning user ID to
+// the encryption context and the record ID and field name to the associated
+// data (see Binding).
+//
+// Version 3 has no per-record KMS call: the data key is derived with HKDF
+// from the owner's key-encryption key (see UserKeyStore) and the random salt
+// stored in the data key slot, and the key ID is that user key's ID. Binding
+// is as in version 2. Destroying the user key makes every version 3 value of
+// that user unreadable.
+//
+// Values without the "tev:" prefix are legacy bare KMS ciphertext blobs
+// from before the format existed.
+const ciphertextPrefix = "tev:"
+
+// Ciphertext format versions
+const (
+	FormatV1 byte = 1
+	FormatV2 byte = 2
+	FormatV3 byte = 3
+)
+
+// gcmNonceSize is the nonce length of every algorithm; AES-GCM panics on any
+// other
+const gcmNonceSize = 12
+
+// Algorithm identifies how a ciphertext was sealed
+type Algorithm byte
+
+const (
+	// AlgorithmAES256GCMKMS is AES-256-GCM under a data key wrapped by KMS
+	AlgorithmAES256GCMKMS Algorithm = 1
+
+	// AlgorithmAES256GCMUserKey is AES-256-GCM under a data key derived with
+	// HKDF-SHA256 from a per-user key-encryption key
+	AlgorithmAES256GCMUserKey Algorithm = 2
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmAES256GCMKMS:
+		return "AES-256-GCM/KMS"
+	case AlgorithmAES256GCMUserKey:
+		return "AES-256-GCM/HKDF-UserKey"
+	}
+	return fmt.Sprintf("Algorithm(%d)", byte(a))
+}
+
+// Ciphertext is a parsed self-describing ciphertext
+type Ciphertext struct {
+	Version    byte
+	Algorithm  Algorithm
+	KeyID      string
+	WrappedKey []byte
+	Nonce      []byte
+	Sealed     []byte
+}
+
+// IsLegacyCiphertext reports whether s is a bare KMS blob that predates the
+// versioned format
+func IsLegacyCiphertext(s string) bool {
+	return s != "" && !strings.HasPrefix(s, ciphertextPrefix)
+}
+
+// header serializes everything but the sealed payload; it doubles as the
+// GCM associated data
+func (c *Ciphertext) header() ([]byte, error) {
+	if len(c.KeyID) > 0xffff || len(c.WrappedKey) > 0xffff || len(c.Nonce) > 0xff {
+		return nil, fmt.Errorf("ciphertext header field too long")
+	}
+
+	buf := make([]byte, 0, 7+len(c.KeyID)+len(c.WrappedKey)+len(c.Nonce))
+	buf = append(buf, c.Version, byte(c.Algorithm))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(c.KeyID)))
+	buf = append(buf, c.KeyID...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(c.WrappedKey)))
+	buf = append(buf, c.WrappedKey...)
+	buf = append(buf, byte(len(c.Nonce)))
+	buf = append(buf, c.Nonce...)
+	return buf, nil
+}
+
+// Encode returns the storage form of the ciphertext
+func (c *Ciphertext) Encode() (string, error) {
+	header, err := c.header()
+	if err != nil {
+		return "", err
+	}
+
+	return ciphertextPrefix + base64.StdEncoding.EncodeToString(append(header, c.Sealed...)), nil
+}
+
+// ParseCiphertext decodes a value produced by Encode
+func ParseCiphertext(s string) (*Ciphertext, error) {
+	if !strings.HasPrefix(s, ciphertextPrefix) {
+		return nil, fmt.Errorf("not a versioned ciphertext")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(s[len(ciphertextPrefix):])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ciphertext: %v", err)
+	}
+
+	r := &byteReader{buf: raw}
+	c := &Ciphertext{Version: r.readByte()}
+	if c.Version != FormatV1 && c.Version != FormatV2 && c.Version != FormatV3 {
+		return nil, fmt.Errorf("unsupported ciphertext version %d", c.Version)
+	}
+
+	c.Algorithm = Algorithm(r.readByte())
+	c.KeyID = string(r.readBytes(int(r.readUint16())))
+	c.WrappedKey = r.readBytes(int(r.readUint16()))
+	c.Nonce = r.readBytes(int(r.readByte()))
+	c.Sealed = r.rest()
+	if r.err != nil {
+		return nil, fmt.Errorf("malformed ciphertext header: %v", r.err)
+	}
+
+	expected := AlgorithmAES256GCMKMS
+	if c.Version == FormatV3 {
+		expected = AlgorithmAES256GCMUserKey
+	}
+	if c.Algorithm != expected {
+		return nil, fmt.Errorf("unsupported ciphertext algorithm %s for version %d", c.Algorithm, c.Version)
+	}
+	if len(c.Nonce) != gcmNonceSize {
+		return nil, fmt.Errorf("malformed ciphertext header: %d-byte nonce", len(c.Nonce))
+	}
+
+	return c, nil
+}
+
+// byteReader reads length-prefixed fields, remembering the first error
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = fmt.Errorf("truncated")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *byteReader) readByte() byte {
+	b := r.readBytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *byteReader) readUint16() uint16 {
+	b := r.readBytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *byteReader) rest() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
@@ -0,0 +1,274 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testProvider(t *testing.T) *LocalKeyProvider {
+	t.Helper()
+	masterKey := make([]byte, 32)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatalf("failed to generate master key: %v", err)
+	}
+	provider, err := NewLocalKeyProvider(masterKey)
+	if err != nil {
+		t.Fatalf("NewLocalKeyProvider failed: %v", err)
+	}
+	return provider
+}
+
+// legacyBlob wraps plaintext the way the original per-field kms.Encrypt did:
+// as a KMS ciphertext under the fixed service encryption context
+func legacyBlob(t *testing.T, p *LocalKeyProvider, plaintext string) string {
+	t.Helper()
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	blob := append([]byte(localWrapMagic), nonce...)
+	blob = p.aead.Seal(blob, nonce, []byte(plaintext), canonicalContext(encryptionContext("")))
+	return base64.StdEncoding.EncodeToString(blob)
+}
+
+func TestCiphertextRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		c    Ciphertext
+	}{
+		{"V1", Ciphertext{Version: FormatV1, Algorithm: AlgorithmAES256GCMKMS, KeyID: "arn:aws:kms:key/1", WrappedKey: []byte("wrapped"), Nonce: bytes.Repeat([]byte{1}, 12), Sealed: []byte("sealed")}},
+		{"V2", Ciphertext{Version: FormatV2, Algorithm: AlgorithmAES256GCMKMS, KeyID: "alias/therma", WrappedKey: []byte{0, 1, 2}, Nonce: bytes.Repeat([]byte{2}, 12), Sealed: []byte{9, 8, 7}}},
+		{"V3", Ciphertext{Version: FormatV3, Algorithm: AlgorithmAES256GCMUserKey, KeyID: "uk:user-1:1", WrappedKey: bytes.Repeat([]byte{3}, 32), Nonce: bytes.Repeat([]byte{4}, 12), Sealed: []byte("x")}},
+		{"EmptyFields", Ciphertext{Version: FormatV2, Algorithm: AlgorithmAES256GCMKMS, Nonce: make([]byte, 12)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.c.Encode()
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if !strings.HasPrefix(encoded, ciphertextPrefix) || IsLegacyCiphertext(encoded) {
+				t.Fatalf("Encode = %q, want a %q-prefixed value", encoded, ciphertextPrefix)
+			}
+
+			parsed, err := ParseCiphertext(encoded)
+			if err != nil {
+				t.Fatalf("ParseCiphertext failed: %v", err)
+			}
+			if parsed.Version != tt.c.Version || parsed.Algorithm != tt.c.Algorithm || parsed.KeyID != tt.c.KeyID ||
+				!bytes.Equal(parsed.WrappedKey, tt.c.WrappedKey) || !bytes.Equal(parsed.Nonce, tt.c.Nonce) ||
+				!bytes.Equal(parsed.Sealed, tt.c.Sealed) {
+				t.Errorf("ParseCiphertext = %+v, want %+v", parsed, tt.c)
+			}
+		})
+	}
+}
+
+func TestParseCiphertextRejectsMalformed(t *testing.T) {
+	valid := Ciphertext{Version: FormatV2, Algorithm: AlgorithmAES256GCMKMS, KeyID: "k", WrappedKey: []byte("w"), Nonce: bytes.Repeat([]byte("n"), 12)}
+	header, err := valid.header()
+	if err != nil {
+		t.Fatalf("header failed: %v", err)
+	}
+	shortNonce := valid
+	shortNonce.Nonce = []byte("n")
+	shortNonceHeader, err := shortNonce.header()
+	if err != nil {
+		t.Fatalf("header failed: %v", err)
+	}
+	encode := func(raw []byte) string {
+		return ciphertextPrefix + base64.StdEncoding.EncodeToString(raw)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"NoPrefix", base64.StdEncoding.EncodeToString(header)},
+		{"BadBase64", ciphertextPrefix + "!!!"},
+		{"Empty", ciphertextPrefix},
+		{"UnknownVersion", encode(append([]byte{9}, header[1:]...))},
+		{"WrongAlgorithmForV2", encode(append([]byte{FormatV2, byte(AlgorithmAES256GCMUserKey)}, header[2:]...))},
+		{"WrongAlgorithmForV3", encode(append([]byte{FormatV3, byte(AlgorithmAES256GCMKMS)}, header[2:]...))},
+		{"Truncated", encode(header[:len(header)-1])},
+		{"ShortNonce", encode(append(shortNonceHeader, "sealed"...))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c, err := ParseCiphertext(tt.value); err == nil {
+				t.Errorf("ParseCiphertext(%q) = %+v, want an error", tt.value, c)
+			}
+		})
+	}
+}
+
+// TestDecryptPHIRejectsBadNonce checks that a stored value whose nonce is
+// not 12 bytes fails to decrypt instead of panicking in AES-GCM
+func TestDecryptPHIRejectsBadNonce(t *testing.T) {
+	e := NewEncryptor(testProvider(t))
+	ctx := context.Background()
+	b := Binding{UserID: "user-1", RecordID: "record-1", Field: "content"}
+
+	ciphertext, err := e.EncryptPHI(ctx, b, "private")
+	if err != nil {
+		t.Fatalf("EncryptPHI failed: %v", err)
+	}
+	parsed, err := ParseCiphertext(ciphertext)
+	if err != nil {
+		t.Fatalf("ParseCiphertext failed: %v", err)
+	}
+
+	for _, size := range []int{0, 1, 11, 13, 255} {
+		parsed.Nonce = make([]byte, size)
+		tampered, err := parsed.Encode()
+		if err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		if got, err := e.DecryptPHI(ctx, b, tampered); err == nil {
+			t.Errorf("DecryptPHI with a %d-byte nonce = %q, want an error", size, got)
+		}
+	}
+}
+
+func TestIsLegacyCiphertext(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", false},
+		{"tev:AQE=", false},
+		{"AQICAHh...", true},
+	}
+
+	for _, tt := range tests {
+		if got := IsLegacyCiphertext(tt.value); got != tt.want {
+			t.Errorf("IsLegacyCiphertext(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSealedValuesAreVersioned(t *testing.T) {
+	e := NewEncryptor(testProvider(t))
+	ctx := context.Background()
+
+	envelope, err := e.NewEnvelope(ctx, "user-1", "record-1")
+	if err != nil {
+		t.Fatalf("NewEnvelope failed: %v", err)
+	}
+	defer envelope.Destroy()
+
+	sealed, err := envelope.Seal("content", "dear diary")
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+
+	parsed, err := ParseCiphertext(sealed)
+	if err != nil {
+		t.Fatalf("ParseCiphertext failed: %v", err)
+	}
+	if parsed.Version != FormatV2 || parsed.KeyID != e.KeyID() {
+		t.Errorf("sealed value has version %d and key %q, want %d and %q", parsed.Version, parsed.KeyID, FormatV2, e.KeyID())
+	}
+	if strings.Contains(sealed, "dear diary") {
+		t.Error("sealed value contains the plaintext")
+	}
+
+	if empty, err := envelope.Seal("mood", ""); err != nil || empty != "" {
+		t.Errorf("Seal of an empty value = %q, %v; want \"\"", empty, err)
+	}
+}
+
+func TestOpenLegacyCiphertext(t *testing.T) {
+	provider := testProvider(t)
+	e := NewEncryptor(provider)
+	ctx := context.Background()
+
+	blob := legacyBlob(t, provider, "written in 2023")
+	if !IsLegacyCiphertext(blob) {
+		t.Fatalf("legacy blob %q is not recognized as legacy", blob)
+	}
+
+	opener := e.OpenRecord("user-1", "record-1", "")
+	defer opener.Close()
+
+	plaintext, err := opener.Open(ctx, "content", blob)
+	if err != nil {
+		t.Fatalf("Open of a legacy blob failed: %v", err)
+	}
+	if plaintext != "written in 2023" {
+		t.Errorf("Open = %q, want %q", plaintext, "written in 2023")
+	}
+}
+
+// TestOpenUnversionedEnvelopeValue covers base64(nonce || ciphertext)
+// values of the first envelope implementation, opened with the data key
+// stored on the row
+func TestOpenUnversionedEnvelopeValue(t *testing.T) {
+	provider := testProvider(t)
+	e := NewEncryptor(provider)
+	ctx := context.Background()
+
+	dataKey, err := provider.GenerateDataKey(ctx, encryptionContext(""))
+	if err != nil {
+		t.Fatalf("GenerateDataKey failed: %v", err)
+	}
+	aead, err := newAEAD(dataKey.Plaintext)
+	if err != nil {
+		t.Fatalf("newAEAD failed: %v", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatalf("failed to generate nonce: %v", err)
+	}
+	value := base64.StdEncoding.EncodeToString(aead.Seal(append([]byte{}, nonce...), nonce, []byte("first envelope"), nil))
+
+	opener := e.OpenRecord("user-1", "record-1", base64.StdEncoding.EncodeToString(dataKey.Wrapped))
+	defer opener.Close()
+
+	plaintext, err := opener.Open(ctx, "content", value)
+	if err != nil {
+		t.Fatalf("Open of an unversioned value failed: %v", err)
+	}
+	if plaintext != "first envelope" {
+		t.Errorf("Open = %q, want %q", plaintext, "first envelope")
+	}
+}
+
+func TestEncryptPHIRoundTrip(t *testing.T) {
+	e := NewEncryptor(testProvider(t))
+	ctx := context.Background()
+	b := Binding{UserID: "user-1", RecordID: "record-1", Field: "content"}
+
+	for _, plaintext := range []string{"", "a", "café ☃", strings.Repeat("long entry ", 1000)} {
+		ciphertext, err := e.EncryptPHI(ctx, b, plaintext)
+		if err != nil {
+			t.Fatalf("EncryptPHI(%q) failed: %v", plaintext, err)
+		}
+		got, err := e.DecryptPHI(ctx, b, ciphertext)
+		if err != nil {
+			t.Fatalf("DecryptPHI failed: %v", err)
+		}
+		if got != plaintext {
+			t.Errorf("DecryptPHI = %q, want %q", got, plaintext)
+		}
+	}
+
+	tags := []string{"anxiety", "sleep"}
+	sealed, err := e.EncryptPHIArray(ctx, Binding{UserID: "user-1", RecordID: "record-1", Field: "tags"}, tags)
+	if err != nil {
+		t.Fatalf("EncryptPHIArray failed: %v", err)
+	}
+	opened, err := e.DecryptPHIArray(ctx, Binding{UserID: "user-1", RecordID: "record-1", Field: "tags"}, sealed)
+	if err != nil {
+		t.Fatalf("DecryptPHIArray failed: %v", err)
+	}
+	if strings.Join(opened, ",") != strings.Join(tags, ",") {
+		t.Errorf("DecryptPHIArray = %v, want %v", opened, tags)
+	}
+}
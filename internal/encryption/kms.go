@@ -2,7 +2,6 @@ package encryption
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"os"
 
@@ -12,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/kms/types"
 )
 
+// KMSClient is the KeyProvider backed by AWS KMS
 type KMSClient struct {
 	client *kms.Client
 	keyID  string
@@ -35,92 +35,59 @@ func NewKMSClient() (*KMSClient, error) {
 	}, nil
 }
 
-// EncryptPHI encrypts PHI data using AWS KMS envelope encryption
-func (k *KMSClient) EncryptPHI(ctx context.Context, plaintext string) (string, error) {
-	if plaintext == "" {
-		return "", nil
-	}
+// KeyID returns the KMS key ID or alias used for encryption
+func (k *KMSClient) KeyID() string {
+	return k.keyID
+}
 
-	input := &kms.EncryptInput{
-		KeyId:     aws.String(k.keyID),
-		Plaintext: []byte(plaintext),
-		EncryptionContext: map[string]string{
-			"Purpose": "PHI-Encryption",
-			"Service": "Therma-Backend",
-		},
+// GenerateDataKey asks KMS for a fresh AES-256 data key
+func (k *KMSClient) GenerateDataKey(ctx context.Context, encCtx map[string]string) (*DataKey, error) {
+	input := &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(k.keyID),
+		KeySpec:           types.DataKeySpecAes256,
+		EncryptionContext: encCtx,
 	}
 
-	result, err := k.client.Encrypt(ctx, input)
+	result, err := k.client.GenerateDataKey(ctx, input)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt PHI: %v", err)
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
 	}
 
-	// Return base64 encoded ciphertext
-	return base64.StdEncoding.EncodeToString(result.CiphertextBlob), nil
+	return &DataKey{
+		Plaintext: result.Plaintext,
+		Wrapped:   result.CiphertextBlob,
+		KeyID:     aws.ToString(result.KeyId),
+	}, nil
 }
 
-// DecryptPHI decrypts PHI data using AWS KMS
-func (k *KMSClient) DecryptPHI(ctx context.Context, ciphertext string) (string, error) {
-	if ciphertext == "" {
-		return "", nil
-	}
-
-	// Decode base64 ciphertext
-	ciphertextBlob, err := base64.StdEncoding.DecodeString(ciphertext)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode ciphertext: %v", err)
-	}
-
+// DecryptDataKey unwraps a data key returned by GenerateDataKey
+func (k *KMSClient) DecryptDataKey(ctx context.Context, wrappedKey []byte, encCtx map[string]string) (*DataKey, error) {
 	input := &kms.DecryptInput{
-		CiphertextBlob: ciphertextBlob,
-		EncryptionContext: map[string]string{
-			"Purpose": "PHI-Encryption",
-			"Service": "Therma-Backend",
-		},
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: encCtx,
 	}
 
 	result, err := k.client.Decrypt(ctx, input)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt PHI: %v", err)
-	}
-
-	return string(result.Plaintext), nil
-}
-
-// EncryptPHIArray encrypts an array of PHI strings
-func (k *KMSClient) EncryptPHIArray(ctx context.Context, plaintexts []string) ([]string, error) {
-	if len(plaintexts) == 0 {
-		return []string{}, nil
-	}
-
-	encrypted := make([]string, len(plaintexts))
-	for i, plaintext := range plaintexts {
-		enc, err := k.EncryptPHI(ctx, plaintext)
-		if err != nil {
-			return nil, fmt.Errorf("failed to encrypt array element %d: %v", i, err)
-		}
-		encrypted[i] = enc
+		return nil, fmt.Errorf("failed to decrypt data key: %v", err)
 	}
 
-	return encrypted, nil
+	return &DataKey{
+		Plaintext: result.Plaintext,
+		Wrapped:   wrappedKey,
+		KeyID:     aws.ToString(result.KeyId),
+	}, nil
 }
 
-// DecryptPHIArray decrypts an array of PHI strings
-func (k *KMSClient) DecryptPHIArray(ctx context.Context, ciphertexts []string) ([]string, error) {
-	if len(ciphertexts) == 0 {
-		return []string{}, nil
-	}
-
-	decrypted := make([]string, len(ciphertexts))
-	for i, ciphertext := range ciphertexts {
-		dec, err := k.DecryptPHI(ctx, ciphertext)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt array element %d: %v", i, err)
-		}
-		decrypted[i] = dec
+// ResolveKeyID returns the ARN of the configured key, following an alias to
+// the key it currently points at
+func (k *KMSClient) ResolveKeyID(ctx context.Context) (string, error) {
+	result, err := k.client.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(k.keyID)})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe KMS key %s: %v", k.keyID, err)
 	}
 
-	return decrypted, nil
+	return aws.ToString(result.KeyMetadata.Arn), nil
 }
 
 // ValidateKMSKey validates that the KMS key exists and is accessible
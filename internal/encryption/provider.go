@@ -0,0 +1,157 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// KeyProvider generates and unwraps data keys under a master key.
+// KMSClient is the production implementation; LocalKeyProvider runs
+// in-process for tests and local development.
+type KeyProvider interface {
+	// KeyID identifies the master key new data keys are wrapped under
+	KeyID() string
+
+	// GenerateDataKey returns a fresh AES-256 data key wrapped under the
+	// master key and bound to encCtx
+	GenerateDataKey(ctx context.Context, encCtx map[string]string) (*DataKey, error)
+
+	// DecryptDataKey unwraps a key returned by GenerateDataKey; encCtx must
+	// match the one it was generated with
+	DecryptDataKey(ctx context.Context, wrappedKey []byte, encCtx map[string]string) (*DataKey, error)
+}
+
+// DataKey is an AES-256 data key in both plaintext and wrapped form
+type DataKey struct {
+	Plaintext []byte
+	Wrapped   []byte
+	KeyID     string // master key that wrapped it, e.g. a KMS key ARN
+}
+
+// localWrapMagic prefixes keys wrapped by LocalKeyProvider so foreign blobs
+// (e.g. real KMS ciphertexts) are rejected with a clear error
+const localWrapMagic = "lkp1"
+
+// LocalKeyProvider wraps data keys with AES-256-GCM under an in-process
+// master key, using the encryption context as associated data. It behaves
+// like KMS for binding purposes but needs no network access. It must never
+// be used for production PHI.
+type LocalKeyProvider struct {
+	aead  cipher.AEAD
+	keyID string
+	rand  io.Reader
+}
+
+// NewLocalKeyProvider creates a provider from a 32-byte master key
+func NewLocalKeyProvider(masterKey []byte) (*LocalKeyProvider, error) {
+	if len(masterKey) != 32 {
+		return nil, fmt.Errorf("local master key must be 32 bytes, got %d", len(masterKey))
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	fingerprint := sha256.Sum256(masterKey)
+	return &LocalKeyProvider{
+		aead:  aead,
+		keyID: "local:" + hex.EncodeToString(fingerprint[:8]),
+		rand:  rand.Reader,
+	}, nil
+}
+
+// NewLocalKeyProviderFromSeed derives the master key from a seed string, so
+// the same seed always yields a provider that can open the same data
+func NewLocalKeyProviderFromSeed(seed string) *LocalKeyProvider {
+	masterKey := sha256.Sum256([]byte("therma-local-master-key:" + seed))
+	provider, _ := NewLocalKeyProvider(masterKey[:])
+	return provider
+}
+
+// WithRand makes data key and wrapping nonce generation read from r instead
+// of crypto/rand, for reproducible test fixtures
+func (p *LocalKeyProvider) WithRand(r io.Reader) *LocalKeyProvider {
+	p.rand = r
+	return p
+}
+
+// KeyID returns "local:" followed by a fingerprint of the master key
+func (p *LocalKeyProvider) KeyID() string {
+	return p.keyID
+}
+
+// GenerateDataKey returns a random data key wrapped under the master key
+func (p *LocalKeyProvider) GenerateDataKey(ctx context.Context, encCtx map[string]string) (*DataKey, error) {
+	plaintext := make([]byte, 32)
+	if _, err := io.ReadFull(p.rand, plaintext); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := io.ReadFull(p.rand, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	wrapped := append([]byte(localWrapMagic), nonce...)
+	wrapped = p.aead.Seal(wrapped, nonce, plaintext, canonicalContext(encCtx))
+
+	return &DataKey{Plaintext: plaintext, Wrapped: wrapped, KeyID: p.keyID}, nil
+}
+
+// DecryptDataKey unwraps a key produced by GenerateDataKey
+func (p *LocalKeyProvider) DecryptDataKey(ctx context.Context, wrappedKey []byte, encCtx map[string]string) (*DataKey, error) {
+	nonceSize := p.aead.NonceSize()
+	if len(wrappedKey) < len(localWrapMagic)+nonceSize || string(wrappedKey[:len(localWrapMagic)]) != localWrapMagic {
+		return nil, fmt.Errorf("failed to decrypt data key: not wrapped by a local key provider")
+	}
+
+	body := wrappedKey[len(localWrapMagic):]
+	plaintext, err := p.aead.Open(nil, body[:nonceSize], body[nonceSize:], canonicalContext(encCtx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %v", err)
+	}
+
+	return &DataKey{Plaintext: plaintext, Wrapped: wrappedKey, KeyID: p.keyID}, nil
+}
+
+// canonicalContext serializes an encryption context in sorted key order
+func canonicalContext(encCtx map[string]string) []byte {
+	keys := make([]string, 0, len(encCtx))
+	for k := range encCtx {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf []byte
+	for _, k := range keys {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(k)))
+		buf = append(buf, k...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(encCtx[k])))
+		buf = append(buf, encCtx[k]...)
+	}
+	return buf
+}
+
+// decodeLocalMasterKey parses the base64 LOCAL_MASTER_KEY setting
+func decodeLocalMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("LOCAL_MASTER_KEY is not valid base64: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,212 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awsbackend/internal/models"
+)
+
+// ErrUserKeyNotFound is returned by a UserKeyStore for users without a key
+var ErrUserKeyNotFound = errors.New("user key not found")
+
+// ErrUserKeyExists is returned by UserKeyStore.Create when the user already
+// has a key or a shredded tombstone
+var ErrUserKeyExists = errors.New("user key already exists")
+
+// ErrUserKeyShredded is returned when sealing or opening PHI of a user whose
+// key has been destroyed
+var ErrUserKeyShredded = errors.New("user key has been shredded")
+
+// userKeyIDPrefix marks key IDs of user keys, as opposed to KMS key ARNs
+const userKeyIDPrefix = "userkey:"
+
+// IsUserKeyID reports whether keyID, as recorded on a row, names a per-user
+// key rather than a KMS master key
+func IsUserKeyID(keyID string) bool {
+	return strings.HasPrefix(keyID, userKeyIDPrefix)
+}
+
+// UserKeyStore persists wrapped per-user key-encryption keys.
+//
+// Shredding must be permanent: a shredded user keeps a tombstone without key
+// material, so the key cannot be silently re-created and sealing new PHI for
+// a deleted account fails. The store's own backups must expire within the
+// retention the deletion policy promises (DynamoDB point-in-time recovery
+// keeps 35 days), since a restored wrapped key would be usable again.
+type UserKeyStore interface {
+	// Get returns the user's key or tombstone, or ErrUserKeyNotFound
+	Get(ctx context.Context, userID string) (*models.UserKey, error)
+
+	// Create stores a new key, or returns ErrUserKeyExists
+	Create(ctx context.Context, key *models.UserKey) error
+
+	// Shred replaces the user's key with a tombstone. Shredding a user that
+	// has no key still leaves a tombstone; shredding twice is not an error.
+	Shred(ctx context.Context, userID string, at time.Time) error
+}
+
+// MemoryUserKeyStore is an in-process UserKeyStore for tests and local
+// development; keys are lost when the process exits
+type MemoryUserKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]models.UserKey
+}
+
+func NewMemoryUserKeyStore() *MemoryUserKeyStore {
+	return &MemoryUserKeyStore{keys: map[string]models.UserKey{}}
+}
+
+func (s *MemoryUserKeyStore) Get(ctx context.Context, userID string) (*models.UserKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[userID]
+	if !ok {
+		return nil, ErrUserKeyNotFound
+	}
+	return &key, nil
+}
+
+func (s *MemoryUserKeyStore) Create(ctx context.Context, key *models.UserKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key.UserID]; ok {
+		return ErrUserKeyExists
+	}
+	s.keys[key.UserID] = *key
+	return nil
+}
+
+func (s *MemoryUserKeyStore) Shred(ctx context.Context, userID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.keys[userID]
+	if key.ShreddedAt != nil {
+		return nil
+	}
+
+	s.keys[userID] = models.UserKey{
+		UserID:      userID,
+		KeyID:       key.KeyID,
+		MasterKeyID: key.MasterKeyID,
+		CreatedAt:   key.CreatedAt,
+		ShreddedAt:  &at,
+	}
+	return nil
+}
+
+// userKeyring creates, unwraps and shreds user keys. The store is read on
+// every use rather than cached, so a shred takes effect immediately in every
+// warm Lambda.
+type userKeyring struct {
+	store    UserKeyStore
+	provider KeyProvider
+}
+
+// unwrappedUserKey is a user key in plaintext; destroy it after use
+type unwrappedUserKey struct {
+	userID    string
+	keyID     string
+	plaintext []byte
+}
+
+func (k *unwrappedUserKey) destroy() {
+	for i := range k.plaintext {
+		k.plaintext[i] = 0
+	}
+}
+
+// current returns the user's key, creating it on first use
+func (r *userKeyring) current(ctx context.Context, userID string) (*unwrappedUserKey, error) {
+	key, err := r.store.Get(ctx, userID)
+	if err == ErrUserKeyNotFound {
+		key, err = r.create(ctx, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return r.unwrap(ctx, key)
+}
+
+// open returns the user's key if it is the one with keyID
+func (r *userKeyring) open(ctx context.Context, userID, keyID string) (*unwrappedUserKey, error) {
+	key, err := r.store.Get(ctx, userID)
+	if err == ErrUserKeyNotFound {
+		return nil, fmt.Errorf("no user key for the owner of this ciphertext")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key.KeyID != keyID {
+		return nil, fmt.Errorf("ciphertext was sealed under user key %s, not %s", keyID, key.KeyID)
+	}
+
+	return r.unwrap(ctx, key)
+}
+
+func (r *userKeyring) create(ctx context.Context, userID string) (*models.UserKey, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, fmt.Errorf("failed to generate user key ID: %v", err)
+	}
+
+	// Never from the data key cache: a user key must be unique to its user
+	dataKey, err := uncached(r.provider).GenerateDataKey(ctx, userKeyContext(userID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate user key: %v", err)
+	}
+	for i := range dataKey.Plaintext {
+		dataKey.Plaintext[i] = 0
+	}
+
+	key := &models.UserKey{
+		UserID:      userID,
+		KeyID:       userKeyIDPrefix + hex.EncodeToString(idBytes),
+		WrappedKey:  dataKey.Wrapped,
+		MasterKeyID: dataKey.KeyID,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	err = r.store.Create(ctx, key)
+	if err == ErrUserKeyExists {
+		// Lost a race with a concurrent first request, or the user was shredded
+		return r.store.Get(ctx, userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (r *userKeyring) unwrap(ctx context.Context, key *models.UserKey) (*unwrappedUserKey, error) {
+	if key.ShreddedAt != nil {
+		return nil, ErrUserKeyShredded
+	}
+
+	dataKey, err := r.provider.DecryptDataKey(ctx, key.WrappedKey, userKeyContext(key.UserID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap user key: %v", err)
+	}
+
+	return &unwrappedUserKey{userID: key.UserID, keyID: key.KeyID, plaintext: dataKey.Plaintext}, nil
+}
+
+// shred destroys the user's key
+func (r *userKeyring) shred(ctx context.Context, userID string) error {
+	if err := r.store.Shred(ctx, userID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("failed to shred user key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/awsbackend/internal/models"
+)
+
+// DynamoUserKeyStore keeps user keys in a DynamoDB table keyed by user_id
+type DynamoUserKeyStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+type userKeyRecord struct {
+	UserID      string     `dynamodbav:"user_id"`
+	KeyID       string     `dynamodbav:"key_id"`
+	WrappedKey  []byte     `dynamodbav:"wrapped_key,omitempty"`
+	MasterKeyID string     `dynamodbav:"master_key_id"`
+	CreatedAt   time.Time  `dynamodbav:"created_at"`
+	ShreddedAt  *time.Time `dynamodbav:"shredded_at,omitempty"`
+}
+
+func NewDynamoUserKeyStore() (*DynamoUserKeyStore, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	tableName := "therma-user-keys"
+	if envTable := os.Getenv("USER_KEYS_TABLE_NAME"); envTable != "" {
+		tableName = envTable
+	}
+
+	return &DynamoUserKeyStore{
+		client:    dynamodb.NewFromConfig(cfg),
+		tableName: tableName,
+	}, nil
+}
+
+// Get reads the user's key with a strongly consistent read, so a shred is
+// seen by the very next request
+func (s *DynamoUserKeyStore) Get(ctx context.Context, userID string) (*models.UserKey, error) {
+	result, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.tableName),
+		Key:            userKeyItemKey(userID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user key: %v", err)
+	}
+
+	if result.Item == nil {
+		return nil, ErrUserKeyNotFound
+	}
+
+	var record userKeyRecord
+	if err := attributevalue.UnmarshalMap(result.Item, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user key: %v", err)
+	}
+
+	return &models.UserKey{
+		UserID:      record.UserID,
+		KeyID:       record.KeyID,
+		WrappedKey:  record.WrappedKey,
+		MasterKeyID: record.MasterKeyID,
+		CreatedAt:   record.CreatedAt,
+		ShreddedAt:  record.ShreddedAt,
+	}, nil
+}
+
+// Create stores a new key unless the user already has one or was shredded
+func (s *DynamoUserKeyStore) Create(ctx context.Context, key *models.UserKey) error {
+	item, err := attributevalue.MarshalMap(userKeyRecord{
+		UserID:      key.UserID,
+		KeyID:       key.KeyID,
+		WrappedKey:  key.WrappedKey,
+		MasterKeyID: key.MasterKeyID,
+		CreatedAt:   key.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal user key: %v", err)
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(s.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(user_id)"),
+	})
+	if err != nil {
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			return ErrUserKeyExists
+		}
+		return fmt.Errorf("failed to store user key: %v", err)
+	}
+
+	return nil
+}
+
+// Shred removes the wrapped key and marks the item as shredded. The first
+// shred time is kept if the user was already shredded.
+func (s *DynamoUserKeyStore) Shred(ctx context.Context, userID string, at time.Time) error {
+	shreddedAt, err := attributevalue.Marshal(at)
+	if err != nil {
+		return fmt.Errorf("failed to marshal shred time: %v", err)
+	}
+
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.tableName),
+		Key:              userKeyItemKey(userID),
+		UpdateExpression: aws.String("SET shredded_at = if_not_exists(shredded_at, :at) REMOVE wrapped_key"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": shreddedAt,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to shred user key: %v", err)
+	}
+
+	return nil
+}
+
+func userKeyItemKey(userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"user_id": &types.AttributeValueMemberS{Value: userID},
+	}
+}
@@ -0,0 +1,108 @@
+// Package httpapi holds the request and response helpers shared by the API
+// Gateway Lambdas, so every endpoint authenticates callers and reports
+// errors the same way.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error             string `json:"error"`
+	Code              string `json:"code,omitempty"`
+	Details           string `json:"details,omitempty"`
+	MissingPermission string `json:"missing_permission,omitempty"`
+}
+
+type claimsKey struct{}
+
+// ContextWithClaims returns ctx carrying claims from Authenticate, so
+// middleware that identified the caller spares the handler doing it again
+func ContextWithClaims(ctx context.Context, claims *auth.Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// Authenticate returns the caller's claims. Requests routed through the API
+// Gateway authorizer carry the verified principal; only direct invocations
+// still present a raw token, which is validated here. Claims already in ctx
+// (see ContextWithClaims) are returned as they are.
+func Authenticate(ctx context.Context, request events.APIGatewayProxyRequest) (*auth.Claims, error) {
+	if claims, ok := ctx.Value(claimsKey{}).(*auth.Claims); ok {
+		return claims, nil
+	}
+
+	if len(request.RequestContext.Authorizer) > 0 {
+		return auth.ClaimsFromAuthorizerContext(ctx, request.RequestContext.Authorizer)
+	}
+
+	token, err := auth.BearerToken(request.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	return claims, nil
+}
+
+// JSON returns body serialized as a JSON response
+func JSON(statusCode int, body interface{}) events.APIGatewayProxyResponse {
+	responseBody, err := json.Marshal(body)
+	if err != nil {
+		return Error(500, "SERIALIZATION_ERROR", "Failed to serialize response", err.Error())
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(responseBody),
+	}
+}
+
+// Error returns an ErrorResponse
+func Error(statusCode int, code, message, details string) events.APIGatewayProxyResponse {
+	return errorJSON(statusCode, ErrorResponse{
+		Error:   message,
+		Code:    code,
+		Details: details,
+	})
+}
+
+// Forbidden is the 403 for an auth.Authorize failure, naming the permission
+// the caller lacks
+func Forbidden(err error) events.APIGatewayProxyResponse {
+	errorResp := ErrorResponse{
+		Error: "You do not have permission to perform this action",
+		Code:  "FORBIDDEN",
+	}
+
+	var permErr *auth.PermissionError
+	if errors.As(err, &permErr) {
+		errorResp.MissingPermission = string(permErr.Permission)
+	}
+
+	return errorJSON(403, errorResp)
+}
+
+func errorJSON(statusCode int, errorResp ErrorResponse) events.APIGatewayProxyResponse {
+	body, _ := json.Marshal(errorResp)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
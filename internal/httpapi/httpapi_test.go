@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+)
+
+func decodeError(t *testing.T, response events.APIGatewayProxyResponse) ErrorResponse {
+	t.Helper()
+	if response.Headers["Content-Type"] != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", response.Headers["Content-Type"])
+	}
+	var body ErrorResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("failed to decode %q: %v", response.Body, err)
+	}
+	return body
+}
+
+func TestError(t *testing.T) {
+	response := Error(404, "ENTRY_NOT_FOUND", "Journal entry not found", "")
+	if response.StatusCode != 404 {
+		t.Errorf("StatusCode = %d, want 404", response.StatusCode)
+	}
+	if body := decodeError(t, response); body != (ErrorResponse{Error: "Journal entry not found", Code: "ENTRY_NOT_FOUND"}) {
+		t.Errorf("body = %+v", body)
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	err := fmt.Errorf("delete account: %w", &auth.PermissionError{Permission: auth.PermAccountDelete})
+	response := Forbidden(err)
+	if response.StatusCode != 403 {
+		t.Errorf("StatusCode = %d, want 403", response.StatusCode)
+	}
+	if body := decodeError(t, response); body.Code != "FORBIDDEN" || body.MissingPermission != string(auth.PermAccountDelete) {
+		t.Errorf("body = %+v, want FORBIDDEN naming %s", body, auth.PermAccountDelete)
+	}
+}
+
+func TestJSONReportsUnserializableBodies(t *testing.T) {
+	response := JSON(200, map[string]interface{}{"f": func() {}})
+	if response.StatusCode != 500 {
+		t.Errorf("StatusCode = %d, want 500", response.StatusCode)
+	}
+	if body := decodeError(t, response); body.Code != "SERIALIZATION_ERROR" {
+		t.Errorf("Code = %q, want SERIALIZATION_ERROR", body.Code)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+
+	request := events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: auth.AuthorizerContext(&auth.Claims{UserID: "user-1", Roles: []string{"clinician"}}),
+		},
+	}
+	claims, err := Authenticate(ctx, request)
+	if err != nil {
+		t.Fatalf("Authenticate with an authorizer context failed: %v", err)
+	}
+	if claims.UserID != "user-1" || len(claims.Roles) != 1 || claims.Roles[0] != "clinician" {
+		t.Errorf("Authenticate = %+v, want user-1 with role clinician", claims)
+	}
+
+	for _, headers := range []map[string]string{nil, {"Authorization": "Bearer not-a-jwt"}} {
+		if claims, err := Authenticate(ctx, events.APIGatewayProxyRequest{Headers: headers}); err == nil {
+			t.Errorf("Authenticate with headers %v = %+v, want an error", headers, claims)
+		}
+	}
+
+	// Claims in the context are trusted without looking at the request
+	ctx = ContextWithClaims(ctx, &auth.Claims{UserID: "user-2"})
+	claims, err = Authenticate(ctx, events.APIGatewayProxyRequest{Headers: map[string]string{"Authorization": "Bearer not-a-jwt"}})
+	if err != nil || claims.UserID != "user-2" {
+		t.Errorf("Authenticate with claims in the context = %+v, %v; want user-2", claims, err)
+	}
+}
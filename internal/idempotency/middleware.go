@@ -0,0 +1,232 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/db"
+)
+
+// Handler is an API Gateway proxy handler, as passed to lambda.Start
+type Handler func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// KeySource says where a route reads the client's idempotency key from
+type KeySource int
+
+const (
+	// KeyFromHeader reads the Idempotency-Key header only
+	KeyFromHeader KeySource = iota
+
+	// KeyFromHeaderOrBody also accepts "idempotency_key" in a JSON body,
+	// for clients that cannot set headers
+	KeyFromHeaderOrBody
+)
+
+// RouteConfig is the idempotency behavior of one route
+type RouteConfig struct {
+	// Disabled turns idempotency off for the route
+	Disabled bool
+
+	// TTL is how long keys are remembered; zero means 24 hours
+	TTL time.Duration
+
+	KeySource KeySource
+
+	// CacheFailures replays error responses as well. Leave it off for
+	// routes whose errors a retry may fix, such as a missing share.
+	CacheFailures bool
+}
+
+// MiddlewareConfig wires a Middleware into a Lambda
+type MiddlewareConfig struct {
+	// Routes configures routes by method and API Gateway resource, e.g.
+	// "PATCH /journal-entries/{id}"
+	Routes map[string]RouteConfig
+
+	// Default applies to unsafe routes missing from Routes; nil leaves them
+	// alone
+	Default *RouteConfig
+
+	// Authenticate returns the caller keys are scoped to, and ctx carrying
+	// whatever the handler needs to not authenticate the request again.
+	// Requests it fails for go straight to the handler, which is expected
+	// to reject them.
+	Authenticate func(ctx context.Context, request events.APIGatewayProxyRequest) (context.Context, string, error)
+
+	// ErrorResponse builds the Lambda's usual error response
+	ErrorResponse func(statusCode int, code, message string) events.APIGatewayProxyResponse
+}
+
+// Middleware makes the unsafe methods of a Lambda's routes idempotent, with
+// the semantics of ProcessResponse. Safe methods are never affected.
+type Middleware struct {
+	service *IdempotencyService
+	config  MiddlewareConfig
+}
+
+func NewMiddleware(service *IdempotencyService, config MiddlewareConfig) *Middleware {
+	return &Middleware{service: service, config: config}
+}
+
+// errUncached rolls back a transaction whose response is not replayed, so
+// a retry starts from scratch
+var errUncached = errors.New("idempotent response is not cached")
+
+// Wrap returns next with idempotency applied. The response's status code,
+// headers and body are stored for replay; multi-value headers are not.
+//
+// With a transactional store, next runs in a transaction it joins through
+// db.Conn(ctx), and the stored response commits together with its writes;
+// responses that are not cached roll it back. The key itself is claimed
+// before the transaction starts, so a duplicate arriving while next runs
+// gets a 409. Once the response is stored, the key's row is locked by the
+// transaction and a duplicate waits for the commit, then replays. If the
+// transaction rolls back or fails to commit after that, the claim is
+// released, so a retry runs at once instead of getting 409s until the
+// lease lapses.
+func (m *Middleware) Wrap(next Handler) Handler {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		route, ok := m.route(request)
+		if !ok {
+			return next(ctx, request)
+		}
+
+		ctx, userID, err := m.config.Authenticate(ctx, request)
+		if err != nil {
+			return next(ctx, request)
+		}
+
+		key, err := requestKey(request, route.KeySource)
+		if err != nil {
+			return m.config.ErrorResponse(400, "INVALID_IDEMPOTENCY_KEY",
+				"Idempotency-Key must be 1-255 printable ASCII characters and match idempotency_key if both are sent"), nil
+		}
+		if key == "" && !m.service.config.BodyHashFallback {
+			return next(ctx, request)
+		}
+
+		req := Request{
+			UserID:        userID,
+			Endpoint:      endpoint(request),
+			Key:           key,
+			Body:          request.Body,
+			TTL:           route.TTL,
+			CacheFailures: route.CacheFailures,
+		}
+
+		// Errors of next itself are passed through as they are
+		var handlerErr error
+		handler := func(ctx context.Context) func() (*Response, error) {
+			return func() (*Response, error) {
+				response, err := next(ctx, request)
+				if err != nil {
+					handlerErr = err
+					return nil, err
+				}
+				return &Response{StatusCode: response.StatusCode, Headers: response.Headers, Body: response.Body}, nil
+			}
+		}
+
+		var response *Response
+		if m.service.Transactional() {
+			var txService *IdempotencyService
+			err = db.WithTx(ctx, func(tx *sql.Tx) error {
+				var err error
+				txService = m.service.WithTx(tx)
+				response, err = txService.ProcessResponse(ctx, req, handler(db.ContextWithTx(ctx, tx)))
+				if err == nil && req.failed(response) {
+					return errUncached
+				}
+				return err
+			})
+			if err != nil && txService != nil {
+				// ctx may already be done, e.g. if that is why the commit failed
+				txService.releaseTx(context.WithoutCancel(ctx))
+			}
+			if err == errUncached {
+				err = nil
+			}
+		} else {
+			response, err = m.service.ProcessResponse(ctx, req, handler(ctx))
+		}
+
+		if handlerErr != nil {
+			return events.APIGatewayProxyResponse{}, handlerErr
+		}
+		if err == ErrKeyConflict {
+			return m.config.ErrorResponse(422, "IDEMPOTENCY_KEY_CONFLICT",
+				"This Idempotency-Key was already used for a different request"), nil
+		}
+		if err == ErrResponseUnavailable {
+			return m.config.ErrorResponse(409, "IDEMPOTENT_RESPONSE_UNAVAILABLE",
+				"A request with this Idempotency-Key was already processed, but its response cannot be replayed"), nil
+		}
+		var inProgress *InProgressError
+		if errors.As(err, &inProgress) {
+			errorResponse := m.config.ErrorResponse(409, "REQUEST_IN_PROGRESS",
+				"A request with this Idempotency-Key is still being processed")
+			if errorResponse.Headers == nil {
+				errorResponse.Headers = map[string]string{}
+			}
+			errorResponse.Headers["Retry-After"] = strconv.Itoa(int(math.Ceil(inProgress.RetryAfter.Seconds())))
+			return errorResponse, nil
+		}
+		if err != nil {
+			return m.config.ErrorResponse(500, "PROCESSING_ERROR", "Failed to process request"), nil
+		}
+
+		return events.APIGatewayProxyResponse{
+			StatusCode: response.StatusCode,
+			Headers:    response.Headers,
+			Body:       response.Body,
+		}, nil
+	}
+}
+
+// route returns the configuration that applies to request, if any
+func (m *Middleware) route(request events.APIGatewayProxyRequest) (RouteConfig, bool) {
+	switch request.HTTPMethod {
+	case "POST", "PUT", "PATCH", "DELETE":
+	default:
+		return RouteConfig{}, false
+	}
+
+	route, ok := m.config.Routes[request.HTTPMethod+" "+request.Resource]
+	if !ok {
+		if m.config.Default == nil {
+			return RouteConfig{}, false
+		}
+		route = *m.config.Default
+	}
+
+	return route, !route.Disabled
+}
+
+// requestKey reads the client's key from where source says
+func requestKey(request events.APIGatewayProxyRequest, source KeySource) (string, error) {
+	var body struct {
+		IdempotencyKey string `json:"idempotency_key"`
+	}
+	if source == KeyFromHeaderOrBody {
+		// Bodies that are not JSON objects simply carry no key
+		_ = json.Unmarshal([]byte(request.Body), &body)
+	}
+
+	return RequestKey(request.Headers, body.IdempotencyKey)
+}
+
+// endpoint scopes keys to the concrete path, so one key used on two
+// entries names two requests
+func endpoint(request events.APIGatewayProxyRequest) string {
+	path := request.Path
+	if path == "" {
+		path = request.Resource
+	}
+	return request.HTTPMethod + " " + path
+}
@@ -0,0 +1,259 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/encryption"
+)
+
+type callerKey struct{}
+
+// testMiddleware wraps a counting handler in a Middleware over a memory
+// store. Callers are identified by the X-User header, and requests
+// without one fail authentication.
+func testMiddleware(t *testing.T, routes map[string]RouteConfig, next Handler) (Handler, *MemoryStore, *int) {
+	t.Helper()
+	store := NewMemoryStore()
+	encryptor := encryption.NewEncryptor(encryption.NewLocalKeyProviderFromSeed(t.Name()))
+	calls := 0
+
+	m := NewMiddleware(NewService(store, Config{Encryptor: encryptor}), MiddlewareConfig{
+		Routes: routes,
+		Authenticate: func(ctx context.Context, request events.APIGatewayProxyRequest) (context.Context, string, error) {
+			userID := request.Headers["X-User"]
+			if userID == "" {
+				return ctx, "", errors.New("no caller")
+			}
+			return context.WithValue(ctx, callerKey{}, userID), userID, nil
+		},
+		ErrorResponse: func(statusCode int, code, message string) events.APIGatewayProxyResponse {
+			return events.APIGatewayProxyResponse{StatusCode: statusCode, Body: code}
+		},
+	})
+
+	return m.Wrap(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		calls++
+		return next(ctx, request)
+	}), store, &calls
+}
+
+func created(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    map[string]string{"Content-Type": "application/json", "X-Request-Id": "r-1"},
+		Body:       request.Body,
+	}, nil
+}
+
+func request(method, resource, userID, key, body string) events.APIGatewayProxyRequest {
+	headers := map[string]string{}
+	if userID != "" {
+		headers["X-User"] = userID
+	}
+	if key != "" {
+		headers["Idempotency-Key"] = key
+	}
+	return events.APIGatewayProxyRequest{HTTPMethod: method, Resource: resource, Path: resource, Headers: headers, Body: body}
+}
+
+func TestMiddlewareReplays(t *testing.T) {
+	wrapped, _, calls := testMiddleware(t, map[string]RouteConfig{"POST /entries": {}}, created)
+	ctx := context.Background()
+
+	first, err := wrapped(ctx, request("POST", "/entries", "user-1", "key-1", `{"a":1}`))
+	if err != nil {
+		t.Fatalf("first request failed: %v", err)
+	}
+	if first.StatusCode != 201 || first.Headers[ReplayedHeader] != "" {
+		t.Fatalf("first request = %d %v, want a fresh 201", first.StatusCode, first.Headers)
+	}
+
+	replayed, err := wrapped(ctx, request("POST", "/entries", "user-1", "key-1", `{"a":1}`))
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("handler ran %d times, want 1", *calls)
+	}
+	if replayed.StatusCode != 201 || replayed.Body != first.Body || replayed.Headers["Content-Type"] != "application/json" {
+		t.Errorf("retry = %d %v %q, want the first response", replayed.StatusCode, replayed.Headers, replayed.Body)
+	}
+	if replayed.Headers[ReplayedHeader] != "true" {
+		t.Errorf("retry is missing %s: true", ReplayedHeader)
+	}
+	if _, ok := replayed.Headers["X-Request-Id"]; ok {
+		t.Error("retry replayed the per-request X-Request-Id header")
+	}
+
+	// The same key of another user names another request
+	if _, err := wrapped(ctx, request("POST", "/entries", "user-2", "key-1", `{"a":1}`)); err != nil || *calls != 2 {
+		t.Errorf("request of another user = %v after %d calls, want the handler to run", err, *calls)
+	}
+}
+
+func TestMiddlewareErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		prepare  func(t *testing.T, store *MemoryStore, s *IdempotencyService)
+		request  events.APIGatewayProxyRequest
+		want     int
+		wantCode string
+	}{
+		{"InvalidKey", nil, request("POST", "/entries", "user-1", "bad\nkey", `{}`), 400, "INVALID_IDEMPOTENCY_KEY"},
+		{"KeyConflict", func(t *testing.T, store *MemoryStore, s *IdempotencyService) {
+			claimKey(t, store, s, "user-1", "POST /entries", "key-1", `{"other":true}`, StatusCompleted)
+		}, request("POST", "/entries", "user-1", "key-1", `{}`), 422, "IDEMPOTENCY_KEY_CONFLICT"},
+		{"InProgress", func(t *testing.T, store *MemoryStore, s *IdempotencyService) {
+			claimKey(t, store, s, "user-1", "POST /entries", "key-1", `{}`, StatusPending)
+		}, request("POST", "/entries", "user-1", "key-1", `{}`), 409, "REQUEST_IN_PROGRESS"},
+		{"ResponseUnavailable", func(t *testing.T, store *MemoryStore, s *IdempotencyService) {
+			claimKey(t, store, s, "user-1", "POST /entries", "key-1", `{}`, responseUnavailable)
+		}, request("POST", "/entries", "user-1", "key-1", `{}`), 409, "IDEMPOTENT_RESPONSE_UNAVAILABLE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped, store, calls := testMiddleware(t, map[string]RouteConfig{"POST /entries": {}}, created)
+			if tt.prepare != nil {
+				tt.prepare(t, store, NewService(store, Config{}))
+			}
+
+			response, err := wrapped(context.Background(), tt.request)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if response.StatusCode != tt.want || response.Body != tt.wantCode {
+				t.Errorf("response = %d %s, want %d %s", response.StatusCode, response.Body, tt.want, tt.wantCode)
+			}
+			if *calls != 0 {
+				t.Errorf("handler ran %d times, want 0", *calls)
+			}
+			if tt.wantCode == "REQUEST_IN_PROGRESS" && response.Headers["Retry-After"] == "" {
+				t.Error("409 is missing Retry-After")
+			}
+		})
+	}
+}
+
+// claimKey records a request for key as if it had been made before: left
+// pending, completed, or completed without a response (responseUnavailable)
+func claimKey(t *testing.T, store *MemoryStore, s *IdempotencyService, userID, endpoint, clientKey, body, status string) {
+	t.Helper()
+	now := time.Now()
+	claim, _, err := store.Claim(context.Background(), ClaimRequest{
+		Key:            s.GenerateIdempotencyKey(userID, endpoint, clientKey),
+		UserID:         userID,
+		Endpoint:       endpoint,
+		RequestHash:    s.GenerateRequestHash(body),
+		Now:            now,
+		LeaseExpiresAt: now.Add(time.Minute),
+		ExpiresAt:      now.Add(time.Hour),
+	})
+	if err != nil || claim == nil {
+		t.Fatalf("Claim = %v, %v; want a claim", claim, err)
+	}
+	outcome := Outcome{Status: StatusCompleted, Response: &Response{StatusCode: 201}}
+	switch status {
+	case StatusPending:
+		return
+	case responseUnavailable:
+		outcome = Outcome{Status: StatusCompleted, Err: responseUnavailable}
+	}
+	if err := store.Complete(context.Background(), claim, outcome); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+}
+
+func TestMiddlewarePassesThrough(t *testing.T) {
+	routes := map[string]RouteConfig{"POST /entries": {}, "DELETE /entries/{id}": {Disabled: true}}
+
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+	}{
+		{"SafeMethod", request("GET", "/entries", "user-1", "key-1", "")},
+		{"UnconfiguredRoute", request("PATCH", "/entries/{id}", "user-1", "key-1", `{}`)},
+		{"DisabledRoute", request("DELETE", "/entries/{id}", "user-1", "key-1", "")},
+		{"Unauthenticated", request("POST", "/entries", "", "key-1", `{}`)},
+		{"NoKey", request("POST", "/entries", "user-1", "", `{}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped, _, calls := testMiddleware(t, routes, created)
+			for i := 0; i < 2; i++ {
+				response, err := wrapped(context.Background(), tt.request)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				if response.Headers[ReplayedHeader] != "" {
+					t.Errorf("request %d was replayed", i+1)
+				}
+			}
+			if *calls != 2 {
+				t.Errorf("handler ran %d times, want 2", *calls)
+			}
+		})
+	}
+}
+
+// TestMiddlewareAuthenticatesOnce checks that the handler gets the context
+// Authenticate returned, so it need not authenticate the request again
+func TestMiddlewareAuthenticatesOnce(t *testing.T) {
+	var caller interface{}
+	wrapped, _, _ := testMiddleware(t, map[string]RouteConfig{"POST /entries": {}}, func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		caller = ctx.Value(callerKey{})
+		return created(ctx, request)
+	})
+
+	if _, err := wrapped(context.Background(), request("POST", "/entries", "user-1", "key-1", `{}`)); err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if caller != "user-1" {
+		t.Errorf("handler saw caller %v, want user-1 from Authenticate", caller)
+	}
+}
+
+func TestMiddlewareRetriesFailures(t *testing.T) {
+	status := 500
+	wrapped, _, calls := testMiddleware(t, map[string]RouteConfig{"POST /entries": {}}, func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		body, _ := json.Marshal(map[string]int{"status": status})
+		return events.APIGatewayProxyResponse{StatusCode: status, Body: string(body)}, nil
+	})
+	ctx := context.Background()
+
+	for i, want := range []int{500, 200, 200} {
+		if i == 1 {
+			status = 200
+		}
+		response, err := wrapped(ctx, request("POST", "/entries", "user-1", "key-1", `{}`))
+		if err != nil {
+			t.Fatalf("request %d failed: %v", i+1, err)
+		}
+		if response.StatusCode != want {
+			t.Errorf("request %d = %d, want %d", i+1, response.StatusCode, want)
+		}
+	}
+	if *calls != 2 {
+		t.Errorf("handler ran %d times, want 2: once failing, once succeeding", *calls)
+	}
+
+	handlerErr := fmt.Errorf("boom")
+	wrapped, _, calls = testMiddleware(t, map[string]RouteConfig{"POST /entries": {}}, func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{}, handlerErr
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := wrapped(ctx, request("POST", "/entries", "user-1", "key-1", `{}`)); err != handlerErr {
+			t.Errorf("request %d = %v, want the handler's error", i+1, err)
+		}
+	}
+	if *calls != 2 {
+		t.Errorf("failing handler ran %d times, want 2", *calls)
+	}
+}
@@ -0,0 +1,212 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/awsbackend/internal/encryption"
+)
+
+const (
+	// recordTTL is how long a key is remembered
+	recordTTL = 24 * time.Hour
+
+	// DefaultLease is how long a claim is held when the context has no
+	// deadline. A Lambda's context ends at its timeout, so there the lease
+	// is the remaining time plus leaseMargin.
+	DefaultLease = time.Minute
+	leaseMargin  = 5 * time.Second
+)
+
+// ReplayedHeader marks a response replayed from the idempotency store
+const ReplayedHeader = "Idempotent-Replayed"
+
+// replayedHeaders are the response headers stored for replay. Others, such
+// as per-request IDs, describe the original request only.
+var replayedHeaders = []string{
+	"Content-Type",
+	"Content-Language",
+	"Location",
+	"ETag",
+	"Last-Modified",
+	"Cache-Control",
+}
+
+// Request identifies an idempotent request
+type Request struct {
+	UserID   string
+	Endpoint string // e.g. "POST /journal-entries"
+	Key      string // From RequestKey; may be empty
+	Body     string
+
+	TTL           time.Duration // How long the key is remembered; zero means 24 hours
+	CacheFailures bool          // Replay error responses too; see ProcessResponse
+}
+
+// Response is an HTTP response as stored and replayed
+type Response struct {
+	StatusCode int
+	Headers    map[string]string
+	Body       string
+}
+
+// ProcessResponse runs handler at most once per idempotency key. Without a
+// key the handler simply runs, unless the body-hash fallback is enabled.
+//
+// A retry with the same key and body gets the stored response: the same
+// status, stored headers and body bytes, plus Idempotent-Replayed: true.
+// The same key with a different body gets ErrKeyConflict, and a retry while
+// the first request is still running an *InProgressError. A retry of a
+// request whose response could not be stored gets ErrResponseUnavailable. Error responses
+// (4xx and 5xx) are not replayed unless req.CacheFailures is set, and
+// handler errors never are: they are recorded as failed, and a retry runs
+// the handler again. If a request dies
+// mid-handler, its claim lapses with the Lambda's timeout and the next
+// retry takes over.
+//
+// Bodies may carry PHI, so they are stored sealed by Config.Encryptor,
+// bound to the user and key; without one, keyed requests fail.
+func (s *IdempotencyService) ProcessResponse(ctx context.Context, req Request, handler func() (*Response, error)) (*Response, error) {
+	var key string
+	switch {
+	case req.Key != "":
+		key = s.GenerateIdempotencyKey(req.UserID, req.Endpoint, req.Key)
+	case s.config.BodyHashFallback:
+		key = s.GenerateBodyHashKey(req.UserID, req.Endpoint, req.Body)
+	default:
+		return handler()
+	}
+	if s.config.Encryptor == nil {
+		return nil, ErrNoEncryptor
+	}
+	requestHash := s.GenerateRequestHash(req.Body)
+	binding := responseBinding(req.UserID, key)
+
+	now := time.Now()
+	claim, existingRecord, err := s.store.Claim(ctx, ClaimRequest{
+		Key:            key,
+		UserID:         req.UserID,
+		Endpoint:       req.Endpoint,
+		RequestHash:    requestHash,
+		Now:            now,
+		LeaseExpiresAt: now.Add(leaseFor(ctx, now)),
+		ExpiresAt:      now.Add(req.ttl()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if existingRecord != nil {
+		return s.replay(ctx, binding, existingRecord)
+	}
+
+	response, err := handler()
+	if err != nil {
+		// A failed attempt can be retried with the same key
+		if completeErr := s.store.Complete(ctx, claim, Outcome{Status: StatusFailed, Err: err.Error()}); completeErr != nil {
+			log.Printf("Warning: failed to record failed idempotent request: %v", completeErr)
+		}
+		return nil, err
+	}
+
+	status := StatusCompleted
+	if req.failed(response) {
+		status = StatusFailed
+	}
+
+	// The handler has run either way, so a lost lease or failed update is
+	// logged rather than failing the request. A body that cannot be sealed
+	// is not stored. The request still counts as completed, since running
+	// it again would repeat its side effects; retries get
+	// ErrResponseUnavailable instead of a replay.
+	outcome := Outcome{Status: status}
+	sealed, err := s.config.Encryptor.EncryptPHI(ctx, binding, response.Body)
+	if err != nil {
+		log.Printf("Warning: failed to seal idempotent response: %v", err)
+		outcome.Err = responseUnavailable
+	} else {
+		outcome.Response = &Response{StatusCode: response.StatusCode, Headers: storedHeaders(response.Headers), Body: sealed}
+	}
+	if err := s.store.Complete(ctx, claim, outcome); err != nil {
+		log.Printf("Warning: failed to update idempotency record: %v", err)
+	}
+
+	return response, nil
+}
+
+// failed reports whether response is recorded as a failure rather than
+// replayed
+func (req Request) failed(response *Response) bool {
+	return response.StatusCode >= 400 && !req.CacheFailures
+}
+
+func (req Request) ttl() time.Duration {
+	if req.TTL > 0 {
+		return req.TTL
+	}
+	return recordTTL
+}
+
+// responseBinding binds a stored response to its user and key, so it
+// cannot be replayed to anyone else and is shredded with the user's key
+func responseBinding(userID, key string) encryption.Binding {
+	return encryption.Binding{UserID: userID, RecordID: key, Field: "idempotent_response"}
+}
+
+// responseUnavailable is the error recorded for a completed request whose
+// response could not be sealed
+const responseUnavailable = "failed to seal response"
+
+// replay rebuilds the stored response of a completed request
+func (s *IdempotencyService) replay(ctx context.Context, binding encryption.Binding, record *IdempotencyRecord) (*Response, error) {
+	if record.Error == responseUnavailable {
+		return nil, ErrResponseUnavailable
+	}
+
+	body, err := s.config.Encryptor.DecryptPHI(ctx, binding, record.Response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stored response: %v", err)
+	}
+
+	headers := map[string]string{}
+	for name, value := range record.ResponseHeaders {
+		headers[name] = value
+	}
+	headers[ReplayedHeader] = "true"
+
+	statusCode := record.ResponseStatus
+	if statusCode == 0 {
+		// Records written before responses were stored hold only a JSON
+		// body; they expire within a day of the upgrade
+		statusCode = http.StatusOK
+		headers["Content-Type"] = "application/json"
+	}
+
+	return &Response{StatusCode: statusCode, Headers: headers, Body: body}, nil
+}
+
+// leaseFor returns how long to hold a claim: until the context's deadline,
+// when the Lambda would be stopped, plus a margin
+func leaseFor(ctx context.Context, now time.Time) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok && deadline.After(now) {
+		return deadline.Sub(now) + leaseMargin
+	}
+	return DefaultLease
+}
+
+// storedHeaders picks the replayedHeaders out of headers, matching names
+// case-insensitively
+func storedHeaders(headers map[string]string) map[string]string {
+	stored := map[string]string{}
+	for name, value := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		for _, replayed := range replayedHeaders {
+			if canonical == http.CanonicalHeaderKey(replayed) {
+				stored[replayed] = value
+			}
+		}
+	}
+	return stored
+}
@@ -0,0 +1,120 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awsbackend/internal/encryption"
+)
+
+func TestStoredResponsesAreSealed(t *testing.T) {
+	store := NewMemoryStore()
+	encryptor := encryption.NewEncryptor(encryption.NewLocalKeyProviderFromSeed(t.Name()))
+	s := NewService(store, Config{Encryptor: encryptor})
+	ctx := context.Background()
+	req := Request{UserID: "user-1", Endpoint: "POST /journal-entries", Key: "key-1", Body: `{"content":"dear diary"}`}
+
+	calls := 0
+	handler := func() (*Response, error) {
+		calls++
+		return &Response{StatusCode: 201, Headers: map[string]string{"Content-Type": "application/json"}, Body: `{"content":"dear diary"}`}, nil
+	}
+
+	first, err := s.ProcessResponse(ctx, req, handler)
+	if err != nil {
+		t.Fatalf("ProcessResponse failed: %v", err)
+	}
+
+	key := s.GenerateIdempotencyKey(req.UserID, req.Endpoint, req.Key)
+	now := time.Now()
+	_, record, err := store.Claim(ctx, ClaimRequest{Key: key, UserID: req.UserID, Endpoint: req.Endpoint, RequestHash: s.GenerateRequestHash(req.Body), Now: now, LeaseExpiresAt: now.Add(time.Minute), ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+	if record == nil {
+		t.Fatal("Claim of a completed key returned no record")
+	}
+	if strings.Contains(record.Response, "dear diary") {
+		t.Errorf("stored response %q contains the plaintext body", record.Response)
+	}
+
+	replayed, err := s.ProcessResponse(ctx, req, handler)
+	if err != nil {
+		t.Fatalf("ProcessResponse of a retry failed: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+	if replayed.Body != first.Body || replayed.StatusCode != first.StatusCode {
+		t.Errorf("replay = %d %q, want %d %q", replayed.StatusCode, replayed.Body, first.StatusCode, first.Body)
+	}
+
+	// The sealed body opens only for the user and key it was stored under
+	if _, err := encryptor.DecryptPHI(ctx, responseBinding("user-2", key), record.Response); err == nil {
+		t.Error("stored response opened for another user")
+	}
+}
+
+func TestProcessResponseRequiresEncryptor(t *testing.T) {
+	s := NewService(NewMemoryStore(), Config{})
+	ran := false
+	handler := func() (*Response, error) {
+		ran = true
+		return &Response{StatusCode: 200}, nil
+	}
+
+	_, err := s.ProcessResponse(context.Background(), Request{UserID: "user-1", Endpoint: "POST /x", Key: "k", Body: "{}"}, handler)
+	if !errors.Is(err, ErrNoEncryptor) {
+		t.Errorf("ProcessResponse without an encryptor = %v, want ErrNoEncryptor", err)
+	}
+	if ran {
+		t.Error("handler ran without an encryptor to seal its response")
+	}
+
+	// Requests without a key are not stored, so they need no encryptor
+	if _, err := s.ProcessResponse(context.Background(), Request{UserID: "user-1", Endpoint: "POST /x", Body: "{}"}, handler); err != nil || !ran {
+		t.Errorf("ProcessResponse without a key = %v, ran %v; want the handler to run", err, ran)
+	}
+}
+
+// sealFailingEncryptor cannot seal, as when KMS is unavailable
+type sealFailingEncryptor struct {
+	encryption.Encryptor
+}
+
+func (sealFailingEncryptor) EncryptPHI(ctx context.Context, b encryption.Binding, plaintext string) (string, error) {
+	return "", errors.New("kms unavailable")
+}
+
+// TestUnsealableResponseIsNotRerun checks that a request whose response
+// could not be stored is not run again by a retry, which would repeat its
+// side effects
+func TestUnsealableResponseIsNotRerun(t *testing.T) {
+	encryptor := sealFailingEncryptor{encryption.NewEncryptor(encryption.NewLocalKeyProviderFromSeed(t.Name()))}
+	s := NewService(NewMemoryStore(), Config{Encryptor: encryptor})
+	ctx := context.Background()
+	req := Request{UserID: "user-1", Endpoint: "POST /journal-entries", Key: "key-1", Body: `{}`}
+
+	calls := 0
+	handler := func() (*Response, error) {
+		calls++
+		return &Response{StatusCode: 201, Body: `{"id":"entry-1"}`}, nil
+	}
+
+	response, err := s.ProcessResponse(ctx, req, handler)
+	if err != nil || response.StatusCode != 201 {
+		t.Fatalf("ProcessResponse = %v, %v; want the handler's 201", response, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.ProcessResponse(ctx, req, handler); !errors.Is(err, ErrResponseUnavailable) {
+			t.Errorf("retry %d = %v, want ErrResponseUnavailable", i+1, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+}
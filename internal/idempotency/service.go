@@ -5,244 +5,216 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
 )
 
+// HeaderName is the request header clients send their idempotency key in
+const HeaderName = "Idempotency-Key"
+
+// maxKeyLength bounds client-supplied keys; UUIDs and ULIDs fit easily
+const maxKeyLength = 255
+
+var (
+	// ErrKeyConflict is returned when a key is reused for a different request
+	ErrKeyConflict = errors.New("idempotency key was already used for a different request")
+
+	// ErrInvalidKey is returned for keys that are empty after trimming, too
+	// long or not printable ASCII, and when the header and body disagree
+	ErrInvalidKey = errors.New("invalid idempotency key")
+
+	// ErrNoEncryptor is returned for keyed requests to a service without
+	// Config.Encryptor, which would store response bodies in plaintext
+	ErrNoEncryptor = errors.New("idempotency service has no encryptor for stored responses")
+
+	// ErrResponseUnavailable is returned for a retry of a request that
+	// completed but whose response could not be stored. The handler is not
+	// run again, as its side effects have already happened.
+	ErrResponseUnavailable = errors.New("idempotent request completed but its response is unavailable")
+)
+
+// IdempotencyService runs requests at most once per idempotency key; see
+// ProcessResponse
 type IdempotencyService struct {
-	client    *dynamodb.Client
-	tableName string
+	store  Store
+	config Config
 }
 
+// Config tunes an IdempotencyService
+type Config struct {
+	// BodyHashFallback derives a key from the request body when the client
+	// sends none. Identical bodies are then treated as retries, so two
+	// entries a user writes with the same text collapse into one.
+	BodyHashFallback bool
+
+	// Encryptor seals stored response bodies, which may carry PHI
+	Encryptor encryption.Encryptor
+}
+
+// IdempotencyRecord is a key's stored state. The dynamodbav names are the
+// attributes of the DynamoDB table; other stores keep the same fields.
 type IdempotencyRecord struct {
 	Key         string    `dynamodbav:"key"`
 	UserID      string    `dynamodbav:"user_id"`
+	Endpoint    string    `dynamodbav:"endpoint"`
 	RequestHash string    `dynamodbav:"request_hash"`
-	Response    string    `dynamodbav:"response"`
+	Response    string    `dynamodbav:"response"` // Response body, sealed by Config.Encryptor
 	Status      string    `dynamodbav:"status"`
 	CreatedAt   time.Time `dynamodbav:"created_at"`
 	ExpiresAt   time.Time `dynamodbav:"expires_at"`
-	TTL         int64     `dynamodbav:"ttl"`
-}
-
-func NewIdempotencyService() (*IdempotencyService, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %v", err)
-	}
-
-	tableName := "therma-idempotency"
-	if envTable := os.Getenv("IDEMPOTENCY_TABLE_NAME"); envTable != "" {
-		tableName = envTable
-	}
+	TTL         int64     `dynamodbav:"ttl"` // ExpiresAt in Unix seconds
 
-	client := dynamodb.NewFromConfig(cfg)
-	return &IdempotencyService{
-		client:    client,
-		tableName: tableName,
-	}, nil
-}
+	ResponseStatus  int               `dynamodbav:"response_status,omitempty"`
+	ResponseHeaders map[string]string `dynamodbav:"response_headers,omitempty"` // Only replayedHeaders
+	Error           string            `dynamodbav:"error,omitempty"`            // Why a failed attempt failed, or a completed one has no response
 
-// GenerateIdempotencyKey creates a unique key for the request
-func (s *IdempotencyService) GenerateIdempotencyKey(userID, endpoint, requestBody string) string {
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%s", userID, endpoint, requestBody)))
-	return hex.EncodeToString(hash[:])
+	LeaseExpiresAt int64 `dynamodbav:"lease_expires_at"` // Unix milliseconds; while pending, the claim lapses then
+	FencingToken   int64 `dynamodbav:"fencing_token"`    // Incremented by every claim
 }
 
-// GenerateRequestHash creates a hash of the request for comparison
-func (s *IdempotencyService) GenerateRequestHash(requestBody string) string {
-	hash := sha256.Sum256([]byte(requestBody))
-	return hex.EncodeToString(hash[:])
+func NewService(store Store, config Config) *IdempotencyService {
+	return &IdempotencyService{store: store, config: config}
 }
 
-// CheckIdempotency checks if a request with the same idempotency key already exists
-func (s *IdempotencyService) CheckIdempotency(ctx context.Context, key string) (*IdempotencyRecord, error) {
-	input := &dynamodb.GetItemInput{
-		TableName: aws.String(s.tableName),
-		Key: map[string]types.AttributeValue{
-			"key": &types.AttributeValueMemberS{Value: key},
-		},
-	}
-
-	result, err := s.client.GetItem(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check idempotency: %v", err)
-	}
-
-	if result.Item == nil {
-		return nil, nil // No existing record
-	}
-
-	var record IdempotencyRecord
-	err = attributevalue.UnmarshalMap(result.Item, &record)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal idempotency record: %v", err)
+// NewIdempotencyService configures a service that seals stored responses
+// with encryptor from the environment: IDEMPOTENCY_STORE selects
+// "dynamodb" (the default), "postgres" (db.DB, which must be initialized
+// first) or "memory", and IDEMPOTENCY_BODY_HASH_FALLBACK=true enables
+// Config.BodyHashFallback.
+func NewIdempotencyService(encryptor encryption.Encryptor) (*IdempotencyService, error) {
+	var store Store
+	switch backend := os.Getenv("IDEMPOTENCY_STORE"); backend {
+	case "", "dynamodb":
+		dynamoStore, err := NewDynamoStore()
+		if err != nil {
+			return nil, err
+		}
+		store = dynamoStore
+	case "postgres":
+		if db.DB == nil {
+			return nil, fmt.Errorf("IDEMPOTENCY_STORE=postgres requires the database to be initialized")
+		}
+		store = NewPostgresStore(db.DB)
+	case "memory":
+		store = NewMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown IDEMPOTENCY_STORE %q", backend)
 	}
 
-	// Check if record has expired
-	if time.Now().After(record.ExpiresAt) {
-		// Record expired, delete it
-		s.DeleteIdempotencyRecord(ctx, key)
-		return nil, nil
+	config := Config{Encryptor: encryptor}
+	if raw := os.Getenv("IDEMPOTENCY_BODY_HASH_FALLBACK"); raw != "" {
+		config.BodyHashFallback = raw == "true" || raw == "1"
 	}
 
-	return &record, nil
+	return NewService(store, config), nil
 }
 
-// StoreIdempotencyRecord stores a new idempotency record
-func (s *IdempotencyService) StoreIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error {
-	// Set TTL for automatic cleanup (24 hours from now)
-	record.TTL = time.Now().Add(24 * time.Hour).Unix()
-
-	item, err := attributevalue.MarshalMap(record)
-	if err != nil {
-		return fmt.Errorf("failed to marshal idempotency record: %v", err)
-	}
-
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(s.tableName),
-		Item:      item,
-		ConditionExpression: aws.String("attribute_not_exists(#key)"),
-		ExpressionAttributeNames: map[string]string{
-			"#key": "key",
-		},
-	}
-
-	_, err = s.client.PutItem(ctx, input)
-	if err != nil {
-		// Check if it's a conditional check failed error (record already exists)
-		if _, ok := err.(*types.ConditionalCheckFailedException); ok {
-			return fmt.Errorf("idempotency key already exists")
-		}
-		return fmt.Errorf("failed to store idempotency record: %v", err)
-	}
-
-	return nil
+// Transactional reports whether the store can join a database transaction
+// through WithTx
+func (s *IdempotencyService) Transactional() bool {
+	_, ok := s.store.(TxStore)
+	return ok
 }
 
-// UpdateIdempotencyRecord updates an existing idempotency record with response
-func (s *IdempotencyService) UpdateIdempotencyRecord(ctx context.Context, key, response, status string) error {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(s.tableName),
-		Key: map[string]types.AttributeValue{
-			"key": &types.AttributeValueMemberS{Value: key},
-		},
-		UpdateExpression: aws.String("SET #response = :response, #status = :status, #updated_at = :updated_at"),
-		ExpressionAttributeNames: map[string]string{
-			"#response":    "response",
-			"#status":      "status",
-			"#updated_at":  "updated_at",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":response":   &types.AttributeValueMemberS{Value: response},
-			":status":     &types.AttributeValueMemberS{Value: status},
-			":updated_at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
-		},
-	}
-
-	_, err := s.client.UpdateItem(ctx, input)
-	if err != nil {
-		return fmt.Errorf("failed to update idempotency record: %v", err)
+// WithTx returns a service whose store completes keys inside tx, so the
+// stored response commits together with the handler's writes. Services
+// whose store is not a TxStore are returned unchanged.
+func (s *IdempotencyService) WithTx(tx db.DBTX) *IdempotencyService {
+	txStore, ok := s.store.(TxStore)
+	if !ok {
+		return s
 	}
+	return NewService(txStore.WithTx(tx), s.config)
+}
 
-	return nil
+// releaser is a store from TxStore.WithTx that can release the claim it
+// completed inside its transaction; see PostgresStore.Release
+type releaser interface {
+	Release(ctx context.Context) error
 }
 
-// DeleteIdempotencyRecord deletes an idempotency record
-func (s *IdempotencyService) DeleteIdempotencyRecord(ctx context.Context, key string) error {
-	input := &dynamodb.DeleteItemInput{
-		TableName: aws.String(s.tableName),
-		Key: map[string]types.AttributeValue{
-			"key": &types.AttributeValueMemberS{Value: key},
-		},
+// releaseTx releases the claim a WithTx service completed inside its
+// transaction, after that transaction rolled back
+func (s *IdempotencyService) releaseTx(ctx context.Context) {
+	r, ok := s.store.(releaser)
+	if !ok {
+		return
 	}
-
-	_, err := s.client.DeleteItem(ctx, input)
-	if err != nil {
-		return fmt.Errorf("failed to delete idempotency record: %v", err)
+	if err := r.Release(ctx); err != nil {
+		log.Printf("Warning: failed to release idempotency key: %v", err)
 	}
-
-	return nil
 }
 
-// ProcessIdempotentRequest handles the complete idempotency flow
-func (s *IdempotencyService) ProcessIdempotentRequest(
-	ctx context.Context,
-	userID, endpoint, requestBody string,
-	handler func() (interface{}, error),
-) (interface{}, error) {
-	// Generate idempotency key and request hash
-	key := s.GenerateIdempotencyKey(userID, endpoint, requestBody)
-	requestHash := s.GenerateRequestHash(requestBody)
-
-	// Check if request already exists
-	existingRecord, err := s.CheckIdempotency(ctx, key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check idempotency: %v", err)
-	}
-
-	// If record exists and request hash matches, return cached response
-	if existingRecord != nil && existingRecord.RequestHash == requestHash {
-		if existingRecord.Status == "completed" {
-			var response interface{}
-			err := json.Unmarshal([]byte(existingRecord.Response), &response)
-			if err != nil {
-				return nil, fmt.Errorf("failed to unmarshal cached response: %v", err)
-			}
-			return response, nil
-		} else if existingRecord.Status == "pending" {
-			return nil, fmt.Errorf("request is already being processed")
+// RequestKey returns the client's idempotency key from the Idempotency-Key
+// header (matched case-insensitively) or, for clients that cannot set
+// headers, a key from the request body. It returns "" if there is neither,
+// and ErrInvalidKey if the key is malformed or the two disagree.
+func RequestKey(headers map[string]string, bodyKey string) (string, error) {
+	var headerKey string
+	for name, value := range headers {
+		if strings.EqualFold(name, HeaderName) {
+			headerKey = strings.TrimSpace(value)
+			break
 		}
 	}
+	bodyKey = strings.TrimSpace(bodyKey)
 
-	// If record exists but request hash doesn't match, it's a duplicate key with different content
-	if existingRecord != nil && existingRecord.RequestHash != requestHash {
-		return nil, fmt.Errorf("idempotency key conflict: same key used for different request")
+	key := headerKey
+	if key == "" {
+		key = bodyKey
+	} else if bodyKey != "" && bodyKey != headerKey {
+		return "", ErrInvalidKey
 	}
-
-	// Create new idempotency record
-	record := &IdempotencyRecord{
-		Key:         key,
-		UserID:      userID,
-		RequestHash: requestHash,
-		Status:      "pending",
-		CreatedAt:   time.Now(),
-		ExpiresAt:   time.Now().Add(24 * time.Hour),
+	if key == "" {
+		return "", nil
 	}
 
-	err = s.StoreIdempotencyRecord(ctx, record)
-	if err != nil {
-		return nil, fmt.Errorf("failed to store idempotency record: %v", err)
+	if len(key) > maxKeyLength {
+		return "", ErrInvalidKey
 	}
-
-	// Execute the actual handler
-	response, err := handler()
-	if err != nil {
-		// Update record with error status
-		s.UpdateIdempotencyRecord(ctx, key, fmt.Sprintf("error: %v", err), "failed")
-		return nil, err
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return "", ErrInvalidKey
+		}
 	}
 
-	// Marshal response for storage
-	responseJSON, err := json.Marshal(response)
-	if err != nil {
-		s.UpdateIdempotencyRecord(ctx, key, "error: failed to marshal response", "failed")
-		return nil, fmt.Errorf("failed to marshal response: %v", err)
-	}
+	return key, nil
+}
+
+// GenerateIdempotencyKey scopes a client's key to the user and endpoint, so
+// keys only need to be unique per client
+func (s *IdempotencyService) GenerateIdempotencyKey(userID, endpoint, clientKey string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("key:%s:%s:%s", userID, endpoint, clientKey)))
+	return hex.EncodeToString(hash[:])
+}
+
+// GenerateBodyHashKey derives a key from the request itself, for clients
+// that send none; see Config.BodyHashFallback
+func (s *IdempotencyService) GenerateBodyHashKey(userID, endpoint, requestBody string) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("body:%s:%s:%s", userID, endpoint, s.GenerateRequestHash(requestBody))))
+	return hex.EncodeToString(hash[:])
+}
 
-	// Update record with successful response
-	err = s.UpdateIdempotencyRecord(ctx, key, string(responseJSON), "completed")
-	if err != nil {
-		// Log error but don't fail the request
-		fmt.Printf("Warning: failed to update idempotency record: %v\n", err)
+// GenerateRequestHash fingerprints a request body to detect a key reused
+// for a different request. JSON bodies are hashed in canonical form, so a
+// retry that serializes the same object with its fields in another order
+// still matches.
+func (s *IdempotencyService) GenerateRequestHash(requestBody string) string {
+	canonical := []byte(requestBody)
+	var body interface{}
+	if err := json.Unmarshal(canonical, &body); err == nil {
+		if encoded, err := json.Marshal(body); err == nil {
+			canonical = encoded
+		}
 	}
 
-	return response, nil
+	hash := sha256.Sum256(canonical)
+	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,157 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClaimable(t *testing.T) {
+	now := time.Now()
+	req := ClaimRequest{Key: "k", RequestHash: "hash-1", Now: now}
+	record := func(status string, leaseExpiresAt time.Time) *IdempotencyRecord {
+		r := &IdempotencyRecord{Key: "k", RequestHash: "hash-1", Status: status, TTL: now.Add(time.Hour).Unix()}
+		if !leaseExpiresAt.IsZero() {
+			r.LeaseExpiresAt = leaseExpiresAt.UnixMilli()
+		}
+		return r
+	}
+	expired := record(StatusCompleted, time.Time{})
+	expired.TTL = now.Add(-time.Second).Unix()
+	otherHash := record(StatusFailed, time.Time{})
+	otherHash.RequestHash = "hash-2"
+
+	tests := []struct {
+		name   string
+		record *IdempotencyRecord
+		want   bool
+	}{
+		{"LiveLease", record(StatusPending, now.Add(time.Second)), false},
+		{"LapsedLease", record(StatusPending, now.Add(-time.Millisecond)), true},
+		{"PendingWithoutLease", record(StatusPending, time.Time{}), true},
+		{"Failed", record(StatusFailed, time.Time{}), true},
+		{"Completed", record(StatusCompleted, time.Time{}), false},
+		{"Expired", expired, true},
+		{"FailedWithOtherHash", otherHash, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claimable(tt.record, req); got != tt.want {
+				t.Errorf("claimable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlockedBy(t *testing.T) {
+	now := time.Now()
+	req := ClaimRequest{Key: "k", RequestHash: "hash-1", Now: now}
+
+	completed := &IdempotencyRecord{RequestHash: "hash-1", Status: StatusCompleted, Response: "{}"}
+	if replay, err := blockedBy(completed, req); err != nil || replay != completed {
+		t.Errorf("blockedBy(completed) = %v, %v; want the record for replay", replay, err)
+	}
+
+	conflicting := &IdempotencyRecord{RequestHash: "hash-2", Status: StatusCompleted}
+	if _, err := blockedBy(conflicting, req); err != ErrKeyConflict {
+		t.Errorf("blockedBy(other hash) = %v, want ErrKeyConflict", err)
+	}
+
+	tests := []struct {
+		name        string
+		leaseLeft   time.Duration
+		wantRetryIn time.Duration
+	}{
+		{"RestOfLease", 20 * time.Second, 20 * time.Second},
+		{"AtLeastOneSecond", 100 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending := &IdempotencyRecord{RequestHash: "hash-1", Status: StatusPending, LeaseExpiresAt: now.Add(tt.leaseLeft).UnixMilli()}
+			_, err := blockedBy(pending, req)
+			var inProgress *InProgressError
+			if !errors.As(err, &inProgress) {
+				t.Fatalf("blockedBy(pending) = %v, want *InProgressError", err)
+			}
+			if diff := inProgress.RetryAfter - tt.wantRetryIn; diff < -time.Millisecond || diff > time.Millisecond {
+				t.Errorf("RetryAfter = %s, want %s", inProgress.RetryAfter, tt.wantRetryIn)
+			}
+		})
+	}
+}
+
+func TestLeaseFor(t *testing.T) {
+	now := time.Now()
+	if got := leaseFor(context.Background(), now); got != DefaultLease {
+		t.Errorf("leaseFor without deadline = %s, want %s", got, DefaultLease)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(10*time.Second))
+	defer cancel()
+	if got := leaseFor(ctx, now); got != 10*time.Second+leaseMargin {
+		t.Errorf("leaseFor with deadline = %s, want the remaining time plus %s", got, leaseMargin)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		bodyKey string
+		want    string
+		wantErr bool
+	}{
+		{"Header", map[string]string{"Idempotency-Key": "abc"}, "", "abc", false},
+		{"HeaderCaseInsensitive", map[string]string{"idempotency-key": " abc "}, "", "abc", false},
+		{"Body", nil, "abc", "abc", false},
+		{"HeaderAndBodyAgree", map[string]string{"Idempotency-Key": "abc"}, "abc", "abc", false},
+		{"HeaderAndBodyDisagree", map[string]string{"Idempotency-Key": "abc"}, "def", "", true},
+		{"None", map[string]string{"Content-Type": "application/json"}, "", "", false},
+		{"TooLong", map[string]string{"Idempotency-Key": string(make([]byte, maxKeyLength+1))}, "", "", true},
+		{"NotPrintable", map[string]string{"Idempotency-Key": "a b"}, "", "", true},
+		{"NotASCII", nil, "clé", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RequestKey(tt.headers, tt.bodyKey)
+			if tt.wantErr {
+				if err != ErrInvalidKey {
+					t.Errorf("RequestKey = %q, %v; want ErrInvalidKey", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("RequestKey = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeneratedKeysAreScoped(t *testing.T) {
+	s := NewService(NewMemoryStore(), Config{})
+
+	key := s.GenerateIdempotencyKey("user-1", "POST /journal-entries", "abc")
+	for _, other := range []string{
+		s.GenerateIdempotencyKey("user-2", "POST /journal-entries", "abc"),
+		s.GenerateIdempotencyKey("user-1", "PATCH /journal-entries/1", "abc"),
+		s.GenerateIdempotencyKey("user-1", "POST /journal-entries", "abd"),
+		s.GenerateBodyHashKey("user-1", "POST /journal-entries", "abc"),
+	} {
+		if other == key {
+			t.Errorf("key %q is shared with another user, endpoint or client key", key)
+		}
+	}
+
+	if a, b := s.GenerateRequestHash(`{"mood":"calm","content":"x"}`), s.GenerateRequestHash(`{ "content": "x", "mood": "calm" }`); a != b {
+		t.Error("GenerateRequestHash differs for the same JSON object in another field order")
+	}
+	if a, b := s.GenerateRequestHash(`{"content":"x"}`), s.GenerateRequestHash(`{"content":"y"}`); a == b {
+		t.Error("GenerateRequestHash is the same for different bodies")
+	}
+	if a, b := s.GenerateRequestHash("not json"), s.GenerateRequestHash("not json "); a == b {
+		t.Error("GenerateRequestHash ignored a difference in a non-JSON body")
+	}
+}
@@ -0,0 +1,108 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// ErrLeaseLost is returned when completing a claim that another request
+// took over after the lease lapsed
+var ErrLeaseLost = errors.New("idempotency lease was taken over by another request")
+
+// InProgressError is returned while another request holds the claim on a
+// key. RetryAfter is when its lease lapses.
+type InProgressError struct {
+	RetryAfter time.Duration
+}
+
+func (e *InProgressError) Error() string {
+	return fmt.Sprintf("a request with this idempotency key is already being processed; retry after %s", e.RetryAfter)
+}
+
+// Store keeps idempotency records. Implementations must pass the
+// conformance suite in idempotency/storetest.
+type Store interface {
+	// Claim takes req.Key for a request in one atomic step. It succeeds if
+	// the key is new or expired, or if an earlier attempt at the same
+	// request failed or let its lease lapse. Otherwise the existing record
+	// decides: a completed record with the same request hash is returned
+	// for replay, a different hash is ErrKeyConflict and a live lease is an
+	// *InProgressError. Times are compared against req.Now.
+	Claim(ctx context.Context, req ClaimRequest) (*Claim, *IdempotencyRecord, error)
+
+	// Complete stores the outcome of a claimed request. It returns
+	// ErrLeaseLost if the claim was taken over in the meantime.
+	Complete(ctx context.Context, claim *Claim, outcome Outcome) error
+}
+
+// ClaimRequest describes the request claiming a key
+type ClaimRequest struct {
+	Key            string
+	UserID         string
+	Endpoint       string
+	RequestHash    string
+	Now            time.Time
+	LeaseExpiresAt time.Time // When the claim lapses if not completed
+	ExpiresAt      time.Time // When the key is forgotten
+}
+
+// Claim is the right to run the handler for a key. FencingToken increases
+// with every takeover, so a request whose lease lapsed cannot overwrite the
+// result of the one that took over.
+type Claim struct {
+	Key          string
+	FencingToken int64
+}
+
+// Outcome is what Complete stores: the response of a completed request, or
+// the response or error of a failed one
+type Outcome struct {
+	Status   string // StatusCompleted or StatusFailed
+	Response *Response
+	Err      string
+}
+
+// claimable reports whether req may take over the existing record
+func claimable(record *IdempotencyRecord, req ClaimRequest) bool {
+	if record.TTL < req.Now.Unix() {
+		return true
+	}
+	if record.RequestHash != req.RequestHash {
+		return false
+	}
+	switch record.Status {
+	case StatusFailed:
+		return true
+	case StatusPending:
+		// Records written before leases existed have none and count as lapsed
+		return record.LeaseExpiresAt == 0 || record.LeaseExpiresAt < req.Now.UnixMilli()
+	}
+	return false
+}
+
+// blockedBy explains why req could not claim the existing record. A
+// completed record for the same request is returned instead of an error,
+// for replay.
+func blockedBy(record *IdempotencyRecord, req ClaimRequest) (*IdempotencyRecord, error) {
+	if record.RequestHash != req.RequestHash {
+		return nil, ErrKeyConflict
+	}
+	if record.Status == StatusCompleted {
+		return record, nil
+	}
+
+	// Only a pending record with a live lease is left
+	retryAfter := time.UnixMilli(record.LeaseExpiresAt).Sub(req.Now)
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return nil, &InProgressError{RetryAfter: retryAfter}
+}
@@ -0,0 +1,171 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoStore keeps idempotency records in the therma-idempotency table
+// (IDEMPOTENCY_TABLE_NAME), whose TTL attribute removes expired keys
+type DynamoStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoStore() (*DynamoStore, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	tableName := "therma-idempotency"
+	if envTable := os.Getenv("IDEMPOTENCY_TABLE_NAME"); envTable != "" {
+		tableName = envTable
+	}
+
+	return &DynamoStore{
+		client:    dynamodb.NewFromConfig(cfg),
+		tableName: tableName,
+	}, nil
+}
+
+// Claim is a single conditional UpdateItem whose condition mirrors
+// claimable. When it fails, DynamoDB returns the blocking record with the
+// error, so no second read is needed.
+func (s *DynamoStore) Claim(ctx context.Context, req ClaimRequest) (*Claim, *IdempotencyRecord, error) {
+	result, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: req.Key},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#key) OR #ttl < :now_s OR " +
+			"(#request_hash = :request_hash AND (#status = :failed OR " +
+			"(#status = :pending AND (attribute_not_exists(#lease) OR #lease < :now_ms))))"),
+		UpdateExpression: aws.String("SET #user_id = :user_id, #endpoint = :endpoint, #request_hash = :request_hash, " +
+			"#status = :pending, #created_at = :created_at, #expires_at = :expires_at, #ttl = :ttl, #lease = :lease, " +
+			"#fencing_token = if_not_exists(#fencing_token, :zero) + :one " +
+			"REMOVE #response, #response_status, #response_headers, #error"),
+		ExpressionAttributeNames: map[string]string{
+			"#key":              "key",
+			"#user_id":          "user_id",
+			"#endpoint":         "endpoint",
+			"#request_hash":     "request_hash",
+			"#status":           "status",
+			"#created_at":       "created_at",
+			"#expires_at":       "expires_at",
+			"#ttl":              "ttl",
+			"#lease":            "lease_expires_at",
+			"#fencing_token":    "fencing_token",
+			"#response":         "response",
+			"#response_status":  "response_status",
+			"#response_headers": "response_headers",
+			"#error":            "error",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user_id":      &types.AttributeValueMemberS{Value: req.UserID},
+			":endpoint":     &types.AttributeValueMemberS{Value: req.Endpoint},
+			":request_hash": &types.AttributeValueMemberS{Value: req.RequestHash},
+			":pending":      &types.AttributeValueMemberS{Value: StatusPending},
+			":failed":       &types.AttributeValueMemberS{Value: StatusFailed},
+			":created_at":   &types.AttributeValueMemberS{Value: req.Now.UTC().Format(time.RFC3339Nano)},
+			":expires_at":   &types.AttributeValueMemberS{Value: req.ExpiresAt.UTC().Format(time.RFC3339Nano)},
+			":ttl":          numberValue(req.ExpiresAt.Unix()),
+			":lease":        numberValue(req.LeaseExpiresAt.UnixMilli()),
+			":now_s":        numberValue(req.Now.Unix()),
+			":now_ms":       numberValue(req.Now.UnixMilli()),
+			":zero":         numberValue(0),
+			":one":          numberValue(1),
+		},
+		ReturnValues:                        types.ReturnValueUpdatedNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		var record IdempotencyRecord
+		if err := attributevalue.UnmarshalMap(conditionErr.Item, &record); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal idempotency record: %v", err)
+		}
+		replay, err := blockedBy(&record, req)
+		return nil, replay, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to claim idempotency key: %v", err)
+	}
+
+	var claimed struct {
+		FencingToken int64 `dynamodbav:"fencing_token"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Attributes, &claimed); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal idempotency claim: %v", err)
+	}
+
+	return &Claim{Key: req.Key, FencingToken: claimed.FencingToken}, nil, nil
+}
+
+func (s *DynamoStore) Complete(ctx context.Context, claim *Claim, outcome Outcome) error {
+	names := map[string]string{
+		"#fencing_token": "fencing_token",
+		"#status":        "status",
+		"#updated_at":    "updated_at",
+		"#lease":         "lease_expires_at",
+	}
+	values := map[string]types.AttributeValue{
+		":fencing_token": numberValue(claim.FencingToken),
+		":status":        &types.AttributeValueMemberS{Value: outcome.Status},
+		":updated_at":    &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+	}
+	update := "SET #status = :status, #updated_at = :updated_at"
+
+	if outcome.Response != nil {
+		headers, err := attributevalue.Marshal(outcome.Response.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal response headers: %v", err)
+		}
+		names["#response"], names["#response_status"], names["#response_headers"] = "response", "response_status", "response_headers"
+		values[":response"] = &types.AttributeValueMemberS{Value: outcome.Response.Body}
+		values[":response_status"] = numberValue(int64(outcome.Response.StatusCode))
+		values[":response_headers"] = headers
+		update += ", #response = :response, #response_status = :response_status, #response_headers = :response_headers"
+	}
+	if outcome.Err != "" {
+		names["#error"] = "error"
+		values[":error"] = &types.AttributeValueMemberS{Value: outcome.Err}
+		update += ", #error = :error"
+	}
+
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: claim.Key},
+		},
+		ConditionExpression:       aws.String("#fencing_token = :fencing_token"),
+		UpdateExpression:          aws.String(update + " REMOVE #lease"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrLeaseLost
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update idempotency record: %v", err)
+	}
+
+	return nil
+}
+
+func numberValue(n int64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
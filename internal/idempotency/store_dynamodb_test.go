@@ -0,0 +1,28 @@
+package idempotency_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/awsbackend/internal/idempotency"
+	"github.com/awsbackend/internal/idempotency/storetest"
+)
+
+// TestDynamoStore runs against the table named by TEST_IDEMPOTENCY_TABLE,
+// with the usual AWS configuration (set AWS_ENDPOINT_URL for DynamoDB
+// Local). It is skipped when the variable is unset.
+func TestDynamoStore(t *testing.T) {
+	table := os.Getenv("TEST_IDEMPOTENCY_TABLE")
+	if table == "" {
+		t.Skip("TEST_IDEMPOTENCY_TABLE is not set")
+	}
+	t.Setenv("IDEMPOTENCY_TABLE_NAME", table)
+
+	store, err := idempotency.NewDynamoStore()
+	if err != nil {
+		t.Fatalf("NewDynamoStore failed: %v", err)
+	}
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		return store
+	})
+}
@@ -0,0 +1,81 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps idempotency records in process, for tests and local
+// development. Records are only dropped when a claim replaces them.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]*IdempotencyRecord
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]*IdempotencyRecord{}}
+}
+
+func (s *MemoryStore) Claim(ctx context.Context, req ClaimRequest) (*Claim, *IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var fencingToken int64
+	if existing, ok := s.records[req.Key]; ok {
+		if !claimable(existing, req) {
+			replay, err := blockedBy(copyRecord(existing), req)
+			return nil, replay, err
+		}
+		fencingToken = existing.FencingToken
+	}
+
+	record := &IdempotencyRecord{
+		Key:            req.Key,
+		UserID:         req.UserID,
+		Endpoint:       req.Endpoint,
+		RequestHash:    req.RequestHash,
+		Status:         StatusPending,
+		CreatedAt:      req.Now,
+		ExpiresAt:      req.ExpiresAt,
+		TTL:            req.ExpiresAt.Unix(),
+		LeaseExpiresAt: req.LeaseExpiresAt.UnixMilli(),
+		FencingToken:   fencingToken + 1,
+	}
+	s.records[req.Key] = record
+
+	return &Claim{Key: req.Key, FencingToken: record.FencingToken}, nil, nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, claim *Claim, outcome Outcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[claim.Key]
+	if !ok || record.FencingToken != claim.FencingToken {
+		return ErrLeaseLost
+	}
+
+	record.Status = outcome.Status
+	record.Error = outcome.Err
+	record.LeaseExpiresAt = 0
+	if outcome.Response != nil {
+		record.ResponseStatus = outcome.Response.StatusCode
+		record.ResponseHeaders = map[string]string{}
+		for name, value := range outcome.Response.Headers {
+			record.ResponseHeaders[name] = value
+		}
+		record.Response = outcome.Response.Body
+	}
+
+	return nil
+}
+
+// copyRecord keeps callers from changing stored records
+func copyRecord(record *IdempotencyRecord) *IdempotencyRecord {
+	c := *record
+	c.ResponseHeaders = map[string]string{}
+	for name, value := range record.ResponseHeaders {
+		c.ResponseHeaders[name] = value
+	}
+	return &c
+}
@@ -0,0 +1,14 @@
+package idempotency_test
+
+import (
+	"testing"
+
+	"github.com/awsbackend/internal/idempotency"
+	"github.com/awsbackend/internal/idempotency/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		return idempotency.NewMemoryStore()
+	})
+}
@@ -0,0 +1,193 @@
+package idempotency
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/awsbackend/internal/db"
+)
+
+const idempotencyKeyColumns = `idempotency_key, user_id, endpoint, request_hash, status, response,
+	response_status, response_headers, error, lease_expires_at, fencing_token, created_at, expires_at`
+
+// TxStore is a Store that can join a database transaction, so the
+// handler's writes and the stored response commit or roll back together
+type TxStore interface {
+	Store
+	WithTx(tx db.DBTX) Store
+}
+
+// PostgresStore keeps idempotency records in the idempotency_keys table.
+// Claims always commit on their own, so a duplicate sees the live lease
+// and gets an *InProgressError instead of waiting on the first request's
+// transaction; see WithTx for completing keys inside one.
+type PostgresStore struct {
+	db db.DBTX
+
+	// tx is the handler's transaction, which completed outcomes join
+	tx db.DBTX
+
+	// completedInTx is the claim last completed inside tx; see Release
+	completedInTx *Claim
+}
+
+func NewPostgresStore(conn db.DBTX) *PostgresStore {
+	return &PostgresStore{db: conn}
+}
+
+// WithTx returns a store that completes keys inside tx, so the stored
+// response commits with the handler's writes. Claims and failed outcomes
+// are still written outside it: a transaction whose response is not
+// cached is rolled back, and its failure must outlive it so a retry can
+// take over at once. From the completion until tx ends, a duplicate's
+// Claim waits on the row lock rather than seeing the live lease.
+func (s *PostgresStore) WithTx(tx db.DBTX) Store {
+	return &PostgresStore{db: s.db, tx: tx}
+}
+
+// Claim inserts the key or, if the existing row is claimable, takes it
+// over in the same statement; the WHERE clause mirrors claimable
+func (s *PostgresStore) Claim(ctx context.Context, req ClaimRequest) (*Claim, *IdempotencyRecord, error) {
+	var fencingToken int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO idempotency_keys AS k (idempotency_key, user_id, endpoint, request_hash, status,
+			created_at, updated_at, expires_at, lease_expires_at, fencing_token)
+		VALUES ($1, $2, $3, $4, 'pending', $5, $5, $6, $7, 1)
+		ON CONFLICT (idempotency_key) DO UPDATE SET
+			user_id = EXCLUDED.user_id,
+			endpoint = EXCLUDED.endpoint,
+			request_hash = EXCLUDED.request_hash,
+			status = 'pending',
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at,
+			expires_at = EXCLUDED.expires_at,
+			lease_expires_at = EXCLUDED.lease_expires_at,
+			fencing_token = k.fencing_token + 1,
+			response = NULL,
+			response_status = NULL,
+			response_headers = NULL,
+			error = NULL
+		WHERE k.expires_at < $5
+			OR (k.request_hash = EXCLUDED.request_hash AND (k.status = 'failed'
+				OR (k.status = 'pending' AND (k.lease_expires_at IS NULL OR k.lease_expires_at < $5))))
+		RETURNING fencing_token`,
+		req.Key, req.UserID, req.Endpoint, req.RequestHash, req.Now, req.ExpiresAt, req.LeaseExpiresAt,
+	).Scan(&fencingToken)
+	if err == nil {
+		return &Claim{Key: req.Key, FencingToken: fencingToken}, nil, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("failed to claim idempotency key: %v", err)
+	}
+
+	// The row exists and is not claimable; it cannot disappear before it
+	// expires, which is why the claim failed
+	record, err := scanIdempotencyRecord(s.db.QueryRowContext(ctx, `
+		SELECT `+idempotencyKeyColumns+` FROM idempotency_keys WHERE idempotency_key = $1`, req.Key))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get idempotency record: %v", err)
+	}
+
+	replay, err := blockedBy(record, req)
+	return nil, replay, err
+}
+
+func (s *PostgresStore) Complete(ctx context.Context, claim *Claim, outcome Outcome) error {
+	var response, headers sql.NullString
+	var responseStatus sql.NullInt64
+	if outcome.Response != nil {
+		encoded, err := json.Marshal(outcome.Response.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal response headers: %v", err)
+		}
+		response = sql.NullString{String: outcome.Response.Body, Valid: true}
+		responseStatus = sql.NullInt64{Int64: int64(outcome.Response.StatusCode), Valid: true}
+		headers = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	conn := s.db
+	if s.tx != nil && outcome.Status == StatusCompleted {
+		conn = s.tx
+		s.completedInTx = claim
+	}
+
+	result, err := conn.ExecContext(ctx, `
+		UPDATE idempotency_keys SET
+			status = $3,
+			response = $4,
+			response_status = $5,
+			response_headers = $6,
+			error = $7,
+			lease_expires_at = NULL,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE idempotency_key = $1 AND fencing_token = $2`,
+		claim.Key, claim.FencingToken, outcome.Status, response, responseStatus, headers, sql.NullString{String: outcome.Err, Valid: outcome.Err != ""},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update idempotency record: %v", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to check rows affected: %v", err)
+	}
+	if rows != 1 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// Release marks the claim completed inside tx as failed, outside it. Call
+// it once tx has rolled back or failed to commit, which leaves the claim
+// pending: a retry would otherwise get a 409 until the lease lapses.
+func (s *PostgresStore) Release(ctx context.Context) error {
+	claim := s.completedInTx
+	if claim == nil {
+		return nil
+	}
+	s.completedInTx = nil
+	return NewPostgresStore(s.db).Complete(ctx, claim, Outcome{Status: StatusFailed, Err: "transaction rolled back"})
+}
+
+// DeleteExpired removes records that expired before now and returns how
+// many there were. Postgres has no TTL, so this has to be scheduled.
+func (s *PostgresStore) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < $1`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired idempotency records: %v", err)
+	}
+
+	return result.RowsAffected()
+}
+
+func scanIdempotencyRecord(row interface{ Scan(...interface{}) error }) (*IdempotencyRecord, error) {
+	var record IdempotencyRecord
+	var response, headers, errMsg sql.NullString
+	var responseStatus sql.NullInt64
+	var leaseExpiresAt sql.NullTime
+
+	err := row.Scan(&record.Key, &record.UserID, &record.Endpoint, &record.RequestHash, &record.Status, &response,
+		&responseStatus, &headers, &errMsg, &leaseExpiresAt, &record.FencingToken, &record.CreatedAt, &record.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Response = response.String
+	record.ResponseStatus = int(responseStatus.Int64)
+	record.Error = errMsg.String
+	record.TTL = record.ExpiresAt.Unix()
+	if leaseExpiresAt.Valid {
+		record.LeaseExpiresAt = leaseExpiresAt.Time.UnixMilli()
+	}
+	if headers.Valid {
+		if err := json.Unmarshal([]byte(headers.String), &record.ResponseHeaders); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal response headers: %v", err)
+		}
+	}
+
+	return &record, nil
+}
@@ -0,0 +1,194 @@
+package idempotency_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/idempotency"
+	"github.com/awsbackend/internal/idempotency/storetest"
+)
+
+// migratedTestDB returns a connection to TEST_DATABASE_URL whose
+// search_path is a fresh, fully migrated schema, dropped when the test
+// ends. Tests using it are skipped when the variable is unset.
+func migratedTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		t.Fatalf("TEST_DATABASE_URL must be a postgres:// URL: %v", err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+
+	conn, err := sql.Open("postgres", u.String())
+	if err != nil {
+		t.Fatalf("failed to open test schema: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	m, err := db.NewMigrator(conn)
+	if err != nil {
+		t.Fatalf("NewMigrator failed: %v", err)
+	}
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatalf("Up failed: %v", err)
+	}
+
+	return conn
+}
+
+func TestPostgresStore(t *testing.T) {
+	conn := migratedTestDB(t)
+	storetest.Run(t, func(t *testing.T) idempotency.Store {
+		return idempotency.NewPostgresStore(conn)
+	})
+}
+
+// TestPostgresDuplicateDoesNotWait checks that a duplicate of a request
+// still running in its transaction gets a 409 at once rather than waiting
+// on the first request's row lock, and replays its response afterwards
+func TestPostgresDuplicateDoesNotWait(t *testing.T) {
+	conn := migratedTestDB(t)
+	previous := db.DB
+	db.DB = conn
+	t.Cleanup(func() { db.DB = previous })
+
+	encryptor := encryption.NewEncryptor(encryption.NewLocalKeyProviderFromSeed(t.Name()))
+	service := idempotency.NewService(idempotency.NewPostgresStore(conn), idempotency.Config{Encryptor: encryptor})
+	m := idempotency.NewMiddleware(service, idempotency.MiddlewareConfig{
+		Routes: map[string]idempotency.RouteConfig{"POST /entries": {}},
+		Authenticate: func(ctx context.Context, request events.APIGatewayProxyRequest) (context.Context, string, error) {
+			return ctx, "user-1", nil
+		},
+		ErrorResponse: func(statusCode int, code, message string) events.APIGatewayProxyResponse {
+			return events.APIGatewayProxyResponse{StatusCode: statusCode, Body: code}
+		},
+	})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	wrapped := m.Wrap(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if _, ok := db.Conn(ctx).(*sql.Tx); !ok {
+			return events.APIGatewayProxyResponse{}, errors.New("handler is not in a transaction")
+		}
+		close(started)
+		<-release
+		return events.APIGatewayProxyResponse{StatusCode: 201, Body: `{"id":"entry-1"}`}, nil
+	})
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Resource:   "/entries",
+		Headers:    map[string]string{"Idempotency-Key": "key-1"},
+		Body:       `{}`,
+	}
+
+	type result struct {
+		response events.APIGatewayProxyResponse
+		err      error
+	}
+	first := make(chan result, 1)
+	go func() {
+		response, err := wrapped(context.Background(), request)
+		first <- result{response, err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	duplicate, err := wrapped(ctx, request)
+	close(release)
+	if err != nil {
+		t.Fatalf("duplicate failed: %v", err)
+	}
+	if duplicate.StatusCode != 409 || duplicate.Headers["Retry-After"] == "" {
+		t.Errorf("duplicate = %d %s %v, want a 409 with Retry-After", duplicate.StatusCode, duplicate.Body, duplicate.Headers)
+	}
+
+	r := <-first
+	if r.err != nil || r.response.StatusCode != 201 {
+		t.Fatalf("first request = %d, %v; want 201", r.response.StatusCode, r.err)
+	}
+
+	replayed, err := wrapped(context.Background(), request)
+	if err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if replayed.StatusCode != 201 || replayed.Body != r.response.Body || replayed.Headers[idempotency.ReplayedHeader] != "true" {
+		t.Errorf("retry = %d %s %v, want the first response replayed", replayed.StatusCode, replayed.Body, replayed.Headers)
+	}
+}
+
+// TestPostgresReleaseAfterRollback checks that a claim completed inside a
+// transaction that rolled back can be released, so a retry need not wait
+// for the lease to lapse
+func TestPostgresReleaseAfterRollback(t *testing.T) {
+	conn := migratedTestDB(t)
+	store := idempotency.NewPostgresStore(conn)
+	ctx := context.Background()
+	now := time.Now()
+	req := idempotency.ClaimRequest{
+		Key:            "release-1",
+		UserID:         "user-1",
+		Endpoint:       "POST /entries",
+		RequestHash:    "hash-1",
+		Now:            now,
+		LeaseExpiresAt: now.Add(time.Minute),
+		ExpiresAt:      now.Add(time.Hour),
+	}
+
+	claim, _, err := store.Claim(ctx, req)
+	if err != nil || claim == nil {
+		t.Fatalf("Claim = %v, %v; want a claim", claim, err)
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx failed: %v", err)
+	}
+	txStore := store.WithTx(tx).(*idempotency.PostgresStore)
+	if err := txStore.Complete(ctx, claim, idempotency.Outcome{Status: idempotency.StatusCompleted, Response: &idempotency.Response{StatusCode: 201}}); err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	var inProgress *idempotency.InProgressError
+	if _, _, err := store.Claim(ctx, req); !errors.As(err, &inProgress) {
+		t.Fatalf("Claim after the rollback = %v, want an *InProgressError until released", err)
+	}
+
+	if err := txStore.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if retry, _, err := store.Claim(ctx, req); err != nil || retry == nil {
+		t.Errorf("Claim after Release = %v, %v; want a claim", retry, err)
+	}
+}
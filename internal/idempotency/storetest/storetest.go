@@ -0,0 +1,246 @@
+// Package storetest is the conformance suite every idempotency.Store must
+// pass. A backend's tests call Run with a constructor for that backend:
+//
+//	func TestMemoryStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) idempotency.Store {
+//			return idempotency.NewMemoryStore()
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awsbackend/internal/idempotency"
+)
+
+const lease = 30 * time.Second
+
+// Run runs the suite against stores from newStore. Every subtest uses its
+// own keys, so newStore may return the same store, e.g. one backed by a
+// shared test database.
+func Run(t *testing.T, newStore func(t *testing.T) idempotency.Store) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s idempotency.Store, c *claimer)
+	}{
+		{"ClaimNewKey", testClaimNewKey},
+		{"DuplicateWhileLeaseIsLive", testDuplicateWhileLeaseIsLive},
+		{"ReplayCompleted", testReplayCompleted},
+		{"ConflictingRequest", testConflictingRequest},
+		{"TakeoverAfterLeaseLapses", testTakeoverAfterLeaseLapses},
+		{"RetryAfterFailure", testRetryAfterFailure},
+		{"ExpiredKeyIsReclaimed", testExpiredKeyIsReclaimed},
+		{"KeysAreIndependent", testKeysAreIndependent},
+		{"ConcurrentClaims", testConcurrentClaims},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &claimer{
+				prefix: fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano()),
+				now:    time.Now().Truncate(time.Millisecond),
+			}
+			tt.test(t, newStore(t), c)
+		})
+	}
+}
+
+// claimer builds claim requests for one subtest at a controlled time
+type claimer struct {
+	prefix string
+	now    time.Time
+}
+
+func (c *claimer) request(key, requestHash string) idempotency.ClaimRequest {
+	return idempotency.ClaimRequest{
+		Key:            c.prefix + "/" + key,
+		UserID:         "user-1",
+		Endpoint:       "POST /journal-entries",
+		RequestHash:    requestHash,
+		Now:            c.now,
+		LeaseExpiresAt: c.now.Add(lease),
+		ExpiresAt:      c.now.Add(24 * time.Hour),
+	}
+}
+
+func mustClaim(t *testing.T, s idempotency.Store, req idempotency.ClaimRequest) *idempotency.Claim {
+	t.Helper()
+	claim, record, err := s.Claim(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Claim(%s) failed: %v", req.Key, err)
+	}
+	if claim == nil || record != nil {
+		t.Fatalf("Claim(%s) = %v, %v; want a claim", req.Key, claim, record)
+	}
+	return claim
+}
+
+func mustComplete(t *testing.T, s idempotency.Store, claim *idempotency.Claim, outcome idempotency.Outcome) {
+	t.Helper()
+	if err := s.Complete(context.Background(), claim, outcome); err != nil {
+		t.Fatalf("Complete(%s) failed: %v", claim.Key, err)
+	}
+}
+
+func wantInProgress(t *testing.T, err error) *idempotency.InProgressError {
+	t.Helper()
+	var inProgress *idempotency.InProgressError
+	if !errors.As(err, &inProgress) {
+		t.Fatalf("got %v, want *InProgressError", err)
+	}
+	return inProgress
+}
+
+var created = &idempotency.Response{
+	StatusCode: 201,
+	Headers:    map[string]string{"Content-Type": "application/json", "Location": "/journal-entries/1"},
+	Body:       "{\"id\":\"1\",\"content\":\"caf\u00e9 \\u2603\"}\n",
+}
+
+func testClaimNewKey(t *testing.T, s idempotency.Store, c *claimer) {
+	claim := mustClaim(t, s, c.request("a", "hash-1"))
+	if claim.FencingToken < 1 {
+		t.Errorf("FencingToken = %d, want at least 1", claim.FencingToken)
+	}
+}
+
+func testDuplicateWhileLeaseIsLive(t *testing.T, s idempotency.Store, c *claimer) {
+	mustClaim(t, s, c.request("a", "hash-1"))
+
+	c.now = c.now.Add(10 * time.Second)
+	_, _, err := s.Claim(context.Background(), c.request("a", "hash-1"))
+	inProgress := wantInProgress(t, err)
+	if inProgress.RetryAfter < time.Second || inProgress.RetryAfter > lease {
+		t.Errorf("RetryAfter = %s, want the rest of the lease, about %s", inProgress.RetryAfter, lease-10*time.Second)
+	}
+}
+
+func testReplayCompleted(t *testing.T, s idempotency.Store, c *claimer) {
+	claim := mustClaim(t, s, c.request("a", "hash-1"))
+	mustComplete(t, s, claim, idempotency.Outcome{Status: idempotency.StatusCompleted, Response: created})
+
+	c.now = c.now.Add(time.Hour)
+	again, record, err := s.Claim(context.Background(), c.request("a", "hash-1"))
+	if err != nil || again != nil || record == nil {
+		t.Fatalf("Claim after completion = %v, %v, %v; want the stored record", again, record, err)
+	}
+	if record.Status != idempotency.StatusCompleted {
+		t.Errorf("Status = %q, want %q", record.Status, idempotency.StatusCompleted)
+	}
+	if record.ResponseStatus != created.StatusCode {
+		t.Errorf("ResponseStatus = %d, want %d", record.ResponseStatus, created.StatusCode)
+	}
+	if record.Response != created.Body {
+		t.Errorf("Response = %q, want %q byte for byte", record.Response, created.Body)
+	}
+	if len(record.ResponseHeaders) != len(created.Headers) {
+		t.Errorf("ResponseHeaders = %v, want %v", record.ResponseHeaders, created.Headers)
+	}
+	for name, value := range created.Headers {
+		if record.ResponseHeaders[name] != value {
+			t.Errorf("ResponseHeaders[%s] = %q, want %q", name, record.ResponseHeaders[name], value)
+		}
+	}
+}
+
+func testConflictingRequest(t *testing.T, s idempotency.Store, c *claimer) {
+	pending := mustClaim(t, s, c.request("pending", "hash-1"))
+	if _, _, err := s.Claim(context.Background(), c.request("pending", "hash-2")); err != idempotency.ErrKeyConflict {
+		t.Errorf("Claim of a pending key with another hash = %v, want ErrKeyConflict", err)
+	}
+
+	mustComplete(t, s, pending, idempotency.Outcome{Status: idempotency.StatusCompleted, Response: created})
+	if _, _, err := s.Claim(context.Background(), c.request("pending", "hash-2")); err != idempotency.ErrKeyConflict {
+		t.Errorf("Claim of a completed key with another hash = %v, want ErrKeyConflict", err)
+	}
+
+	failed := mustClaim(t, s, c.request("failed", "hash-1"))
+	mustComplete(t, s, failed, idempotency.Outcome{Status: idempotency.StatusFailed, Err: "boom"})
+	if _, _, err := s.Claim(context.Background(), c.request("failed", "hash-2")); err != idempotency.ErrKeyConflict {
+		t.Errorf("Claim of a failed key with another hash = %v, want ErrKeyConflict", err)
+	}
+}
+
+func testTakeoverAfterLeaseLapses(t *testing.T, s idempotency.Store, c *claimer) {
+	first := mustClaim(t, s, c.request("a", "hash-1"))
+
+	c.now = c.now.Add(lease + time.Second)
+	second := mustClaim(t, s, c.request("a", "hash-1"))
+	if second.FencingToken <= first.FencingToken {
+		t.Errorf("FencingToken after takeover = %d, want more than %d", second.FencingToken, first.FencingToken)
+	}
+
+	err := s.Complete(context.Background(), first, idempotency.Outcome{Status: idempotency.StatusCompleted, Response: created})
+	if err != idempotency.ErrLeaseLost {
+		t.Errorf("Complete with a lapsed claim = %v, want ErrLeaseLost", err)
+	}
+	mustComplete(t, s, second, idempotency.Outcome{Status: idempotency.StatusCompleted, Response: created})
+
+	// The lapsed claim has not overwritten the winner's result
+	c.now = c.now.Add(time.Second)
+	if _, record, err := s.Claim(context.Background(), c.request("a", "hash-1")); err != nil || record == nil {
+		t.Errorf("Claim after takeover = %v, %v; want the stored record", record, err)
+	}
+}
+
+func testRetryAfterFailure(t *testing.T, s idempotency.Store, c *claimer) {
+	first := mustClaim(t, s, c.request("a", "hash-1"))
+	mustComplete(t, s, first, idempotency.Outcome{Status: idempotency.StatusFailed, Err: "boom"})
+
+	c.now = c.now.Add(time.Second)
+	second := mustClaim(t, s, c.request("a", "hash-1"))
+	if second.FencingToken <= first.FencingToken {
+		t.Errorf("FencingToken after a failure = %d, want more than %d", second.FencingToken, first.FencingToken)
+	}
+}
+
+func testExpiredKeyIsReclaimed(t *testing.T, s idempotency.Store, c *claimer) {
+	claim := mustClaim(t, s, c.request("a", "hash-1"))
+	mustComplete(t, s, claim, idempotency.Outcome{Status: idempotency.StatusCompleted, Response: created})
+
+	c.now = c.now.Add(25 * time.Hour)
+	mustClaim(t, s, c.request("a", "hash-2"))
+}
+
+func testKeysAreIndependent(t *testing.T, s idempotency.Store, c *claimer) {
+	mustClaim(t, s, c.request("a", "hash-1"))
+	mustClaim(t, s, c.request("b", "hash-1"))
+}
+
+func testConcurrentClaims(t *testing.T, s idempotency.Store, c *claimer) {
+	const n = 10
+	req := c.request("a", "hash-1")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claims, inProgress := 0, 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claim, _, err := s.Claim(context.Background(), req)
+			mu.Lock()
+			defer mu.Unlock()
+			var inProgressErr *idempotency.InProgressError
+			switch {
+			case err == nil && claim != nil:
+				claims++
+			case errors.As(err, &inProgressErr):
+				inProgress++
+			default:
+				t.Errorf("concurrent Claim = %v, %v", claim, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if claims != 1 || inProgress != n-1 {
+		t.Errorf("%d concurrent claims: %d succeeded and %d were in progress, want 1 and %d", n, claims, inProgress, n-1)
+	}
+}
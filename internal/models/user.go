@@ -5,11 +5,75 @@ import (
 )
 
 type User struct {
-	ID        string    `json:"id"`
-	Email     string    `json:"email"`
-	Password  string    `json:"-"` // Password is never exposed in JSON
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              string     `json:"id"`
+	Email           string     `json:"email"`
+	Password        string     `json:"-"` // Password is never exposed in JSON
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// UserMFA is a user's TOTP second factor. It is enrolled when created and
+// only enforced once EnabledAt is set, after the first valid code.
+type UserMFA struct {
+	UserID             string
+	Secret             string // Ciphertext of the base32 TOTP secret
+	KeyID              string
+	DataKey            string
+	EnabledAt          *time.Time
+	LastUsedStep       int64 // TOTP time step of the last accepted code, against replay
+	RecoveryCodeHashes []string
+	FailedAttempts     int
+	LockedUntil        *time.Time
+	LastPendingJTI     string // jti of the last mfa_pending token exchanged for tokens, against reuse
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+// JournalShare grants a clinician read access to a patient's journal
+type JournalShare struct {
+	PatientID   string    `json:"patient_id"`
+	ClinicianID string    `json:"clinician_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// RefreshToken is a stored refresh token. Only the hash of the token is
+// kept; tokens issued from one login share a FamilyID.
+type RefreshToken struct {
+	ID        string
+	UserID    string
+	FamilyID  string
+	ParentID  string // Token this one was rotated from; empty for the first of a family
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// AccountToken is a mailed single-use token, see the account_tokens table
+type AccountToken struct {
+	ID        string
+	UserID    string
+	Purpose   string // auth.TokenUseEmailVerification or auth.TokenUsePasswordReset
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// UserKey is a user's key-encryption key, wrapped under the KMS master key.
+// Every PHI value of the user is sealed under a key derived from it, so
+// destroying it (crypto-shredding) makes all copies of that PHI unreadable,
+// including those in backups.
+type UserKey struct {
+	UserID      string     `json:"user_id"`
+	KeyID       string     `json:"key_id"`        // Recorded in every ciphertext sealed under this key
+	WrappedKey  []byte     `json:"-"`             // Empty once shredded
+	MasterKeyID string     `json:"master_key_id"` // KMS key that wrapped it
+	CreatedAt   time.Time  `json:"created_at"`
+	ShreddedAt  *time.Time `json:"shredded_at,omitempty"`
 }
 
 type MoodCheckIn struct {
@@ -32,8 +96,39 @@ type JournalEntry struct {
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 	Encrypted   bool      `json:"encrypted"`   // Track encryption status
+	KeyID       string    `json:"-"`           // KMS key the PHI fields were encrypted under
+	DataKey     string    `json:"-"`           // KMS-wrapped data key sealing the PHI fields; empty for legacy rows
+	Version     int64     `json:"-"`           // Bumped on every write, for optimistic concurrency
+	MoodIndex   string    `json:"-"`           // Blind index of Mood; empty when there is no mood
+	TagIndexes  []string  `json:"-"`           // Blind indexes of Tags
 }
 
+// MoodCheckInRecord is a mood check-in as stored, with its PHI fields still
+// encrypted
+type MoodCheckInRecord struct {
+	ID          string
+	UserID      string
+	MoodScore   string    // PHI - ciphertext of the decimal score
+	Notes       string    // PHI - ciphertext
+	CheckedInAt time.Time
+	CreatedAt   time.Time
+	Encrypted   bool
+	KeyID       string
+	DataKey     string
+	Version     int64
+}
+
+// Field names PHI values are bound to when encrypted, so a ciphertext only
+// decrypts in the column it was written for
+const (
+	JournalEntryFieldContent = "journal_entries.content"
+	JournalEntryFieldMood    = "journal_entries.mood"
+	JournalEntryFieldTags    = "journal_entries.tags"
+	MoodCheckInFieldScore    = "mood_check_ins.mood_score"
+	MoodCheckInFieldNotes    = "mood_check_ins.notes"
+	UserMFAFieldSecret       = "user_mfa.secret"
+)
+
 type IdempotencyKey struct {
 	Key         string    `json:"key"`
 	UserID      string    `json:"user_id"`
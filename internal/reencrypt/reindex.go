@@ -0,0 +1,114 @@
+package reencrypt
+
+import (
+	"context"
+	"log"
+	"slices"
+
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/models"
+)
+
+// ReindexStats counts what a Reindexer did
+type ReindexStats struct {
+	Scanned   int64
+	Updated   int64
+	Unchanged int64
+	Failed    int64 // could not be decrypted, e.g. shredded users; see the log
+	LastID    string
+}
+
+// Reindexer recomputes the blind indexes of every journal entry, for rows
+// written before indexing existed or after the index key changes. It is
+// idempotent, so no progress is stored; pass the last ID it logged to
+// continue an interrupted run.
+type Reindexer struct {
+	encryptor  encryption.Encryptor
+	blindIndex *encryption.BlindIndex
+	batchSize  int
+}
+
+func NewReindexer(encryptor encryption.Encryptor, blindIndex *encryption.BlindIndex, batchSize int) *Reindexer {
+	if batchSize <= 0 {
+		batchSize = DefaultConfig.BatchSize
+	}
+	return &Reindexer{encryptor: encryptor, blindIndex: blindIndex, batchSize: batchSize}
+}
+
+// Run walks journal_entries in ID order after afterID
+func (r *Reindexer) Run(ctx context.Context, afterID string) (*ReindexStats, error) {
+	stats := &ReindexStats{LastID: afterID}
+	repo := db.NewJournalEntryRepository(db.DB)
+
+	for {
+		entries, err := repo.ListForReencryption(ctx, stats.LastID, r.batchSize)
+		if err != nil {
+			return stats, err
+		}
+
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return stats, err
+			}
+
+			stats.Scanned++
+			updated, err := r.reindex(ctx, entry)
+			switch {
+			case err != nil:
+				stats.Failed++
+				log.Printf("reindex: journal entry %s: %v", entry.ID, err)
+			case updated:
+				stats.Updated++
+			default:
+				stats.Unchanged++
+			}
+			stats.LastID = entry.ID
+		}
+
+		log.Printf("reindex: scanned=%d updated=%d unchanged=%d failed=%d last_id=%s",
+			stats.Scanned, stats.Updated, stats.Unchanged, stats.Failed, stats.LastID)
+
+		if len(entries) < r.batchSize {
+			return stats, nil
+		}
+	}
+}
+
+// reindex updates one entry's indexes, retrying once if it is modified
+// concurrently (in which case the writer has usually indexed it already)
+func (r *Reindexer) reindex(ctx context.Context, entry *models.JournalEntry) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		opener := r.encryptor.OpenRecord(entry.UserID, entry.ID, entry.DataKey)
+		mood, err := opener.Open(ctx, models.JournalEntryFieldMood, entry.Mood)
+		if err != nil {
+			opener.Close()
+			return false, err
+		}
+		tags, err := opener.OpenArray(ctx, models.JournalEntryFieldTags, entry.Tags)
+		opener.Close()
+		if err != nil {
+			return false, err
+		}
+
+		moodIndex := r.blindIndex.Token(entry.UserID, models.JournalEntryFieldMood, mood)
+		tagIndexes := r.blindIndex.Tokens(entry.UserID, models.JournalEntryFieldTags, tags)
+		if moodIndex == entry.MoodIndex && slices.Equal(tagIndexes, entry.TagIndexes) {
+			return false, nil
+		}
+
+		entry.MoodIndex, entry.TagIndexes = moodIndex, tagIndexes
+		err = db.NewJournalEntryRepository(db.DB).UpdateIndexes(ctx, entry)
+		if err != db.ErrConflict || attempt > 0 {
+			return err == nil, err
+		}
+
+		entry, err = db.NewJournalEntryRepository(db.DB).GetByID(ctx, entry.UserID, entry.ID)
+		if err == db.ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
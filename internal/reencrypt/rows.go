@@ -0,0 +1,102 @@
+package reencrypt
+
+import (
+	"context"
+
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/models"
+)
+
+// row adapts one stored record of any table to the worker
+type row interface {
+	id() string
+	owner() (userID, recordID string)
+	keyID() string
+	dataKey() string
+	encrypted() bool
+
+	// fields returns pointers to the PHI columns so reseal can rewrite them
+	fields() []field
+	setKey(keyID, dataKey string)
+
+	// save writes the new ciphertexts if the row is unchanged since it was
+	// read, returning db.ErrConflict otherwise
+	save(ctx context.Context, database db.DBTX) error
+	reload(ctx context.Context, database db.DBTX) (row, error)
+}
+
+// field is a scalar (value) or array (values) PHI column
+type field struct {
+	name   string
+	value  *string
+	values *[]string
+}
+
+type journalEntryRow struct {
+	entry *models.JournalEntry
+}
+
+func (r *journalEntryRow) id() string              { return r.entry.ID }
+func (r *journalEntryRow) owner() (string, string) { return r.entry.UserID, r.entry.ID }
+func (r *journalEntryRow) keyID() string           { return r.entry.KeyID }
+func (r *journalEntryRow) dataKey() string         { return r.entry.DataKey }
+func (r *journalEntryRow) encrypted() bool         { return r.entry.Encrypted }
+func (r *journalEntryRow) setKey(keyID, dataKey string) {
+	r.entry.KeyID = keyID
+	r.entry.DataKey = dataKey
+	r.entry.Encrypted = true
+}
+
+func (r *journalEntryRow) fields() []field {
+	return []field{
+		{name: models.JournalEntryFieldContent, value: &r.entry.Content},
+		{name: models.JournalEntryFieldMood, value: &r.entry.Mood},
+		{name: models.JournalEntryFieldTags, values: &r.entry.Tags},
+	}
+}
+
+func (r *journalEntryRow) save(ctx context.Context, database db.DBTX) error {
+	return db.NewJournalEntryRepository(database).UpdateCiphertexts(ctx, r.entry)
+}
+
+func (r *journalEntryRow) reload(ctx context.Context, database db.DBTX) (row, error) {
+	entry, err := db.NewJournalEntryRepository(database).GetByID(ctx, r.entry.UserID, r.entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &journalEntryRow{entry: entry}, nil
+}
+
+type moodCheckInRow struct {
+	checkIn *models.MoodCheckInRecord
+}
+
+func (r *moodCheckInRow) id() string              { return r.checkIn.ID }
+func (r *moodCheckInRow) owner() (string, string) { return r.checkIn.UserID, r.checkIn.ID }
+func (r *moodCheckInRow) keyID() string           { return r.checkIn.KeyID }
+func (r *moodCheckInRow) dataKey() string         { return r.checkIn.DataKey }
+func (r *moodCheckInRow) encrypted() bool         { return r.checkIn.Encrypted }
+func (r *moodCheckInRow) setKey(keyID, dataKey string) {
+	r.checkIn.KeyID = keyID
+	r.checkIn.DataKey = dataKey
+	r.checkIn.Encrypted = true
+}
+
+func (r *moodCheckInRow) fields() []field {
+	return []field{
+		{name: models.MoodCheckInFieldScore, value: &r.checkIn.MoodScore},
+		{name: models.MoodCheckInFieldNotes, value: &r.checkIn.Notes},
+	}
+}
+
+func (r *moodCheckInRow) save(ctx context.Context, database db.DBTX) error {
+	return db.NewMoodCheckInRepository(database).UpdateCiphertexts(ctx, r.checkIn)
+}
+
+func (r *moodCheckInRow) reload(ctx context.Context, database db.DBTX) (row, error) {
+	checkIn, err := db.NewMoodCheckInRepository(database).GetByID(ctx, r.checkIn.UserID, r.checkIn.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &moodCheckInRow{checkIn: checkIn}, nil
+}
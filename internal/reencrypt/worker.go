@@ -0,0 +1,353 @@
+// Package reencrypt moves stored PHI to the current master key.
+//
+// After KMS_KEY_ID (or the alias it names) is pointed at a new key, new
+// records are sealed under it straight away but existing rows keep data keys
+// wrapped by the old one. The Worker walks journal_entries and
+// mood_check_ins in ID order, decrypts every row that is not yet under the
+// current key, seals it again under a fresh data key and writes it back with
+// a version check, so it never overwrites a concurrent edit. Progress is
+// stored in reencryption_jobs after every batch: an interrupted run resumes
+// where it stopped, and finished jobs remain as the audit record of the
+// rotation.
+//
+// KMS automatic key rotation does not need this; KMS keeps old key material
+// and existing ciphertexts stay decryptable under the same key ID.
+//
+// With per-user keys enabled, the worker also moves rows still sealed under
+// KMS data keys onto their owner's key, so that shredding it on account
+// deletion covers them too.
+package reencrypt
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
+)
+
+// Tables the worker walks, in order
+const (
+	TableJournalEntries = "journal_entries"
+	TableMoodCheckIns   = "mood_check_ins"
+)
+
+// Config tunes a Worker
+type Config struct {
+	// BatchSize is how many rows are read, and progress saved, at a time
+	BatchSize int
+
+	// MaxAttempts is how often a row modified concurrently is re-read and
+	// retried before it is counted as a conflict and left for the next run
+	MaxAttempts int
+}
+
+// DefaultConfig is used for zero fields of a Config
+var DefaultConfig = Config{
+	BatchSize:   100,
+	MaxAttempts: 3,
+}
+
+// Worker re-encrypts stored PHI under the encryptor's current key. It uses
+// the db.DB connection pool, so db.InitDB must have been called.
+type Worker struct {
+	encryptor  encryption.Encryptor
+	config     Config
+	toUserKeys bool // every row not under a user key is resealed
+}
+
+func NewWorker(encryptor encryption.Encryptor, config Config) *Worker {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultConfig.BatchSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultConfig.MaxAttempts
+	}
+
+	userKeys, ok := encryptor.(interface{ UsesUserKeys() bool })
+	return &Worker{encryptor: encryptor, config: config, toUserKeys: ok && userKeys.UsesUserKeys()}
+}
+
+// Run resumes the unfinished job for the current key if there is one and
+// starts a new job otherwise, then walks every table to the end. Rows that
+// fail or keep conflicting are counted and skipped; running again later
+// starts a new job that picks them up. The returned job reflects the final
+// progress even when err is non-nil.
+func (w *Worker) Run(ctx context.Context) (*db.ReencryptionJob, error) {
+	targetKeyID, err := w.encryptor.ResolveKeyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := db.NewReencryptionJobRepository(db.DB)
+
+	job, err := jobs.FindUnfinished(ctx, targetKeyID)
+	switch {
+	case err == db.ErrNotFound:
+		job, err = w.startJob(ctx, jobs, targetKeyID)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("re-encryption job %s started: target key %s", job.ID, targetKeyID)
+
+	case err != nil:
+		return nil, err
+
+	default:
+		if err := jobs.SetStatus(ctx, job.ID, db.ReencryptionJobRunning, ""); err != nil {
+			return nil, err
+		}
+		log.Printf("re-encryption job %s resumed: target key %s", job.ID, targetKeyID)
+	}
+
+	for _, table := range []string{TableJournalEntries, TableMoodCheckIns} {
+		progress := job.Progress(table)
+		if progress == nil {
+			progress = &db.ReencryptionTableProgress{Table: table}
+			job.Tables = append(job.Tables, progress)
+		}
+
+		if err := w.runTable(ctx, jobs, job, progress); err != nil {
+			w.fail(jobs, job, err)
+			return job, err
+		}
+	}
+
+	if err := jobs.SetStatus(ctx, job.ID, db.ReencryptionJobCompleted, ""); err != nil {
+		return job, err
+	}
+	job.Status = db.ReencryptionJobCompleted
+
+	for _, p := range job.Tables {
+		log.Printf("re-encryption job %s completed %s: scanned=%d reencrypted=%d skipped=%d conflicts=%d failed=%d",
+			job.ID, p.Table, p.Scanned, p.Reencrypted, p.Skipped, p.Conflicts, p.Failed)
+	}
+
+	return job, nil
+}
+
+func (w *Worker) startJob(ctx context.Context, jobs *db.ReencryptionJobRepository, targetKeyID string) (*db.ReencryptionJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &db.ReencryptionJob{
+		ID:          id,
+		TargetKeyID: targetKeyID,
+		Status:      db.ReencryptionJobRunning,
+		StartedAt:   time.Now().UTC(),
+		Tables: []*db.ReencryptionTableProgress{
+			{Table: TableJournalEntries},
+			{Table: TableMoodCheckIns},
+		},
+	}
+
+	err = db.WithTx(ctx, func(tx *sql.Tx) error {
+		return db.NewReencryptionJobRepository(tx).Create(ctx, job)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// fail records why a run stopped and how far it got. It uses a fresh context
+// because the usual reason is that ctx was cancelled or timed out.
+func (w *Worker) fail(jobs *db.ReencryptionJobRepository, job *db.ReencryptionJob, cause error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Keep the counts for rows handled since the last saved batch
+	for _, p := range job.Tables {
+		if err := jobs.SaveProgress(ctx, job.ID, p); err != nil {
+			log.Printf("re-encryption job %s: failed to save progress: %v", job.ID, err)
+		}
+	}
+
+	if err := jobs.SetStatus(ctx, job.ID, db.ReencryptionJobFailed, cause.Error()); err != nil {
+		log.Printf("re-encryption job %s: failed to record failure: %v", job.ID, err)
+	}
+	job.Status = db.ReencryptionJobFailed
+	job.Error = cause.Error()
+
+	log.Printf("re-encryption job %s stopped: %v", job.ID, cause)
+}
+
+// runTable processes one table batch by batch from progress.LastID
+func (w *Worker) runTable(ctx context.Context, jobs *db.ReencryptionJobRepository, job *db.ReencryptionJob, progress *db.ReencryptionTableProgress) error {
+	for !progress.Done {
+		rows, err := w.batch(ctx, progress.Table, progress.LastID)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rows {
+			result, err := w.process(ctx, r, job.TargetKeyID)
+			if err != nil {
+				// Checked before counting so a cancelled run resumes at this row
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("re-encryption job %s: %s %s: %v", job.ID, progress.Table, r.id(), err)
+			}
+
+			progress.Scanned++
+			switch result {
+			case resultReencrypted:
+				progress.Reencrypted++
+			case resultSkipped:
+				progress.Skipped++
+			case resultConflict:
+				progress.Conflicts++
+			case resultFailed:
+				progress.Failed++
+			}
+			progress.LastID = r.id()
+		}
+
+		if len(rows) < w.config.BatchSize {
+			progress.Done = true
+		}
+
+		if err := jobs.SaveProgress(ctx, job.ID, progress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Worker) batch(ctx context.Context, table, afterID string) ([]row, error) {
+	var rows []row
+
+	switch table {
+	case TableJournalEntries:
+		entries, err := db.NewJournalEntryRepository(db.DB).ListForReencryption(ctx, afterID, w.config.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			rows = append(rows, &journalEntryRow{entry: entry})
+		}
+
+	case TableMoodCheckIns:
+		checkIns, err := db.NewMoodCheckInRepository(db.DB).ListForReencryption(ctx, afterID, w.config.BatchSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, checkIn := range checkIns {
+			rows = append(rows, &moodCheckInRow{checkIn: checkIn})
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown table %q", table)
+	}
+
+	return rows, nil
+}
+
+type result int
+
+const (
+	resultReencrypted result = iota
+	resultSkipped
+	resultConflict
+	resultFailed
+)
+
+// process re-encrypts one row, re-reading and retrying it if it changes
+// underneath us
+func (w *Worker) process(ctx context.Context, r row, targetKeyID string) (result, error) {
+	for attempt := 1; ; attempt++ {
+		// Rows sealed under a user key do not depend on the master key
+		// directly; with user keys enabled every other row moves onto one
+		if encryption.IsUserKeyID(r.keyID()) || (!w.toUserKeys && r.keyID() == targetKeyID && r.dataKey() != "") {
+			return resultSkipped, nil
+		}
+
+		if err := w.reseal(ctx, r); err != nil {
+			return resultFailed, err
+		}
+
+		err := r.save(ctx, db.DB)
+		if err == nil {
+			return resultReencrypted, nil
+		}
+		if err != db.ErrConflict {
+			return resultFailed, err
+		}
+
+		if attempt == w.config.MaxAttempts {
+			return resultConflict, fmt.Errorf("still modified concurrently after %d attempts", attempt)
+		}
+
+		r, err = r.reload(ctx, db.DB)
+		if err == db.ErrNotFound {
+			// Deleted since it was read; nothing left to protect
+			return resultSkipped, nil
+		}
+		if err != nil {
+			return resultFailed, err
+		}
+	}
+}
+
+// reseal decrypts every PHI field of r and seals it again under a fresh data
+// key from the current master key, updating r in memory
+func (w *Worker) reseal(ctx context.Context, r row) error {
+	userID, recordID := r.owner()
+
+	envelope, err := w.encryptor.NewEnvelope(ctx, userID, recordID)
+	if err != nil {
+		return fmt.Errorf("failed to create data key: %v", err)
+	}
+	defer envelope.Destroy()
+
+	opener := w.encryptor.OpenRecord(userID, recordID, r.dataKey())
+	defer opener.Close()
+
+	for _, f := range r.fields() {
+		if f.value != nil {
+			plaintext := *f.value
+			if r.encrypted() {
+				if plaintext, err = opener.Open(ctx, f.name, *f.value); err != nil {
+					return fmt.Errorf("failed to decrypt %s: %v", f.name, err)
+				}
+			}
+			if *f.value, err = envelope.Seal(f.name, plaintext); err != nil {
+				return fmt.Errorf("failed to encrypt %s: %v", f.name, err)
+			}
+			continue
+		}
+
+		plaintexts := *f.values
+		if r.encrypted() {
+			if plaintexts, err = opener.OpenArray(ctx, f.name, *f.values); err != nil {
+				return fmt.Errorf("failed to decrypt %s: %v", f.name, err)
+			}
+		}
+		if *f.values, err = envelope.SealArray(f.name, plaintexts); err != nil {
+			return fmt.Errorf("failed to encrypt %s: %v", f.name, err)
+		}
+	}
+
+	r.setKey(envelope.KeyID(), envelope.WrappedKey())
+	return nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %v", err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/httpapi"
+)
+
+// app holds the services shared by every request served by a warm Lambda
+type app struct {
+	encryptor encryption.Encryptor
+	revoker   *auth.Revoker // nil when token revocation is not configured
+}
+
+func newApp() (*app, error) {
+	encryptor, err := encryption.NewEncryptorFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize encryption service: %v", err)
+	}
+
+	revoker, err := auth.DefaultRevoker()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize token revocation: %v", err)
+	}
+
+	return &app{encryptor: encryptor, revoker: revoker}, nil
+}
+
+// handler routes /account requests
+func (a *app) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims, err := httpapi.Authenticate(ctx, request)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+
+	if request.HTTPMethod == "DELETE" {
+		if err := auth.Authorize(claims, auth.PermAccountDelete); err != nil {
+			return httpapi.Forbidden(err), nil
+		}
+		return a.deleteAccount(ctx, claims.UserID)
+	}
+
+	return httpapi.Error(405, "METHOD_NOT_ALLOWED",
+		fmt.Sprintf("%s is not supported on %s", request.HTTPMethod, request.Resource), ""), nil
+}
+
+// deleteAccount handles DELETE /account. The user's key is shredded first,
+// which on its own makes every copy of their PHI sealed under it unreadable,
+// including backups and rows this request fails to delete; the rows are
+// then removed and, last, every token of the user is revoked. Retrying after
+// a failure is safe, and possible because the caller's token still works
+// until the final step.
+//
+// Rows sealed before per-user keys were enabled (format versions 1 and 2)
+// are under KMS data keys and not covered by shredding; make reencrypt moves
+// them onto user keys. Without per-user keys or token revocation the account
+// cannot be deleted as promised, so the request fails before touching
+// anything.
+func (a *app) deleteAccount(ctx context.Context, userID string) (events.APIGatewayProxyResponse, error) {
+	if a.revoker == nil {
+		return httpapi.Error(503, "ACCOUNT_DELETION_UNAVAILABLE",
+			"Account deletion is not available", "token revocation is not configured"), nil
+	}
+
+	err := a.encryptor.ShredUser(ctx, userID)
+	if err == encryption.ErrUserKeysDisabled {
+		return httpapi.Error(503, "ACCOUNT_DELETION_UNAVAILABLE",
+			"Account deletion is not available", "per-user keys are not enabled, so PHI cannot be shredded"), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "SHRED_ERROR", "Failed to destroy account key", err.Error()), nil
+	}
+
+	err = db.WithTx(ctx, func(tx *sql.Tx) error {
+		entries, err := db.NewJournalEntryRepository(tx).DeleteAllForUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		checkIns, err := db.NewMoodCheckInRepository(tx).DeleteAllForUser(ctx, userID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.NewJournalShareRepository(tx).DeleteAllForUser(ctx, userID); err != nil {
+			return err
+		}
+
+		// Users that only ever authenticated with a token have no users row
+		// and no refresh tokens, and their IDs need not be UUIDs
+		if db.IsUUID(userID) {
+			// Refresh tokens would go with the users row, but revoking them
+			// explicitly also covers a failed or partial delete
+			if _, err := db.NewRefreshTokenRepository(tx).RevokeAllForUser(ctx, userID); err != nil {
+				return err
+			}
+
+			if err := db.NewUserRepository(tx).Delete(ctx, userID); err != nil && err != db.ErrNotFound {
+				return err
+			}
+		}
+
+		log.Printf("account deletion for %s: deleted %d journal entries and %d mood check-ins",
+			userID, entries, checkIns)
+		return nil
+	})
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to delete account data", err.Error()), nil
+	}
+
+	if err := a.revoker.RevokeUser(ctx, userID); err != nil {
+		return httpapi.Error(500, "REVOCATION_ERROR", "Failed to revoke account tokens", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+func main() {
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("failed to initialize database: %v", err)
+	}
+
+	a, err := newApp()
+	if err != nil {
+		log.Fatalf("failed to initialize services: %v", err)
+	}
+
+	lambda.Start(a.handler)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/httpapi"
+)
+
+func deleteRequest(userID string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod: "DELETE",
+		Resource:   "/account",
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: auth.AuthorizerContext(&auth.Claims{UserID: userID}),
+		},
+	}
+}
+
+// TestDeleteAccountFailsClosed checks that deletion refuses to run, rather
+// than deleting rows it cannot shred, when shredding or token revocation is
+// not configured
+func TestDeleteAccountFailsClosed(t *testing.T) {
+	provider := encryption.NewLocalKeyProviderFromSeed(t.Name())
+	revoker := auth.NewRevoker(auth.NewMemoryRevocationStore(), auth.DefaultRevokerConfig)
+
+	tests := []struct {
+		name string
+		app  *app
+	}{
+		{"NoUserKeys", &app{encryptor: encryption.NewEncryptor(provider), revoker: revoker}},
+		{"NoRevocation", &app{encryptor: encryption.NewEncryptor(provider).WithUserKeys(encryption.NewMemoryUserKeyStore())}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID := "6f1c2a8e-3b4d-4c5e-9f60-718293a4b5c6"
+			response, err := tt.app.handler(context.Background(), deleteRequest(userID))
+			if err != nil {
+				t.Fatalf("handler failed: %v", err)
+			}
+			if response.StatusCode != 503 {
+				t.Fatalf("DELETE /account = %d %s, want 503", response.StatusCode, response.Body)
+			}
+
+			var body httpapi.ErrorResponse
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+				t.Fatalf("failed to decode %q: %v", response.Body, err)
+			}
+			if body.Code != "ACCOUNT_DELETION_UNAVAILABLE" {
+				t.Errorf("Code = %q, want ACCOUNT_DELETION_UNAVAILABLE", body.Code)
+			}
+
+			// Nothing was shredded: the user can still seal PHI
+			envelope, err := tt.app.encryptor.NewEnvelope(context.Background(), userID, "record-1")
+			if err != nil {
+				t.Fatalf("NewEnvelope after a refused deletion failed: %v", err)
+			}
+			envelope.Destroy()
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/email"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Rate limits on mailed tokens, per account
+const (
+	passwordResetLimit     = 3
+	verificationEmailLimit = 5
+	accountEmailWindow     = time.Hour
+)
+
+// verifyEmail handles POST /auth/verify-email with the token from a
+// verification email
+func (a *app) verifyEmail(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req AccountTokenRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	err := db.WithTx(ctx, func(tx *sql.Tx) error {
+		userID, err := consumeAccountToken(ctx, tx, req.Token, auth.TokenUseEmailVerification)
+		if err != nil {
+			return err
+		}
+		return db.NewUserRepository(tx).MarkEmailVerified(ctx, userID)
+	})
+	if err == db.ErrNotFound {
+		return httpapi.Error(400, "INVALID_TOKEN", "The verification link is invalid, expired or already used", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to verify email", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// resendVerification handles POST /auth/verify-email/resend for a signed-in
+// user whose address is not verified yet
+func (a *app) resendVerification(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims, err := httpapi.Authenticate(ctx, request)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+	if a.mailer == nil {
+		return httpapi.Error(503, "EMAIL_DISABLED", "Outbound email is not configured", ""), nil
+	}
+
+	user, err := getUser(ctx, db.DB, claims.UserID)
+	if err == db.ErrNotFound {
+		return httpapi.Error(404, "USER_NOT_FOUND", "Email verification is only available for password accounts", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to send verification email", err.Error()), nil
+	}
+	if user.EmailVerifiedAt != nil {
+		return httpapi.Error(409, "EMAIL_ALREADY_VERIFIED", "The email address is already verified", ""), nil
+	}
+
+	// The caller is signed in, so unlike password resets the limit can be
+	// reported without revealing anything
+	sent, err := db.NewAccountTokenRepository(db.DB).CountSince(ctx, user.ID, auth.TokenUseEmailVerification, time.Now().Add(-accountEmailWindow))
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to send verification email", err.Error()), nil
+	}
+	if sent >= verificationEmailLimit {
+		response := httpapi.Error(429, "RATE_LIMITED", "Too many verification emails; try again later", "")
+		response.Headers["Retry-After"] = fmt.Sprint(int(accountEmailWindow.Seconds()))
+		return response, nil
+	}
+
+	if err := a.sendAccountEmail(ctx, user, auth.TokenUseEmailVerification); err != nil {
+		return httpapi.Error(500, "EMAIL_ERROR", "Failed to send verification email", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 202}, nil
+}
+
+// requestPasswordReset handles POST /auth/password-reset/request. It
+// answers 202 whether or not the email has an account, and also when the
+// account's rate limit is exhausted, so it does not reveal which emails are
+// registered.
+func (a *app) requestPasswordReset(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req PasswordResetRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	addr, err := normalizeEmail(req.Email)
+	if err != nil {
+		return httpapi.Error(400, "VALIDATION_ERROR", "A valid email address is required", ""), nil
+	}
+	if a.mailer == nil {
+		return httpapi.Error(503, "EMAIL_DISABLED", "Outbound email is not configured", ""), nil
+	}
+
+	accepted := events.APIGatewayProxyResponse{StatusCode: 202}
+
+	user, err := db.NewUserRepository(db.DB).GetByEmail(ctx, addr)
+	if err == db.ErrNotFound {
+		return accepted, nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to request password reset", err.Error()), nil
+	}
+
+	sent, err := db.NewAccountTokenRepository(db.DB).CountSince(ctx, user.ID, auth.TokenUsePasswordReset, time.Now().Add(-accountEmailWindow))
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to request password reset", err.Error()), nil
+	}
+	if sent >= passwordResetLimit {
+		log.Printf("password reset for %s: rate limited after %d requests", user.ID, sent)
+		return accepted, nil
+	}
+
+	if err := a.sendAccountEmail(ctx, user, auth.TokenUsePasswordReset); err != nil {
+		return httpapi.Error(500, "EMAIL_ERROR", "Failed to request password reset", err.Error()), nil
+	}
+
+	return accepted, nil
+}
+
+// resetPassword handles POST /auth/password-reset. A new password ends
+// every session: all refresh tokens and all access tokens issued so far are
+// revoked, and any other outstanding reset links stop working.
+func (a *app) resetPassword(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req PasswordResetConfirmRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	if msg := validatePassword(req.Password); msg != "" {
+		return httpapi.Error(400, "VALIDATION_ERROR", msg, ""), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), a.bcryptCost)
+	if err != nil {
+		return httpapi.Error(500, "PROCESSING_ERROR", "Failed to hash password", err.Error()), nil
+	}
+
+	revoker, err := auth.DefaultRevoker()
+	if err != nil {
+		return httpapi.Error(500, "REVOCATION_ERROR", "Failed to reset password", err.Error()), nil
+	}
+
+	err = db.WithTx(ctx, func(tx *sql.Tx) error {
+		userID, err := consumeAccountToken(ctx, tx, req.Token, auth.TokenUsePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		if err := db.NewUserRepository(tx).UpdatePassword(ctx, userID, string(hash)); err != nil {
+			return err
+		}
+		// Following the link proved control of the address
+		if err := db.NewUserRepository(tx).MarkEmailVerified(ctx, userID); err != nil {
+			return err
+		}
+		if _, err := db.NewAccountTokenRepository(tx).InvalidateForUser(ctx, userID, auth.TokenUsePasswordReset); err != nil {
+			return err
+		}
+		if _, err := db.NewRefreshTokenRepository(tx).RevokeAllForUser(ctx, userID); err != nil {
+			return err
+		}
+
+		// Revoked before commit: if this fails the password is unchanged,
+		// and if the commit fails the user merely has to log in again
+		if revoker == nil {
+			log.Printf("password reset for %s: token revocation disabled, access tokens stay valid until they expire", userID)
+			return nil
+		}
+		return revoker.RevokeUser(ctx, userID)
+	})
+	if err == db.ErrNotFound {
+		return httpapi.Error(400, "INVALID_TOKEN", "The reset link is invalid, expired or already used", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to reset password", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// consumeAccountToken checks a mailed token's signature and expiry, then
+// uses up its stored hash. It returns the token's user, or ErrNotFound for
+// any invalid token.
+func consumeAccountToken(ctx context.Context, tx db.DBTX, token, use string) (string, error) {
+	claims, err := auth.ValidateAccountToken(token, use)
+	if err != nil {
+		return "", db.ErrNotFound
+	}
+
+	stored, err := db.NewAccountTokenRepository(tx).Consume(ctx, auth.HashAccountToken(token), use)
+	if err != nil {
+		return "", err
+	}
+	if stored.UserID != claims.UserID {
+		return "", db.ErrNotFound
+	}
+
+	return stored.UserID, nil
+}
+
+// sendAccountEmail mails user a new email verification or password reset
+// link
+func (a *app) sendAccountEmail(ctx context.Context, user *models.User, use string) error {
+	ttl, path, subject := auth.EmailVerificationTokenTTL, "/verify-email", "Confirm your email address"
+	intro := "Confirm the email address of your Therma account by opening this link:"
+	if use == auth.TokenUsePasswordReset {
+		ttl, path, subject = auth.PasswordResetTokenTTL, "/reset-password", "Reset your password"
+		intro = "Someone asked to reset the password of your Therma account. If it was you, open this link:"
+	}
+
+	token, err := auth.GenerateAccountToken(user.ID, use, ttl)
+	if err != nil {
+		return err
+	}
+
+	err = db.NewAccountTokenRepository(db.DB).Create(ctx, &models.AccountToken{
+		UserID:    user.ID,
+		Purpose:   use,
+		TokenHash: auth.HashAccountToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := a.appBaseURL + path + "?token=" + url.QueryEscape(token)
+	return a.mailer.Send(ctx, email.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body: fmt.Sprintf("%s\n\n%s\n\nThe link expires in %s and works once. If you did not ask for this, ignore this email.\n",
+			intro, link, formatTTL(ttl)),
+	})
+}
+
+func formatTTL(ttl time.Duration) string {
+	if ttl%time.Hour == 0 {
+		if ttl == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", int(ttl.Hours()))
+	}
+	return fmt.Sprintf("%d minutes", int(ttl.Minutes()))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordBytes  = 72 // bcrypt ignores anything longer
+)
+
+// signup handles POST /auth/signup
+func (a *app) signup(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req SignupRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	email, err := normalizeEmail(req.Email)
+	if err != nil {
+		return httpapi.Error(400, "VALIDATION_ERROR", "A valid email address is required", ""), nil
+	}
+	if msg := validatePassword(req.Password); msg != "" {
+		return httpapi.Error(400, "VALIDATION_ERROR", msg, ""), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), a.bcryptCost)
+	if err != nil {
+		return httpapi.Error(500, "PROCESSING_ERROR", "Failed to hash password", err.Error()), nil
+	}
+
+	user := &models.User{Email: email, Password: string(hash)}
+	var refreshToken string
+	err = db.WithTx(ctx, func(tx *sql.Tx) error {
+		if err := db.NewUserRepository(tx).Create(ctx, user); err != nil {
+			return err
+		}
+		refreshToken, err = a.issueRefreshToken(ctx, tx, user.ID, nil)
+		return err
+	})
+	if err == db.ErrEmailTaken {
+		return httpapi.Error(409, "EMAIL_TAKEN", "An account with this email already exists", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to create account", err.Error()), nil
+	}
+
+	// The account works before the address is verified; a failed email can
+	// be retried through /auth/verify-email/resend
+	if a.mailer != nil {
+		if err := a.sendAccountEmail(ctx, user, auth.TokenUseEmailVerification); err != nil {
+			log.Printf("signup for %s: failed to send verification email: %v", user.ID, err)
+		}
+	}
+
+	return a.tokenResponse(201, user, refreshToken)
+}
+
+// login handles POST /auth/login. Unknown emails and wrong passwords get the
+// same response after the same bcrypt work, so callers cannot tell whether
+// an account exists.
+func (a *app) login(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req LoginRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	email, emailErr := normalizeEmail(req.Email)
+
+	var user *models.User
+	var err error
+	if emailErr == nil {
+		user, err = db.NewUserRepository(db.DB).GetByEmail(ctx, email)
+		if err != nil && err != db.ErrNotFound {
+			return httpapi.Error(500, "DATABASE_ERROR", "Failed to log in", err.Error()), nil
+		}
+	}
+
+	hash := a.dummyHash
+	if user != nil {
+		hash = []byte(user.Password)
+	}
+
+	// Always run bcrypt, even without a user, so timing does not leak existence
+	passwordOK := bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) == nil
+	if user == nil || !passwordOK {
+		return httpapi.Error(401, "INVALID_CREDENTIALS", "Invalid email or password", ""), nil
+	}
+
+	// Users with MFA, and clinicians who have yet to enroll, get an
+	// mfa_pending token instead and finish at /auth/mfa/*
+	mfa, err := db.NewUserMFARepository(db.DB).Get(ctx, user.ID)
+	if err != nil && err != db.ErrNotFound {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to log in", err.Error()), nil
+	}
+	mfaEnabled := mfa != nil && mfa.EnabledAt != nil
+	if mfaEnabled || user.Role == string(auth.RoleClinician) {
+		return a.mfaRequiredResponse(user, !mfaEnabled)
+	}
+
+	refreshToken, err := a.issueRefreshToken(ctx, db.DB, user.ID, nil)
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to log in", err.Error()), nil
+	}
+
+	return a.tokenResponse(200, user, refreshToken)
+}
+
+func userResponse(user *models.User) *UserResponse {
+	return &UserResponse{
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerifiedAt != nil,
+		Role:          user.Role,
+		CreatedAt:     user.CreatedAt,
+	}
+}
+
+// validatePassword returns why password is unacceptable, or "" if it is fine
+func validatePassword(password string) string {
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Sprintf("Password must be at least %d characters", minPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes)
+	}
+	return ""
+}
+
+// normalizeEmail validates a bare address and lowercases it, so uniqueness
+// and lookups are case-insensitive
+func normalizeEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw || len(raw) > 255 {
+		return "", fmt.Errorf("invalid email address")
+	}
+	return strings.ToLower(raw), nil
+}
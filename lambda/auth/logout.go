@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/httpapi"
+)
+
+// logout handles POST /auth/logout. The presented access token is revoked
+// and, if the body names this session's refresh token, its family too.
+func (a *app) logout(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims, err := httpapi.Authenticate(ctx, request)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+
+	var req LogoutRequest
+	if request.Body != "" {
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+		}
+	}
+
+	// Only users with a users row, and so a UUID, have refresh tokens
+	if req.RefreshToken != "" && db.IsUUID(claims.UserID) {
+		_, err := db.NewRefreshTokenRepository(db.DB).RevokeFamilyOf(ctx, claims.UserID, auth.HashRefreshToken(req.RefreshToken))
+		if err != nil {
+			return httpapi.Error(500, "DATABASE_ERROR", "Failed to revoke refresh token", err.Error()), nil
+		}
+	}
+
+	revoker, err := auth.DefaultRevoker()
+	if err != nil {
+		return httpapi.Error(500, "REVOCATION_ERROR", "Failed to revoke token", err.Error()), nil
+	}
+	if revoker == nil {
+		log.Printf("logout for %s: token revocation disabled, access token stays valid until it expires", claims.UserID)
+		return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+	}
+
+	if err := revoker.RevokeToken(ctx, claims); err != nil {
+		return httpapi.Error(500, "REVOCATION_ERROR", "Failed to revoke token", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// logoutAll handles POST /auth/logout-all, for a lost device or a
+// compromised account: every access token issued to the user so far and
+// every refresh token stop working
+func (a *app) logoutAll(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims, err := httpapi.Authenticate(ctx, request)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+
+	var revoked int64
+	if db.IsUUID(claims.UserID) {
+		revoked, err = db.NewRefreshTokenRepository(db.DB).RevokeAllForUser(ctx, claims.UserID)
+		if err != nil {
+			return httpapi.Error(500, "DATABASE_ERROR", "Failed to revoke refresh tokens", err.Error()), nil
+		}
+	}
+
+	revoker, err := auth.DefaultRevoker()
+	if err != nil {
+		return httpapi.Error(500, "REVOCATION_ERROR", "Failed to revoke tokens", err.Error()), nil
+	}
+	if revoker == nil {
+		log.Printf("logout-all for %s: revoked %d refresh tokens; token revocation disabled, access tokens stay valid until they expire",
+			claims.UserID, revoked)
+		return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+	}
+
+	if err := revoker.RevokeUser(ctx, claims.UserID); err != nil {
+		return httpapi.Error(500, "REVOCATION_ERROR", "Failed to revoke tokens", err.Error()), nil
+	}
+
+	log.Printf("logout-all for %s: revoked %d refresh tokens and all access tokens", claims.UserID, revoked)
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
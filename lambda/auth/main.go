@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/email"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type SignupRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// AccountTokenRequest carries the token from an email verification link
+type AccountTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type UserResponse struct {
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type TokenResponse struct {
+	AccessToken           string        `json:"access_token"`
+	TokenType             string        `json:"token_type"`
+	ExpiresIn             int64         `json:"expires_in"` // seconds
+	RefreshToken          string        `json:"refresh_token"`
+	RefreshTokenExpiresIn int64         `json:"refresh_token_expires_in"` // seconds
+	User                  *UserResponse `json:"user,omitempty"`
+}
+
+// MFARequiredResponse is returned by login instead of tokens to users who
+// must pass MFA. MFAToken authenticates /auth/mfa/challenge, or
+// /auth/mfa/enroll and /auth/mfa/activate if MFAEnrollmentRequired.
+type MFARequiredResponse struct {
+	MFARequired           bool   `json:"mfa_required"`
+	MFAEnrollmentRequired bool   `json:"mfa_enrollment_required"`
+	MFAToken              string `json:"mfa_token"`
+	ExpiresIn             int64  `json:"expires_in"` // seconds
+}
+
+type MFAEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type MFAChallengeRequest struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// MFAActivateResponse carries the tokens too when activation completes a
+// login
+type MFAActivateResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+	*TokenResponse
+}
+
+// app holds the state shared by every request served by a warm Lambda
+type app struct {
+	bcryptCost int
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	encryptor  encryption.Encryptor // seals TOTP secrets
+	totpIssuer string               // shown by authenticator apps
+	mailer     email.Mailer         // nil when outbound email is disabled
+	appBaseURL string               // where links in emails point
+
+	// dummyHash is compared against when a login names an unknown email, so
+	// the response takes as long as for a wrong password
+	dummyHash []byte
+}
+
+func newApp() (*app, error) {
+	cost := bcrypt.DefaultCost
+	if raw := os.Getenv("BCRYPT_COST"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+			return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		cost = n
+	}
+
+	accessTTL, err := time.ParseDuration(os.Getenv("JWT_TTL"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT_TTL: %v", err)
+	}
+
+	refreshTTL, err := auth.RefreshTokenTTL()
+	if err != nil {
+		return nil, err
+	}
+
+	dummyHash, err := bcrypt.GenerateFromPassword([]byte("therma-dummy-password"), cost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate dummy hash: %v", err)
+	}
+
+	encryptor, err := encryption.NewEncryptorFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize encryption service: %v", err)
+	}
+
+	totpIssuer := os.Getenv("TOTP_ISSUER")
+	if totpIssuer == "" {
+		totpIssuer = "Therma"
+	}
+
+	mailer, err := email.NewMailerFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize mailer: %v", err)
+	}
+	appBaseURL := strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/")
+	if mailer != nil && appBaseURL == "" {
+		return nil, fmt.Errorf("APP_BASE_URL is required when MAILER is set")
+	}
+
+	return &app{
+		bcryptCost: cost,
+		accessTTL:  accessTTL,
+		refreshTTL: refreshTTL,
+		encryptor:  encryptor,
+		totpIssuer: totpIssuer,
+		mailer:     mailer,
+		appBaseURL: appBaseURL,
+		dummyHash:  dummyHash,
+	}, nil
+}
+
+// handler routes /auth/* requests
+func (a *app) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/signup":
+		return a.signup(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/login":
+		return a.login(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/refresh":
+		return a.refresh(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/logout":
+		return a.logout(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/logout-all":
+		return a.logoutAll(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/mfa/enroll":
+		return a.mfaEnroll(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/mfa/activate":
+		return a.mfaActivate(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/mfa/challenge":
+		return a.mfaChallenge(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/verify-email":
+		return a.verifyEmail(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/verify-email/resend":
+		return a.resendVerification(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/password-reset/request":
+		return a.requestPasswordReset(ctx, request)
+	case request.HTTPMethod == "POST" && request.Resource == "/auth/password-reset":
+		return a.resetPassword(ctx, request)
+	}
+
+	return httpapi.Error(405, "METHOD_NOT_ALLOWED",
+		fmt.Sprintf("%s is not supported on %s", request.HTTPMethod, request.Resource), ""), nil
+}
+
+// getUser returns the users row of userID, taken from a token. Users that
+// only ever authenticated with a token may have IDs that are not UUIDs;
+// they have no row and get ErrNotFound.
+func getUser(ctx context.Context, q db.DBTX, userID string) (*models.User, error) {
+	if !db.IsUUID(userID) {
+		return nil, db.ErrNotFound
+	}
+	return db.NewUserRepository(q).GetByID(ctx, userID)
+}
+
+// createJSONResponse is httpapi.JSON for responses that may carry tokens,
+// which must not be cached
+func createJSONResponse(statusCode int, body interface{}) events.APIGatewayProxyResponse {
+	response := httpapi.JSON(statusCode, body)
+	response.Headers["Cache-Control"] = "no-store"
+	return response
+}
+
+func main() {
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("failed to initialize database: %v", err)
+	}
+
+	a, err := newApp()
+	if err != nil {
+		log.Fatalf("failed to initialize services: %v", err)
+	}
+
+	lambda.Start(a.handler)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+)
+
+const (
+	recoveryCodeCount = 10
+
+	// mfaMaxAttempts wrong codes in a row lock MFA for mfaLockout, so the
+	// million possible codes cannot be guessed within a pending token's life
+	mfaMaxAttempts = 5
+	mfaLockout     = 15 * time.Minute
+)
+
+// mfaRequiredResponse is what login returns instead of tokens when the user
+// has to pass MFA first
+func (a *app) mfaRequiredResponse(user *models.User, enrollmentRequired bool) (events.APIGatewayProxyResponse, error) {
+	token, err := auth.GenerateMFAPendingToken(user.ID)
+	if err != nil {
+		return httpapi.Error(500, "TOKEN_ERROR", "Failed to issue token", err.Error()), nil
+	}
+
+	return createJSONResponse(200, MFARequiredResponse{
+		MFARequired:           true,
+		MFAEnrollmentRequired: enrollmentRequired,
+		MFAToken:              token,
+		ExpiresIn:             int64(auth.MFAPendingTokenTTL.Seconds()),
+	}), nil
+}
+
+// mfaEnroll handles POST /auth/mfa/enroll. It generates a new TOTP secret
+// for the caller, to be confirmed through /auth/mfa/activate; until then an
+// earlier unfinished enrollment is simply replaced.
+func (a *app) mfaEnroll(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims, _, err := mfaCaller(request)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+
+	user, err := getUser(ctx, db.DB, claims.UserID)
+	if err == db.ErrNotFound {
+		return httpapi.Error(404, "USER_NOT_FOUND", "MFA is only available for password accounts", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to enroll MFA", err.Error()), nil
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return httpapi.Error(500, "PROCESSING_ERROR", "Failed to enroll MFA", err.Error()), nil
+	}
+
+	mfa := &models.UserMFA{UserID: user.ID}
+	if err := a.sealMFASecret(ctx, mfa, secret); err != nil {
+		return httpapi.Error(500, "ENCRYPTION_ERROR", "Failed to enroll MFA", err.Error()), nil
+	}
+
+	err = db.NewUserMFARepository(db.DB).Enroll(ctx, mfa)
+	if err == db.ErrConflict {
+		return httpapi.Error(409, "MFA_ALREADY_ENABLED", "MFA is already enabled for this account", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to enroll MFA", err.Error()), nil
+	}
+
+	return createJSONResponse(201, MFAEnrollResponse{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(a.totpIssuer, user.Email, secret),
+	}), nil
+}
+
+// mfaActivate handles POST /auth/mfa/activate. The first valid code from
+// the enrolled secret enables MFA and returns the recovery codes, which are
+// shown only this once. Callers holding an mfa_pending token also get their
+// tokens, completing the login that required enrollment.
+func (a *app) mfaActivate(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	claims, pending, err := mfaCaller(request)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+
+	var req MFACodeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+	if req.Code == "" {
+		return httpapi.Error(400, "VALIDATION_ERROR", "code is required", ""), nil
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return httpapi.Error(500, "PROCESSING_ERROR", "Failed to activate MFA", err.Error()), nil
+	}
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+
+	var result mfaResult
+	err = db.WithTx(ctx, func(tx *sql.Tx) error {
+		repo := db.NewUserMFARepository(tx)
+		mfa, err := repo.GetForUpdate(ctx, claims.UserID)
+		if err != nil {
+			return err
+		}
+		if mfa.EnabledAt != nil {
+			return db.ErrConflict
+		}
+		if pending && pendingTokenUsed(mfa, claims) {
+			return errMFATokenUsed
+		}
+
+		result, err = a.verifyTOTP(ctx, repo, mfa, req.Code)
+		if err != nil || !result.verified {
+			return err
+		}
+		if err := repo.Enable(ctx, claims.UserID, result.step, hashes); err != nil {
+			return err
+		}
+		if pending {
+			return completePendingLogin(ctx, repo, claims)
+		}
+		return nil
+	})
+	if err == errMFATokenUsed {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or expired MFA token", err.Error()), nil
+	}
+	if err == db.ErrNotFound {
+		return httpapi.Error(400, "MFA_NOT_ENROLLED", "Enroll through /auth/mfa/enroll first", ""), nil
+	}
+	if err == db.ErrConflict {
+		return httpapi.Error(409, "MFA_ALREADY_ENABLED", "MFA is already enabled for this account", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to activate MFA", err.Error()), nil
+	}
+	if !result.verified {
+		return result.failureResponse(), nil
+	}
+
+	response := MFAActivateResponse{RecoveryCodes: recoveryCodes}
+	if !pending {
+		return createJSONResponse(200, response), nil
+	}
+
+	tokens, err := a.completeMFALogin(ctx, claims)
+	if err != nil {
+		return httpapi.Error(500, "TOKEN_ERROR", "Failed to issue token", err.Error()), nil
+	}
+	response.TokenResponse = tokens
+	return createJSONResponse(200, response), nil
+}
+
+// mfaChallenge handles POST /auth/mfa/challenge, exchanging an mfa_pending
+// token and a TOTP or recovery code for the tokens login withheld
+func (a *app) mfaChallenge(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	token, err := auth.BearerToken(request.Headers)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
+	}
+	claims, err := auth.ValidateMFAPendingToken(token)
+	if err != nil {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or expired MFA token", err.Error()), nil
+	}
+
+	var req MFAChallengeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		return httpapi.Error(400, "VALIDATION_ERROR", "Exactly one of code and recovery_code is required", ""), nil
+	}
+
+	var result mfaResult
+	err = db.WithTx(ctx, func(tx *sql.Tx) error {
+		repo := db.NewUserMFARepository(tx)
+		mfa, err := repo.GetForUpdate(ctx, claims.UserID)
+		if err != nil {
+			return err
+		}
+		if mfa.EnabledAt == nil {
+			return db.ErrNotFound
+		}
+		if pendingTokenUsed(mfa, claims) {
+			return errMFATokenUsed
+		}
+
+		if req.RecoveryCode != "" {
+			result, err = a.verifyRecoveryCode(ctx, repo, mfa, req.RecoveryCode)
+		} else {
+			result, err = a.verifyTOTP(ctx, repo, mfa, req.Code)
+			if err == nil && result.verified {
+				err = repo.RecordSuccess(ctx, claims.UserID, result.step)
+			}
+		}
+		if err != nil || !result.verified {
+			return err
+		}
+		return completePendingLogin(ctx, repo, claims)
+	})
+	if err == errMFATokenUsed {
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or expired MFA token", err.Error()), nil
+	}
+	if err == db.ErrNotFound {
+		return httpapi.Error(400, "MFA_NOT_ENABLED", "MFA is not enabled; enroll through /auth/mfa/enroll", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to verify MFA code", err.Error()), nil
+	}
+	if !result.verified {
+		return result.failureResponse(), nil
+	}
+
+	tokens, err := a.completeMFALogin(ctx, claims)
+	if err != nil {
+		return httpapi.Error(500, "TOKEN_ERROR", "Failed to issue token", err.Error()), nil
+	}
+	if req.RecoveryCode != "" {
+		log.Printf("mfa challenge for %s passed with a recovery code, %d left", claims.UserID, result.recoveryCodesLeft)
+	}
+	return createJSONResponse(200, tokens), nil
+}
+
+// mfaResult is the outcome of checking a code. Failures are recorded in the
+// same transaction, so they are committed rather than returned as errors.
+type mfaResult struct {
+	verified          bool
+	step              int64
+	lockedUntil       time.Time // set if MFA is locked
+	recoveryCodesLeft int
+}
+
+func (r mfaResult) failureResponse() events.APIGatewayProxyResponse {
+	if !r.lockedUntil.IsZero() {
+		response := httpapi.Error(429, "MFA_LOCKED", "Too many invalid codes; try again later", "")
+		retryAfter := int(time.Until(r.lockedUntil).Seconds()) + 1
+		response.Headers["Retry-After"] = strconv.Itoa(retryAfter)
+		return response
+	}
+	return httpapi.Error(401, "INVALID_MFA_CODE", "Invalid MFA code", "")
+}
+
+// verifyTOTP checks code against the user's secret, enforcing the lockout
+// and counting a wrong code as a failed attempt
+func (a *app) verifyTOTP(ctx context.Context, repo *db.UserMFARepository, mfa *models.UserMFA, code string) (mfaResult, error) {
+	if locked := lockedUntil(mfa); !locked.IsZero() {
+		return mfaResult{lockedUntil: locked}, nil
+	}
+
+	secret, err := a.openMFASecret(ctx, mfa)
+	if err != nil {
+		return mfaResult{}, err
+	}
+
+	step, ok := auth.ValidateTOTP(secret, code, time.Now(), mfa.LastUsedStep)
+	if !ok {
+		return mfaResult{}, repo.RecordFailure(ctx, mfa.UserID, mfaMaxAttempts, mfaLockout)
+	}
+	return mfaResult{verified: true, step: step}, nil
+}
+
+// verifyRecoveryCode consumes a recovery code, enforcing the same lockout as
+// TOTP codes
+func (a *app) verifyRecoveryCode(ctx context.Context, repo *db.UserMFARepository, mfa *models.UserMFA, code string) (mfaResult, error) {
+	if locked := lockedUntil(mfa); !locked.IsZero() {
+		return mfaResult{lockedUntil: locked}, nil
+	}
+
+	err := repo.UseRecoveryCode(ctx, mfa.UserID, auth.HashRecoveryCode(code))
+	if err == db.ErrNotFound {
+		return mfaResult{}, repo.RecordFailure(ctx, mfa.UserID, mfaMaxAttempts, mfaLockout)
+	}
+	if err != nil {
+		return mfaResult{}, err
+	}
+	return mfaResult{verified: true, recoveryCodesLeft: len(mfa.RecoveryCodeHashes) - 1}, nil
+}
+
+func lockedUntil(mfa *models.UserMFA) time.Time {
+	if mfa.LockedUntil != nil && mfa.LockedUntil.After(time.Now()) {
+		return *mfa.LockedUntil
+	}
+	return time.Time{}
+}
+
+// errMFATokenUsed is returned for an mfa_pending token that already
+// completed its login
+var errMFATokenUsed = errors.New("MFA token has already been used")
+
+// pendingTokenUsed reports whether the mfa_pending token with claims already
+// completed a login. mfa must be locked by the caller's transaction.
+func pendingTokenUsed(mfa *models.UserMFA, claims *auth.Claims) bool {
+	return claims.ID == "" || mfa.LastPendingJTI == claims.ID
+}
+
+// completePendingLogin marks the mfa_pending token with claims as used, in
+// the transaction that accepted its code, so it cannot be exchanged again
+// whether or not token revocation is configured
+func completePendingLogin(ctx context.Context, repo *db.UserMFARepository, claims *auth.Claims) error {
+	err := repo.CompletePendingLogin(ctx, claims.UserID, claims.ID)
+	if err == db.ErrConflict {
+		return errMFATokenUsed
+	}
+	return err
+}
+
+// completeMFALogin issues the tokens for a passed MFA check, after
+// completePendingLogin used up the mfa_pending token
+func (a *app) completeMFALogin(ctx context.Context, claims *auth.Claims) (*TokenResponse, error) {
+	user, err := getUser(ctx, db.DB, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := a.issueRefreshToken(ctx, db.DB, user.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.newTokenResponse(user, refreshToken)
+}
+
+// mfaCaller identifies the caller of the enrollment endpoints: a user
+// completing a login with an mfa_pending token, or a signed-in user adding
+// MFA with an access token. pending reports which.
+func mfaCaller(request events.APIGatewayProxyRequest) (claims *auth.Claims, pending bool, err error) {
+	token, err := auth.BearerToken(request.Headers)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if claims, err := auth.ValidateMFAPendingToken(token); err == nil {
+		return claims, true, nil
+	}
+
+	claims, err = auth.ValidateToken(token)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid token: %v", err)
+	}
+	if !db.IsUUID(claims.UserID) {
+		// Only password accounts, which have UUIDs, can add MFA
+		return nil, false, fmt.Errorf("MFA is only available for password accounts")
+	}
+	return claims, false, nil
+}
+
+// sealMFASecret encrypts the TOTP secret into mfa under a data key bound to
+// the user
+func (a *app) sealMFASecret(ctx context.Context, mfa *models.UserMFA, secret string) error {
+	envelope, err := a.encryptor.NewEnvelope(ctx, mfa.UserID, mfa.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to create data key: %v", err)
+	}
+	defer envelope.Destroy()
+
+	if mfa.Secret, err = envelope.Seal(models.UserMFAFieldSecret, secret); err != nil {
+		return fmt.Errorf("failed to encrypt TOTP secret: %v", err)
+	}
+
+	mfa.DataKey = envelope.WrappedKey()
+	mfa.KeyID = envelope.KeyID()
+	return nil
+}
+
+func (a *app) openMFASecret(ctx context.Context, mfa *models.UserMFA) (string, error) {
+	opener := a.encryptor.OpenRecord(mfa.UserID, mfa.UserID, mfa.DataKey)
+	defer opener.Close()
+
+	secret, err := opener.Open(ctx, models.UserMFAFieldSecret, mfa.Secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %v", err)
+	}
+	return secret, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+)
+
+// refresh handles POST /auth/refresh. The presented token is used up and
+// replaced by a new one in the same family. A token presented a second time
+// means it was copied, so the whole family is revoked and both the attacker
+// and the legitimate client must log in again.
+func (a *app) refresh(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req RefreshRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+	if req.RefreshToken == "" {
+		return httpapi.Error(400, "VALIDATION_ERROR", "refresh_token is required", ""), nil
+	}
+
+	var user *models.User
+	var refreshToken, rejected string
+	err := db.WithTx(ctx, func(tx *sql.Tx) error {
+		repo := db.NewRefreshTokenRepository(tx)
+
+		current, err := repo.GetByHashForUpdate(ctx, auth.HashRefreshToken(req.RefreshToken))
+		if err == db.ErrNotFound {
+			rejected = "INVALID_REFRESH_TOKEN"
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case current.RevokedAt != nil, !time.Now().Before(current.ExpiresAt):
+			rejected = "INVALID_REFRESH_TOKEN"
+			return nil
+		case current.UsedAt != nil:
+			// Commit the revocation even though the request fails
+			revoked, err := repo.RevokeFamily(ctx, current.FamilyID)
+			if err != nil {
+				return err
+			}
+			log.Printf("refresh token reuse for user %s: revoked family %s (%d live tokens)",
+				current.UserID, current.FamilyID, revoked)
+			rejected = "REFRESH_TOKEN_REUSED"
+			return nil
+		}
+
+		if err := repo.MarkUsed(ctx, current.ID); err != nil {
+			return err
+		}
+
+		// Re-read the user so role changes apply from the next refresh
+		user, err = db.NewUserRepository(tx).GetByID(ctx, current.UserID)
+		if err != nil {
+			return err
+		}
+
+		refreshToken, err = a.issueRefreshToken(ctx, tx, current.UserID, current)
+		return err
+	})
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to refresh token", err.Error()), nil
+	}
+
+	switch rejected {
+	case "INVALID_REFRESH_TOKEN":
+		return httpapi.Error(401, rejected, "Refresh token is invalid or expired", ""), nil
+	case "REFRESH_TOKEN_REUSED":
+		return httpapi.Error(401, rejected, "Refresh token was already used; log in again", ""), nil
+	}
+
+	return a.tokenResponse(200, user, refreshToken)
+}
+
+// issueRefreshToken stores a new refresh token for userID and returns it.
+// With a parent the token joins the parent's family, otherwise it starts a
+// new one.
+func (a *app) issueRefreshToken(ctx context.Context, tx db.DBTX, userID string, parent *models.RefreshToken) (string, error) {
+	token, tokenHash, err := auth.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	record := &models.RefreshToken{
+		UserID:    userID,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(a.refreshTTL),
+	}
+	if parent != nil {
+		record.FamilyID = parent.FamilyID
+		record.ParentID = parent.ID
+	}
+
+	if err := db.NewRefreshTokenRepository(tx).Create(ctx, record); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (a *app) tokenResponse(statusCode int, user *models.User, refreshToken string) (events.APIGatewayProxyResponse, error) {
+	response, err := a.newTokenResponse(user, refreshToken)
+	if err != nil {
+		return httpapi.Error(500, "TOKEN_ERROR", "Failed to issue token", err.Error()), nil
+	}
+
+	return createJSONResponse(statusCode, response), nil
+}
+
+// newTokenResponse issues an access token for user alongside refreshToken
+func (a *app) newTokenResponse(user *models.User, refreshToken string) (*TokenResponse, error) {
+	token, err := auth.GenerateToken(user.ID, auth.WithRoles(user.Role))
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:           token,
+		TokenType:             "Bearer",
+		ExpiresIn:             int64(a.accessTTL.Seconds()),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresIn: int64(a.refreshTTL.Seconds()),
+		User:                  userResponse(user),
+	}, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/awsbackend/internal/auth"
+)
+
+// authorizerRequest is either a TOKEN authorizer event, which carries the
+// Authorization header as authorizationToken, or a REQUEST authorizer
+// event, which carries all headers
+type authorizerRequest struct {
+	Type               string            `json:"type"`
+	AuthorizationToken string            `json:"authorizationToken"`
+	MethodArn          string            `json:"methodArn"`
+	Headers            map[string]string `json:"headers"`
+}
+
+// errUnauthorized is the exact error API Gateway turns into a 401; any
+// other error becomes a 500
+var errUnauthorized = errors.New("Unauthorized")
+
+// handler validates the caller's token with auth.ValidateToken and allows
+// the whole API for it, passing the principal to the business Lambdas in
+// the context map (see auth.AuthorizerContext).
+//
+// The policy covers every method, not just MethodArn, because API Gateway
+// caches it per token and reuses it for the token's other requests.
+// Permissions are checked by the handlers, which also recheck revocation.
+func handler(ctx context.Context, request authorizerRequest) (events.APIGatewayCustomAuthorizerResponse, error) {
+	token := request.AuthorizationToken
+	if request.Type == "REQUEST" {
+		token = ""
+		if headerToken, err := auth.BearerToken(request.Headers); err == nil {
+			token = headerToken
+		}
+	} else if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = token[7:]
+	}
+	if token == "" {
+		return events.APIGatewayCustomAuthorizerResponse{}, errUnauthorized
+	}
+
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		log.Printf("authorizer: rejected token: %v", err)
+		return events.APIGatewayCustomAuthorizerResponse{}, errUnauthorized
+	}
+
+	return events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: claims.UserID,
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{
+				{
+					Action:   []string{"execute-api:Invoke"},
+					Effect:   "Allow",
+					Resource: []string{apiWildcardArn(request.MethodArn)},
+				},
+			},
+		},
+		Context: auth.AuthorizerContext(claims),
+	}, nil
+}
+
+// apiWildcardArn turns the ARN of one method,
+// arn:aws:execute-api:region:account:api/stage/VERB/path, into the ARN of
+// every method of the same API and stage
+func apiWildcardArn(methodArn string) string {
+	parts := strings.SplitN(methodArn, "/", 3)
+	if len(parts) < 2 {
+		return methodArn
+	}
+	return parts[0] + "/" + parts[1] + "/*/*"
+}
+
+func main() {
+	lambda.Start(handler)
+}
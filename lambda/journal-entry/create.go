@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/llm"
+	"github.com/awsbackend/internal/models"
+)
+
+// createEntry handles POST /journal-entries
+func (a *app) createEntry(ctx context.Context, userID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Parse request body
+	var req JournalEntryRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	// Validate required fields
+	if req.Content == "" {
+		return httpapi.Error(400, "VALIDATION_ERROR", "Content is required", ""), nil
+	}
+
+	// Idempotency is applied around the whole handler by a.idempotency; with
+	// a Postgres store ctx carries its transaction, which a.withTx joins
+	entry, err := a.processJournalEntry(ctx, userID, req)
+	if err != nil {
+		return httpapi.Error(500, "PROCESSING_ERROR", "Failed to process journal entry", err.Error()), nil
+	}
+
+	response := httpapi.JSON(201, entry)
+	response.Headers["Location"] = "/journal-entries/" + entry.ID
+	return response, nil
+}
+
+// processJournalEntry seals and saves a new entry
+func (a *app) processJournalEntry(ctx context.Context, userID string, req JournalEntryRequest) (*CreateJournalEntryResponse, error) {
+	// Check LLM cost limits before processing
+	estimatedCost := llm.EstimateLLMCost(len(req.Content), 100, "anthropic.claude-3-sonnet-20240229-v1:0")
+	costCheck, err := a.costControl.CheckUserSpendLimit(ctx, userID, estimatedCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check cost limits: %v", err)
+	}
+
+	now := time.Now().UTC()
+	entry := &models.JournalEntry{
+		ID:        generateID(),
+		UserID:    userID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	// Encrypt PHI data
+	if err := a.sealEntry(ctx, entry, req.Content, req.Mood, req.Tags); err != nil {
+		return nil, err
+	}
+
+	// Persist the encrypted entry; only ciphertext ever reaches the database
+	err = a.withTx(ctx, func(ctx context.Context) error {
+		return a.entries(ctx).Create(ctx, entry)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to save journal entry: %v", err)
+	}
+
+	response := &CreateJournalEntryResponse{
+		ID:        entry.ID,
+		UserID:    entry.UserID,
+		CreatedAt: entry.CreatedAt,
+		UpdatedAt: entry.UpdatedAt,
+		Encrypted: entry.Encrypted,
+	}
+
+	if !costCheck.Allowed {
+		// Graceful degradation: the entry is saved, but we skip LLM processing.
+		// In a real implementation, you might also:
+		// 1. Use a cheaper model
+		// 2. Return cached/summarized content
+		// 3. Suggest user upgrade
+		// 4. Queue for later processing
+		return response, nil
+	}
+
+	// Record the LLM cost (even though we didn't use LLM in this example)
+	err = a.costControl.RecordLLMRequest(ctx, userID, estimatedCost)
+	if err != nil {
+		// Log error but don't fail the request
+		fmt.Printf("Warning: failed to record LLM cost: %v\n", err)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/models"
+)
+
+// sealEntry encrypts the plaintext fields into entry under a data key bound
+// to the entry's owner, with every field bound to the entry's ID
+func (a *app) sealEntry(ctx context.Context, entry *models.JournalEntry, content, mood string, tags []string) error {
+	envelope, err := a.encryptor.NewEnvelope(ctx, entry.UserID, entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create data key: %v", err)
+	}
+	defer envelope.Destroy()
+
+	if entry.Content, err = envelope.Seal(models.JournalEntryFieldContent, content); err != nil {
+		return fmt.Errorf("failed to encrypt content: %v", err)
+	}
+
+	if entry.Mood, err = envelope.Seal(models.JournalEntryFieldMood, mood); err != nil {
+		return fmt.Errorf("failed to encrypt mood: %v", err)
+	}
+
+	if entry.Tags, err = envelope.SealArray(models.JournalEntryFieldTags, tags); err != nil {
+		return fmt.Errorf("failed to encrypt tags: %v", err)
+	}
+
+	// Blind indexes are computed from the plaintext next to the ciphertext
+	entry.MoodIndex, entry.TagIndexes = "", []string{}
+	if a.blindIndex != nil {
+		entry.MoodIndex = a.blindIndex.Token(entry.UserID, models.JournalEntryFieldMood, mood)
+		entry.TagIndexes = a.blindIndex.Tokens(entry.UserID, models.JournalEntryFieldTags, tags)
+	}
+
+	entry.DataKey = envelope.WrappedKey()
+	entry.KeyID = envelope.KeyID()
+	entry.Encrypted = true
+	return nil
+}
+
+// decryptEntry turns a stored entry into a plaintext response for its owner
+func (a *app) decryptEntry(ctx context.Context, entry *models.JournalEntry) (*JournalEntryResponse, error) {
+	opener := a.encryptor.OpenRecord(entry.UserID, entry.ID, entry.DataKey)
+	defer opener.Close()
+
+	content, err := opener.Open(ctx, models.JournalEntryFieldContent, entry.Content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content: %v", err)
+	}
+
+	mood, err := opener.Open(ctx, models.JournalEntryFieldMood, entry.Mood)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt mood: %v", err)
+	}
+
+	tags, err := opener.OpenArray(ctx, models.JournalEntryFieldTags, entry.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt tags: %v", err)
+	}
+
+	return &JournalEntryResponse{
+		ID:        entry.ID,
+		UserID:    entry.UserID,
+		Content:   content,
+		Mood:      mood,
+		Tags:      tags,
+		CreatedAt: entry.CreatedAt,
+		UpdatedAt: entry.UpdatedAt,
+		Encrypted: entry.Encrypted,
+	}, nil
+}
+
+// logCacheStats logs the cumulative data key cache counters of this warm
+// Lambda, so hit rate and evictions can be graphed from CloudWatch Logs
+func (a *app) logCacheStats() {
+	cached, ok := a.encryptor.(interface {
+		CacheStats() (encryption.CacheStats, bool)
+	})
+	if !ok {
+		return
+	}
+
+	stats, ok := cached.CacheStats()
+	if !ok {
+		return
+	}
+
+	log.Printf("data key cache: hits=%d misses=%d evictions=%d entries=%d",
+		stats.Hits, stats.Misses, stats.Evictions, stats.Entries)
+}
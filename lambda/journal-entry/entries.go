@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	maxTagFilters   = 10
+)
+
+// getEntry handles GET /journal-entries/{id}
+func (a *app) getEntry(ctx context.Context, userID, entryID string) (events.APIGatewayProxyResponse, error) {
+	entry, err := a.entries(ctx).GetByID(ctx, userID, entryID)
+	if err == db.ErrNotFound {
+		return httpapi.Error(404, "NOT_FOUND", "Journal entry not found", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to load journal entry", err.Error()), nil
+	}
+
+	response, err := a.decryptEntry(ctx, entry)
+	if err != nil {
+		return httpapi.Error(500, "DECRYPTION_ERROR", "Failed to decrypt journal entry", err.Error()), nil
+	}
+
+	return httpapi.JSON(200, response), nil
+}
+
+// listEntries handles GET /journal-entries?limit=&cursor=&mood=&tag=.
+// mood and tag match exactly (case-insensitively) through blind indexes;
+// tag may be repeated, and entries must carry every tag given.
+func (a *app) listEntries(ctx context.Context, userID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	limit := defaultPageSize
+	if raw := request.QueryStringParameters["limit"]; raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			return httpapi.Error(400, "VALIDATION_ERROR",
+				fmt.Sprintf("limit must be between 1 and %d", maxPageSize), ""), nil
+		}
+		limit = n
+	}
+
+	opts := db.ListJournalEntriesOptions{Limit: limit + 1}
+	if raw := request.QueryStringParameters["cursor"]; raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			return httpapi.Error(400, "VALIDATION_ERROR", "Invalid cursor", err.Error()), nil
+		}
+		opts.After = cursor
+	}
+
+	mood, hasMood := request.QueryStringParameters["mood"]
+	tags := request.MultiValueQueryStringParameters["tag"]
+	if tag, ok := request.QueryStringParameters["tag"]; len(tags) == 0 && ok {
+		tags = []string{tag}
+	}
+	if hasMood || len(tags) > 0 {
+		if a.blindIndex == nil {
+			return httpapi.Error(501, "SEARCH_UNAVAILABLE", "Filtering by mood or tag is not enabled", ""), nil
+		}
+		if len(tags) > maxTagFilters {
+			return httpapi.Error(400, "VALIDATION_ERROR",
+				fmt.Sprintf("at most %d tag filters are allowed", maxTagFilters), ""), nil
+		}
+
+		// A blank filter has no token and would silently match everything
+		if hasMood {
+			opts.MoodIndex = a.blindIndex.Token(userID, models.JournalEntryFieldMood, mood)
+			if opts.MoodIndex == "" {
+				return httpapi.Error(400, "VALIDATION_ERROR", "mood cannot be blank", ""), nil
+			}
+		}
+		for _, tag := range tags {
+			if a.blindIndex.Token(userID, models.JournalEntryFieldTags, tag) == "" {
+				return httpapi.Error(400, "VALIDATION_ERROR", "tag cannot be blank", ""), nil
+			}
+		}
+		opts.TagIndexes = a.blindIndex.Tokens(userID, models.JournalEntryFieldTags, tags)
+	}
+
+	// Fetch one extra row to learn whether another page exists
+	entries, err := a.entries(ctx).List(ctx, userID, opts)
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to list journal entries", err.Error()), nil
+	}
+
+	response := ListJournalEntriesResponse{Entries: []*JournalEntryResponse{}}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[len(entries)-1]
+		response.NextCursor = encodeCursor(&db.JournalEntryCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	for _, entry := range entries {
+		decrypted, err := a.decryptEntry(ctx, entry)
+		if err != nil {
+			return httpapi.Error(500, "DECRYPTION_ERROR", "Failed to decrypt journal entry", err.Error()), nil
+		}
+		response.Entries = append(response.Entries, decrypted)
+	}
+
+	return httpapi.JSON(200, response), nil
+}
+
+// updateEntry handles PATCH /journal-entries/{id}
+func (a *app) updateEntry(ctx context.Context, userID, entryID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req UpdateJournalEntryRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return httpapi.Error(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
+	}
+
+	if req.Content == nil && req.Mood == nil && req.Tags == nil {
+		return httpapi.Error(400, "VALIDATION_ERROR", "At least one of content, mood or tags is required", ""), nil
+	}
+	if req.Content != nil && *req.Content == "" {
+		return httpapi.Error(400, "VALIDATION_ERROR", "Content cannot be empty", ""), nil
+	}
+
+	var response *JournalEntryResponse
+	err := a.withTx(ctx, func(ctx context.Context) error {
+		repo := a.entries(ctx)
+
+		entry, err := repo.GetByIDForUpdate(ctx, userID, entryID)
+		if err != nil {
+			return err
+		}
+
+		// Decrypt the current values, apply the patch and reseal the whole
+		// entry under a fresh data key
+		current, err := a.decryptEntry(ctx, entry)
+		if err != nil {
+			return err
+		}
+		if req.Content != nil {
+			current.Content = *req.Content
+		}
+		if req.Mood != nil {
+			current.Mood = *req.Mood
+		}
+		if req.Tags != nil {
+			current.Tags = *req.Tags
+		}
+
+		if err := a.sealEntry(ctx, entry, current.Content, current.Mood, current.Tags); err != nil {
+			return err
+		}
+		entry.UpdatedAt = time.Now().UTC()
+
+		if err := repo.Update(ctx, entry); err != nil {
+			return err
+		}
+
+		current.UpdatedAt = entry.UpdatedAt
+		response = current
+		return nil
+	})
+	if err == db.ErrNotFound {
+		return httpapi.Error(404, "NOT_FOUND", "Journal entry not found", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "PROCESSING_ERROR", "Failed to update journal entry", err.Error()), nil
+	}
+
+	return httpapi.JSON(200, response), nil
+}
+
+// deleteEntry handles DELETE /journal-entries/{id}
+func (a *app) deleteEntry(ctx context.Context, userID, entryID string) (events.APIGatewayProxyResponse, error) {
+	err := a.entries(ctx).Delete(ctx, userID, entryID)
+	if err == db.ErrNotFound {
+		return httpapi.Error(404, "NOT_FOUND", "Journal entry not found", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to delete journal entry", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// encodeCursor serializes a list position as an opaque URL-safe token
+func encodeCursor(cursor *db.JournalEntryCursor) string {
+	raw := fmt.Sprintf("%d|%s", cursor.CreatedAt.UnixNano(), cursor.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(token string) (*db.JournalEntryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || !db.IsUUID(parts[1]) {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor timestamp")
+	}
+
+	return &db.JournalEntryCursor{CreatedAt: time.Unix(0, nanos).UTC(), ID: parts[1]}, nil
+}
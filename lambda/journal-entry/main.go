@@ -2,20 +2,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"database/sql"
 	"fmt"
-	"os"
-	"strconv"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
 	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/httpapi"
 	"github.com/awsbackend/internal/idempotency"
 	"github.com/awsbackend/internal/llm"
 	"github.com/awsbackend/internal/models"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type JournalEntryRequest struct {
@@ -25,6 +27,13 @@ type JournalEntryRequest struct {
 	IdempotencyKey string `json:"idempotency_key,omitempty"`
 }
 
+// UpdateJournalEntryRequest is a PATCH body; omitted fields are left unchanged
+type UpdateJournalEntryRequest struct {
+	Content *string   `json:"content,omitempty"`
+	Mood    *string   `json:"mood,omitempty"`
+	Tags    *[]string `json:"tags,omitempty"`
+}
+
 type JournalEntryResponse struct {
 	ID        string    `json:"id"`
 	UserID    string    `json:"user_id"`
@@ -36,197 +45,228 @@ type JournalEntryResponse struct {
 	Encrypted bool      `json:"encrypted"`
 }
 
-type ErrorResponse struct {
-	Error   string `json:"error"`
-	Code    string `json:"code,omitempty"`
-	Details string `json:"details,omitempty"`
+// CreateJournalEntryResponse acknowledges a new entry. It carries no PHI,
+// because idempotent responses are stored for replay; clients that need the
+// plaintext back already have it.
+type CreateJournalEntryResponse struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Encrypted bool      `json:"encrypted"`
 }
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Extract user ID from JWT token
-	userID, err := extractUserIDFromRequest(request)
-	if err != nil {
-		return createErrorResponse(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
-	}
+type ListJournalEntriesResponse struct {
+	Entries    []*JournalEntryResponse `json:"entries"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
 
-	// Parse request body
-	var req JournalEntryRequest
-	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-		return createErrorResponse(400, "INVALID_REQUEST", "Invalid JSON in request body", err.Error()), nil
-	}
+type JournalShareResponse struct {
+	ClinicianID string    `json:"clinician_id"`
+	CreatedAt   time.Time `json:"created_at"`
+}
 
-	// Validate required fields
-	if req.Content == "" {
-		return createErrorResponse(400, "VALIDATION_ERROR", "Content is required", ""), nil
-	}
+type ListJournalSharesResponse struct {
+	Shares []*JournalShareResponse `json:"shares"`
+}
 
-	// Initialize services
-	idempotencyService, err := idempotency.NewIdempotencyService()
-	if err != nil {
-		return createErrorResponse(500, "SERVICE_ERROR", "Failed to initialize idempotency service", err.Error()), nil
-	}
+// app holds the services shared by every request served by a warm Lambda
+type app struct {
+	idempotency *idempotency.Middleware
+	encryptor   encryption.Encryptor
+	blindIndex  *encryption.BlindIndex // nil when search is not configured
+	costControl costController
 
-	kmsService, err := encryption.NewKMSClient()
+	// entries and shares return repositories that join the transaction
+	// carried by ctx, if any (see db.Conn)
+	entries func(ctx context.Context) journalEntries
+	shares  func(ctx context.Context) journalShares
+
+	// withTx runs fn in a transaction carried by the context fn is given
+	withTx func(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// journalEntries is the entry persistence the handlers use;
+// *db.JournalEntryRepository implements it
+type journalEntries interface {
+	Create(ctx context.Context, entry *models.JournalEntry) error
+	GetByID(ctx context.Context, userID, id string) (*models.JournalEntry, error)
+	GetByIDForUpdate(ctx context.Context, userID, id string) (*models.JournalEntry, error)
+	List(ctx context.Context, userID string, opts db.ListJournalEntriesOptions) ([]*models.JournalEntry, error)
+	Update(ctx context.Context, entry *models.JournalEntry) error
+	Delete(ctx context.Context, userID, id string) error
+}
+
+// journalShares is the share persistence the handlers use;
+// *db.JournalShareRepository implements it
+type journalShares interface {
+	Create(ctx context.Context, share *models.JournalShare) error
+	Exists(ctx context.Context, patientID, clinicianID string) (bool, error)
+	ListForPatient(ctx context.Context, patientID string) ([]*models.JournalShare, error)
+	Delete(ctx context.Context, patientID, clinicianID string) error
+}
+
+// costController meters LLM spend; *llm.CostControlService implements it
+type costController interface {
+	CheckUserSpendLimit(ctx context.Context, userID string, estimatedCost float64) (*llm.CostControlResult, error)
+	RecordLLMRequest(ctx context.Context, userID string, cost float64) error
+}
+
+// idempotentRoutes configures idempotency per route; routes missing here
+// are not idempotent. PATCH /journal-entries/{id} is left out on purpose:
+// it returns the whole decrypted entry and is safe to repeat anyway.
+var idempotentRoutes = map[string]idempotency.RouteConfig{
+	// Older clients send the key in the body
+	"POST /journal-entries":                {KeySource: idempotency.KeyFromHeaderOrBody},
+	"DELETE /journal-entries/{id}":         {},
+	"PUT /journal-shares/{clinicianId}":    {},
+	"DELETE /journal-shares/{clinicianId}": {},
+}
+
+func newApp() (*app, error) {
+	encryptor, err := encryption.NewEncryptorFromEnv()
 	if err != nil {
-		return createErrorResponse(500, "SERVICE_ERROR", "Failed to initialize encryption service", err.Error()), nil
+		return nil, fmt.Errorf("failed to initialize encryption service: %v", err)
 	}
 
-	costControlService, err := llm.NewCostControlService()
+	idempotencyService, err := idempotency.NewIdempotencyService(encryptor)
 	if err != nil {
-		return createErrorResponse(500, "SERVICE_ERROR", "Failed to initialize cost control service", err.Error()), nil
+		return nil, fmt.Errorf("failed to initialize idempotency service: %v", err)
 	}
 
-	// Process request with idempotency
-	response, err := idempotencyService.ProcessIdempotentRequest(
-		ctx,
-		userID,
-		"POST /journal-entries",
-		request.Body,
-		func() (interface{}, error) {
-			return processJournalEntry(ctx, userID, req, kmsService, costControlService)
-		},
-	)
-
+	blindIndex, err := encryption.NewBlindIndexFromEnv(context.TODO())
 	if err != nil {
-		return createErrorResponse(500, "PROCESSING_ERROR", "Failed to process journal entry", err.Error()), nil
+		return nil, fmt.Errorf("failed to initialize blind index: %v", err)
 	}
 
-	// Convert response to JSON
-	responseBody, err := json.Marshal(response)
+	costControlService, err := llm.NewCostControlService()
 	if err != nil {
-		return createErrorResponse(500, "SERIALIZATION_ERROR", "Failed to serialize response", err.Error()), nil
+		return nil, fmt.Errorf("failed to initialize cost control service: %v", err)
 	}
 
-	return events.APIGatewayProxyResponse{
-		StatusCode: 201,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
+	return &app{
+		idempotency: newIdempotencyMiddleware(idempotencyService),
+		encryptor:   encryptor,
+		blindIndex:  blindIndex,
+		costControl: costControlService,
+		entries: func(ctx context.Context) journalEntries {
+			return db.NewJournalEntryRepository(db.Conn(ctx))
+		},
+		shares: func(ctx context.Context) journalShares {
+			return db.NewJournalShareRepository(db.Conn(ctx))
+		},
+		withTx: func(ctx context.Context, fn func(ctx context.Context) error) error {
+			return db.WithTx(ctx, func(tx *sql.Tx) error {
+				return fn(db.ContextWithTx(ctx, tx))
+			})
 		},
-		Body: string(responseBody),
 	}, nil
 }
 
-func processJournalEntry(
-	ctx context.Context,
-	userID string,
-	req JournalEntryRequest,
-	kmsService *encryption.KMSClient,
-	costControlService *llm.CostControlService,
-) (*JournalEntryResponse, error) {
-	// Check LLM cost limits before processing
-	estimatedCost := llm.EstimateLLMCost(len(req.Content), 100, "anthropic.claude-3-sonnet-20240229-v1:0")
-	costCheck, err := costControlService.CheckUserSpendLimit(ctx, userID, estimatedCost)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check cost limits: %v", err)
-	}
-
-	if !costCheck.Allowed {
-		// Implement graceful degradation
-		return handleCostLimitExceeded(req, costCheck)
-	}
+// newIdempotencyMiddleware applies idempotentRoutes through service
+func newIdempotencyMiddleware(service *idempotency.IdempotencyService) *idempotency.Middleware {
+	return idempotency.NewMiddleware(service, idempotency.MiddlewareConfig{
+		Routes: idempotentRoutes,
+		Authenticate: func(ctx context.Context, request events.APIGatewayProxyRequest) (context.Context, string, error) {
+			claims, err := httpapi.Authenticate(ctx, request)
+			if err != nil {
+				return ctx, "", err
+			}
+			return httpapi.ContextWithClaims(ctx, claims), claims.UserID, nil
+		},
+		ErrorResponse: func(statusCode int, code, message string) events.APIGatewayProxyResponse {
+			return httpapi.Error(statusCode, code, message, "")
+		},
+	})
+}
 
-	// Encrypt PHI data
-	encryptedContent, err := kmsService.EncryptPHI(ctx, req.Content)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt content: %v", err)
-	}
+// handler routes /journal-entries, /journal-entries/{id} and
+// /journal-shares requests
+func (a *app) handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	defer a.logCacheStats()
 
-	encryptedMood, err := kmsService.EncryptPHI(ctx, req.Mood)
+	// Identify the caller from the authorizer context or JWT token
+	claims, err := httpapi.Authenticate(ctx, request)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt mood: %v", err)
+		return httpapi.Error(401, "UNAUTHORIZED", "Invalid or missing authentication token", err.Error()), nil
 	}
 
-	encryptedTags, err := kmsService.EncryptPHIArray(ctx, req.Tags)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt tags: %v", err)
+	if strings.HasPrefix(request.Resource, "/journal-shares") {
+		return a.sharesHandler(ctx, claims, request)
 	}
 
-	// Create journal entry (in a real implementation, this would save to database)
-	entry := &JournalEntryResponse{
-		ID:        generateID(),
-		UserID:    userID,
-		Content:   encryptedContent,
-		Mood:      encryptedMood,
-		Tags:      encryptedTags,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Encrypted: true,
+	entryID := request.PathParameters["id"]
+	if entryID != "" && !db.IsUUID(entryID) {
+		// IDs are UUIDs; anything else cannot exist and would only upset Postgres
+		return httpapi.Error(404, "NOT_FOUND", "Journal entry not found", ""), nil
 	}
 
-	// Record the LLM cost (even though we didn't use LLM in this example)
-	err = costControlService.RecordLLMRequest(ctx, userID, estimatedCost)
-	if err != nil {
-		// Log error but don't fail the request
-		fmt.Printf("Warning: failed to record LLM cost: %v\n", err)
+	// Clinicians read a patient's journal with ?patient_id=; everyone else
+	// only ever touches their own entries
+	ownerID := claims.UserID
+	permission := auth.PermJournalWrite
+	if request.HTTPMethod == "GET" {
+		permission = auth.PermJournalRead
 	}
-
-	return entry, nil
-}
-
-func handleCostLimitExceeded(req JournalEntryRequest, costCheck *llm.CostControlResult) (*JournalEntryResponse, error) {
-	// Graceful degradation: return a basic response without LLM processing
-	entry := &JournalEntryResponse{
-		ID:        generateID(),
-		UserID:    "user_id", // This would be the actual user ID
-		Content:   req.Content, // Store unencrypted for now (in real implementation, still encrypt)
-		Mood:      req.Mood,
-		Tags:      req.Tags,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
-		Encrypted: false,
+	if patientID := request.QueryStringParameters["patient_id"]; patientID != "" {
+		if request.HTTPMethod != "GET" {
+			return httpapi.Error(400, "VALIDATION_ERROR", "patient_id is only supported when reading", ""), nil
+		}
+		ownerID = patientID
+		permission = auth.PermSharedJournalRead
 	}
 
-	// In a real implementation, you might:
-	// 1. Use a cheaper model
-	// 2. Return cached/summarized content
-	// 3. Suggest user upgrade
-	// 4. Queue for later processing
-
-	return entry, nil
-}
-
-func extractUserIDFromRequest(request events.APIGatewayProxyRequest) (string, error) {
-	// Extract JWT token from Authorization header
-	authHeader := request.Headers["Authorization"]
-	if authHeader == "" {
-		return "", fmt.Errorf("missing authorization header")
+	if err := auth.Authorize(claims, permission); err != nil {
+		return httpapi.Forbidden(err), nil
 	}
 
-	// Remove "Bearer " prefix
-	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-		authHeader = authHeader[7:]
+	if ownerID != claims.UserID {
+		shared, err := a.shares(ctx).Exists(ctx, ownerID, claims.UserID)
+		if err != nil {
+			return httpapi.Error(500, "DATABASE_ERROR", "Failed to check journal share", err.Error()), nil
+		}
+		if !shared {
+			return httpapi.Error(404, "NOT_FOUND", "No journal is shared with you by this patient", ""), nil
+		}
 	}
 
-	// Validate token and extract user ID
-	claims, err := auth.ValidateToken(authHeader)
-	if err != nil {
-		return "", fmt.Errorf("invalid token: %v", err)
+	switch {
+	case request.HTTPMethod == "POST" && entryID == "":
+		return a.createEntry(ctx, ownerID, request)
+	case request.HTTPMethod == "GET" && entryID == "":
+		return a.listEntries(ctx, ownerID, request)
+	case request.HTTPMethod == "GET":
+		return a.getEntry(ctx, ownerID, entryID)
+	case request.HTTPMethod == "PATCH" && entryID != "":
+		return a.updateEntry(ctx, ownerID, entryID, request)
+	case request.HTTPMethod == "DELETE" && entryID != "":
+		return a.deleteEntry(ctx, ownerID, entryID)
 	}
 
-	return claims.UserID, nil
+	return httpapi.Error(405, "METHOD_NOT_ALLOWED",
+		fmt.Sprintf("%s is not supported on %s", request.HTTPMethod, request.Resource), ""), nil
 }
 
-func createErrorResponse(statusCode int, code, message, details string) events.APIGatewayProxyResponse {
-	errorResp := ErrorResponse{
-		Error:   message,
-		Code:    code,
-		Details: details,
+// generateID returns a random (version 4) UUID for a new journal entry
+func generateID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate entry ID: %v", err))
 	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
 
-	body, _ := json.Marshal(errorResp)
-	return events.APIGatewayProxyResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
+func main() {
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("failed to initialize database: %v", err)
 	}
-}
 
-func generateID() string {
-	return fmt.Sprintf("entry_%d", time.Now().UnixNano())
-}
+	a, err := newApp()
+	if err != nil {
+		log.Fatalf("failed to initialize services: %v", err)
+	}
 
-func main() {
-	lambda.Start(handler)
+	lambda.Start(a.idempotency.Wrap(a.handler))
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/encryption"
+	"github.com/awsbackend/internal/idempotency"
+	"github.com/awsbackend/internal/llm"
+	"github.com/awsbackend/internal/models"
+)
+
+// memoryJournal keeps entries and shares in process, standing in for the
+// Postgres repositories
+type memoryJournal struct {
+	mu      sync.Mutex
+	entries map[string]*models.JournalEntry
+	shares  map[[2]string]*models.JournalShare
+}
+
+func (m *memoryJournal) Create(ctx context.Context, entry *models.JournalEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *entry
+	m.entries[entry.ID] = &stored
+	return nil
+}
+
+func (m *memoryJournal) GetByID(ctx context.Context, userID, id string) (*models.JournalEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok || entry.UserID != userID {
+		return nil, db.ErrNotFound
+	}
+	c := *entry
+	return &c, nil
+}
+
+func (m *memoryJournal) GetByIDForUpdate(ctx context.Context, userID, id string) (*models.JournalEntry, error) {
+	return m.GetByID(ctx, userID, id)
+}
+
+func (m *memoryJournal) List(ctx context.Context, userID string, opts db.ListJournalEntriesOptions) ([]*models.JournalEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []*models.JournalEntry
+	for _, entry := range m.entries {
+		if entry.UserID != userID || (opts.MoodIndex != "" && entry.MoodIndex != opts.MoodIndex) {
+			continue
+		}
+		c := *entry
+		entries = append(entries, &c)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	if len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+	}
+	return entries, nil
+}
+
+func (m *memoryJournal) Update(ctx context.Context, entry *models.JournalEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[entry.ID]; !ok {
+		return db.ErrNotFound
+	}
+	stored := *entry
+	m.entries[entry.ID] = &stored
+	return nil
+}
+
+func (m *memoryJournal) Delete(ctx context.Context, userID, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok || entry.UserID != userID {
+		return db.ErrNotFound
+	}
+	delete(m.entries, id)
+	return nil
+}
+
+// memoryShares adapts memoryJournal to journalShares
+type memoryShares struct{ *memoryJournal }
+
+func (m memoryShares) Create(ctx context.Context, share *models.JournalShare) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	share.CreatedAt = time.Now().UTC()
+	m.shares[[2]string{share.PatientID, share.ClinicianID}] = share
+	return nil
+}
+
+func (m memoryShares) Exists(ctx context.Context, patientID, clinicianID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.shares[[2]string{patientID, clinicianID}]
+	return ok, nil
+}
+
+func (m memoryShares) ListForPatient(ctx context.Context, patientID string) ([]*models.JournalShare, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var shares []*models.JournalShare
+	for key, share := range m.shares {
+		if key[0] == patientID {
+			shares = append(shares, share)
+		}
+	}
+	return shares, nil
+}
+
+func (m memoryShares) Delete(ctx context.Context, patientID, clinicianID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{patientID, clinicianID}
+	if _, ok := m.shares[key]; !ok {
+		return db.ErrNotFound
+	}
+	delete(m.shares, key)
+	return nil
+}
+
+// unlimitedSpend allows every LLM request and counts the recorded ones
+type unlimitedSpend struct {
+	mu       sync.Mutex
+	recorded int
+}
+
+func (s *unlimitedSpend) CheckUserSpendLimit(ctx context.Context, userID string, estimatedCost float64) (*llm.CostControlResult, error) {
+	return &llm.CostControlResult{Allowed: true}, nil
+}
+
+func (s *unlimitedSpend) RecordLLMRequest(ctx context.Context, userID string, cost float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorded++
+	return nil
+}
+
+// newTestApp returns the journal Lambda backed by in-process stores and a
+// LocalKeyProvider
+func newTestApp(t *testing.T) (*app, *memoryJournal) {
+	t.Helper()
+
+	provider, err := encryption.NewLocalKeyProvider([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("NewLocalKeyProvider failed: %v", err)
+	}
+	blindIndex, err := encryption.NewBlindIndex([]byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("NewBlindIndex failed: %v", err)
+	}
+
+	encryptor := encryption.NewEncryptor(provider)
+	journal := &memoryJournal{entries: map[string]*models.JournalEntry{}, shares: map[[2]string]*models.JournalShare{}}
+	a := &app{
+		idempotency: newIdempotencyMiddleware(idempotency.NewService(idempotency.NewMemoryStore(), idempotency.Config{Encryptor: encryptor})),
+		encryptor:   encryptor,
+		blindIndex:  blindIndex,
+		costControl: &unlimitedSpend{},
+		entries:     func(ctx context.Context) journalEntries { return journal },
+		shares:      func(ctx context.Context) journalShares { return memoryShares{journal} },
+		withTx: func(ctx context.Context, fn func(ctx context.Context) error) error {
+			return fn(ctx)
+		},
+	}
+	return a, journal
+}
+
+// call sends a request from userID through the idempotency middleware and
+// the handler, as lambda.Start would
+func call(t *testing.T, a *app, userID, method, resource string, pathParameters map[string]string, body string, headers map[string]string) events.APIGatewayProxyResponse {
+	t.Helper()
+
+	path := resource
+	for name, value := range pathParameters {
+		path = strings.Replace(path, "{"+name+"}", value, 1)
+	}
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     method,
+		Resource:       resource,
+		Path:           path,
+		PathParameters: pathParameters,
+		Headers:        headers,
+		Body:           body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: auth.AuthorizerContext(&auth.Claims{UserID: userID, Roles: []string{string(auth.RolePatient)}}),
+		},
+	}
+
+	response, err := a.idempotency.Wrap(a.handler)(context.Background(), request)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	return response
+}
+
+func decode(t *testing.T, response events.APIGatewayProxyResponse, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(response.Body), v); err != nil {
+		t.Fatalf("failed to decode %q: %v", response.Body, err)
+	}
+}
+
+const userID = "6f1c2a8e-3b4d-4c5e-9f60-718293a4b5c6"
+
+func TestJournalEntryLifecycle(t *testing.T) {
+	a, journal := newTestApp(t)
+
+	created := call(t, a, userID, "POST", "/journal-entries", nil,
+		`{"content":"Slept badly again","mood":"Tired","tags":["sleep","work"]}`, nil)
+	if created.StatusCode != 201 {
+		t.Fatalf("POST = %d %s, want 201", created.StatusCode, created.Body)
+	}
+	if strings.Contains(created.Body, "Slept badly") || strings.Contains(created.Body, "Tired") {
+		t.Errorf("POST response %s contains PHI", created.Body)
+	}
+	var createResponse CreateJournalEntryResponse
+	decode(t, created, &createResponse)
+	if !db.IsUUID(createResponse.ID) || createResponse.UserID != userID || !createResponse.Encrypted {
+		t.Fatalf("POST response = %+v", createResponse)
+	}
+	if created.Headers["Location"] != "/journal-entries/"+createResponse.ID {
+		t.Errorf("Location = %q", created.Headers["Location"])
+	}
+
+	// Only ciphertext is stored
+	stored := journal.entries[createResponse.ID]
+	if stored == nil {
+		t.Fatalf("entry %s was not stored", createResponse.ID)
+	}
+	for _, value := range append([]string{stored.Content, stored.Mood}, stored.Tags...) {
+		if !strings.HasPrefix(value, "tev:") {
+			t.Errorf("stored value %q is not a sealed ciphertext", value)
+		}
+	}
+
+	id := map[string]string{"id": createResponse.ID}
+	got := call(t, a, userID, "GET", "/journal-entries/{id}", id, "", nil)
+	if got.StatusCode != 200 {
+		t.Fatalf("GET = %d %s, want 200", got.StatusCode, got.Body)
+	}
+	var entry JournalEntryResponse
+	decode(t, got, &entry)
+	if entry.Content != "Slept badly again" || entry.Mood != "Tired" || strings.Join(entry.Tags, ",") != "sleep,work" {
+		t.Errorf("GET = %+v, want the plaintext that was posted", entry)
+	}
+
+	patched := call(t, a, userID, "PATCH", "/journal-entries/{id}", id, `{"mood":"Rested"}`, nil)
+	if patched.StatusCode != 200 {
+		t.Fatalf("PATCH = %d %s, want 200", patched.StatusCode, patched.Body)
+	}
+	got = call(t, a, userID, "GET", "/journal-entries/{id}", id, "", nil)
+	decode(t, got, &entry)
+	if entry.Content != "Slept badly again" || entry.Mood != "Rested" {
+		t.Errorf("GET after PATCH = %+v, want the new mood and the old content", entry)
+	}
+
+	listed := call(t, a, userID, "GET", "/journal-entries", nil, "", nil)
+	var list ListJournalEntriesResponse
+	decode(t, listed, &list)
+	if len(list.Entries) != 1 || list.Entries[0].ID != createResponse.ID {
+		t.Errorf("GET /journal-entries = %s, want the one entry", listed.Body)
+	}
+
+	if deleted := call(t, a, userID, "DELETE", "/journal-entries/{id}", id, "", nil); deleted.StatusCode != 204 {
+		t.Fatalf("DELETE = %d %s, want 204", deleted.StatusCode, deleted.Body)
+	}
+	if got := call(t, a, userID, "GET", "/journal-entries/{id}", id, "", nil); got.StatusCode != 404 {
+		t.Errorf("GET after DELETE = %d, want 404", got.StatusCode)
+	}
+}
+
+func TestJournalEntriesAreOwnerScoped(t *testing.T) {
+	a, _ := newTestApp(t)
+
+	created := call(t, a, userID, "POST", "/journal-entries", nil, `{"content":"mine"}`, nil)
+	var createResponse CreateJournalEntryResponse
+	decode(t, created, &createResponse)
+
+	other := "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"
+	id := map[string]string{"id": createResponse.ID}
+	if got := call(t, a, other, "GET", "/journal-entries/{id}", id, "", nil); got.StatusCode != 404 {
+		t.Errorf("GET by another user = %d, want 404", got.StatusCode)
+	}
+	if got := call(t, a, other, "GET", "/journal-entries", map[string]string{}, "", nil); strings.Contains(got.Body, createResponse.ID) {
+		t.Errorf("another user's list contains the entry: %s", got.Body)
+	}
+}
+
+func TestCreateJournalEntryIsIdempotent(t *testing.T) {
+	a, journal := newTestApp(t)
+	headers := map[string]string{"Idempotency-Key": "retry-1"}
+	body := `{"content":"only once"}`
+
+	first := call(t, a, userID, "POST", "/journal-entries", nil, body, headers)
+	second := call(t, a, userID, "POST", "/journal-entries", nil, body, headers)
+	if first.StatusCode != 201 || second.StatusCode != 201 {
+		t.Fatalf("POSTs = %d and %d, want 201 twice", first.StatusCode, second.StatusCode)
+	}
+	if second.Body != first.Body || second.Headers[idempotency.ReplayedHeader] != "true" {
+		t.Errorf("retry = %v %s, want a replay of %s", second.Headers, second.Body, first.Body)
+	}
+	if len(journal.entries) != 1 {
+		t.Errorf("%d entries stored, want 1", len(journal.entries))
+	}
+
+	conflict := call(t, a, userID, "POST", "/journal-entries", nil, `{"content":"something else"}`, headers)
+	if conflict.StatusCode != 422 {
+		t.Errorf("reused key with another body = %d, want 422", conflict.StatusCode)
+	}
+}
+
+type testTxKey struct{}
+
+// TestCreateJournalEntryWritesInTransaction checks that the insert runs
+// through a.withTx even when no idempotency store put a transaction in ctx
+func TestCreateJournalEntryWritesInTransaction(t *testing.T) {
+	a, journal := newTestApp(t)
+	a.withTx = func(ctx context.Context, fn func(ctx context.Context) error) error {
+		return fn(context.WithValue(ctx, testTxKey{}, true))
+	}
+	outside := 0
+	a.entries = func(ctx context.Context) journalEntries {
+		if ctx.Value(testTxKey{}) == nil {
+			outside++
+		}
+		return journal
+	}
+
+	if got := call(t, a, userID, "POST", "/journal-entries", nil, `{"content":"no key"}`, nil); got.StatusCode != 201 {
+		t.Fatalf("POST = %d %s, want 201", got.StatusCode, got.Body)
+	}
+	if outside != 0 {
+		t.Errorf("%d repository calls ran outside a.withTx, want none", outside)
+	}
+	if len(journal.entries) != 1 {
+		t.Errorf("%d entries stored, want 1", len(journal.entries))
+	}
+}
+
+// TestListRejectsBlankFilters checks that a mood or tag that normalizes to
+// nothing is rejected rather than returning the unfiltered list
+func TestListRejectsBlankFilters(t *testing.T) {
+	a, _ := newTestApp(t)
+	call(t, a, userID, "POST", "/journal-entries", nil, `{"content":"Slept well","mood":"Rested","tags":["sleep"]}`, nil)
+
+	tests := []struct {
+		name  string
+		query map[string]string
+		multi map[string][]string
+		want  int
+	}{
+		{"BlankMood", map[string]string{"mood": "   "}, nil, 400},
+		{"EmptyMood", map[string]string{"mood": ""}, nil, 400},
+		{"BlankTag", map[string]string{"tag": " \t "}, nil, 400},
+		{"OneBlankTag", nil, map[string][]string{"tag": {"sleep", "  "}}, 400},
+		{"PaddedMood", map[string]string{"mood": "  rested "}, nil, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				HTTPMethod:                      "GET",
+				Resource:                        "/journal-entries",
+				Path:                            "/journal-entries",
+				QueryStringParameters:           tt.query,
+				MultiValueQueryStringParameters: tt.multi,
+				RequestContext: events.APIGatewayProxyRequestContext{
+					Authorizer: auth.AuthorizerContext(&auth.Claims{UserID: userID, Roles: []string{string(auth.RolePatient)}}),
+				},
+			}
+			response, err := a.handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			if response.StatusCode != tt.want {
+				t.Errorf("GET = %d %s, want %d", response.StatusCode, response.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateJournalEntryValidates(t *testing.T) {
+	a, journal := newTestApp(t)
+
+	if got := call(t, a, userID, "POST", "/journal-entries", nil, `{"mood":"calm"}`, nil); got.StatusCode != 400 {
+		t.Errorf("POST without content = %d, want 400", got.StatusCode)
+	}
+	if got := call(t, a, userID, "POST", "/journal-entries", nil, `not json`, nil); got.StatusCode != 400 {
+		t.Errorf("POST with a malformed body = %d, want 400", got.StatusCode)
+	}
+	if len(journal.entries) != 0 {
+		t.Errorf("%d entries stored, want none", len(journal.entries))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/awsbackend/internal/auth"
+	"github.com/awsbackend/internal/db"
+	"github.com/awsbackend/internal/httpapi"
+	"github.com/awsbackend/internal/models"
+)
+
+// sharesHandler routes /journal-shares and /journal-shares/{clinicianId},
+// through which patients control which clinicians can read their journal
+func (a *app) sharesHandler(ctx context.Context, claims *auth.Claims, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := auth.Authorize(claims, auth.PermSharesWrite); err != nil {
+		return httpapi.Forbidden(err), nil
+	}
+
+	clinicianID := request.PathParameters["clinicianId"]
+
+	switch {
+	case request.HTTPMethod == "GET" && clinicianID == "":
+		return a.listShares(ctx, claims.UserID)
+	case request.HTTPMethod == "PUT" && clinicianID != "":
+		return a.createShare(ctx, claims.UserID, clinicianID)
+	case request.HTTPMethod == "DELETE" && clinicianID != "":
+		return a.deleteShare(ctx, claims.UserID, clinicianID)
+	}
+
+	return httpapi.Error(405, "METHOD_NOT_ALLOWED",
+		fmt.Sprintf("%s is not supported on %s", request.HTTPMethod, request.Resource), ""), nil
+}
+
+// listShares handles GET /journal-shares
+func (a *app) listShares(ctx context.Context, userID string) (events.APIGatewayProxyResponse, error) {
+	shares, err := a.shares(ctx).ListForPatient(ctx, userID)
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to list journal shares", err.Error()), nil
+	}
+
+	response := ListJournalSharesResponse{Shares: []*JournalShareResponse{}}
+	for _, share := range shares {
+		response.Shares = append(response.Shares, &JournalShareResponse{
+			ClinicianID: share.ClinicianID,
+			CreatedAt:   share.CreatedAt,
+		})
+	}
+
+	return httpapi.JSON(200, response), nil
+}
+
+// createShare handles PUT /journal-shares/{clinicianId}
+func (a *app) createShare(ctx context.Context, userID, clinicianID string) (events.APIGatewayProxyResponse, error) {
+	if clinicianID == userID {
+		return httpapi.Error(400, "VALIDATION_ERROR", "You cannot share your journal with yourself", ""), nil
+	}
+
+	share := &models.JournalShare{PatientID: userID, ClinicianID: clinicianID}
+	if err := a.shares(ctx).Create(ctx, share); err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to share journal", err.Error()), nil
+	}
+
+	return httpapi.JSON(200, &JournalShareResponse{
+		ClinicianID: share.ClinicianID,
+		CreatedAt:   share.CreatedAt,
+	}), nil
+}
+
+// deleteShare handles DELETE /journal-shares/{clinicianId}. Access ends
+// with the clinician's next request.
+func (a *app) deleteShare(ctx context.Context, userID, clinicianID string) (events.APIGatewayProxyResponse, error) {
+	err := a.shares(ctx).Delete(ctx, userID, clinicianID)
+	if err == db.ErrNotFound {
+		return httpapi.Error(404, "NOT_FOUND", "Journal is not shared with this clinician", ""), nil
+	}
+	if err != nil {
+		return httpapi.Error(500, "DATABASE_ERROR", "Failed to stop sharing journal", err.Error()), nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
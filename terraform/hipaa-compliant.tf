@@ -20,6 +20,24 @@ resource "aws_kms_alias" "phi_encryption_key_alias" {
   target_key_id = aws_kms_key.phi_encryption_key.key_id
 }
 
+# Blind index key for searching encrypted tags and mood. It is separate from
+# the PHI data keys and only ever stored wrapped under the PHI KMS key.
+resource "random_password" "blind_index_key" {
+  length  = 64
+  special = false
+}
+
+resource "aws_kms_ciphertext" "blind_index_key" {
+  key_id    = aws_kms_key.phi_encryption_key.key_id
+  plaintext = random_password.blind_index_key.result
+
+  context = {
+    Purpose = "PHI-Encryption"
+    Service = "Therma-Backend"
+    KeyType = "BlindIndex"
+  }
+}
+
 # KMS Key Policy for HIPAA compliance
 resource "aws_kms_key_policy" "phi_encryption_key_policy" {
   key_id = aws_kms_key.phi_encryption_key.id
@@ -149,6 +167,92 @@ resource "aws_dynamodb_table" "user_spend_table" {
   }
 }
 
+# Per-user key-encryption keys for crypto-shredding. Point-in-time recovery
+# is the only backup of this table, so a shredded key is unrecoverable once
+# the 35-day recovery window has passed. Do not add on-demand backups.
+resource "aws_dynamodb_table" "user_keys_table" {
+  name           = "therma-user-keys"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "user_id"
+
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  server_side_encryption {
+    enabled     = true
+    kms_key_id  = aws_kms_key.phi_encryption_key.arn
+  }
+
+  tags = {
+    Name        = "therma-user-keys"
+    Environment = "production"
+    Compliance  = "HIPAA"
+  }
+}
+
+# Revoked access tokens ("token#<jti>") and log outs of all devices
+# ("user#<user ID>"), deleted by TTL once the tokens would have expired
+resource "aws_dynamodb_table" "token_revocations_table" {
+  name           = "therma-token-revocations"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "pk"
+
+  attribute {
+    name = "pk"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+
+  point_in_time_recovery {
+    enabled = true
+  }
+
+  server_side_encryption {
+    enabled     = true
+    kms_key_id  = aws_kms_key.phi_encryption_key.arn
+  }
+
+  tags = {
+    Name        = "therma-token-revocations"
+    Environment = "production"
+    Compliance  = "HIPAA"
+  }
+}
+
+# Keyring of the HS256 keys that sign access tokens. Populated and rotated
+# with cmd/jwtkeys rather than by Terraform, so secrets never enter the
+# state. Encrypted with the AWS managed Secrets Manager key.
+resource "aws_secretsmanager_secret" "jwt_keyring" {
+  name        = "therma/jwt-keyring"
+  description = "Access token signing keys (see cmd/jwtkeys)"
+
+  tags = {
+    Name        = "therma-jwt-keyring"
+    Environment = "production"
+    Compliance  = "HIPAA"
+  }
+}
+
+# Sender of email verification and password reset emails
+resource "aws_sesv2_email_identity" "mail_from" {
+  email_identity = var.mail_from
+
+  tags = {
+    Name        = "therma-mail-from"
+    Environment = "production"
+  }
+}
+
 # S3 Bucket for Audit Logs with Object Lock
 resource "aws_s3_bucket" "audit_logs" {
   bucket = "therma-audit-logs-${random_string.bucket_suffix.result}"
@@ -333,10 +437,18 @@ resource "aws_iam_role_policy" "lambda_policy" {
           }
         }
       },
+      {
+        Effect = "Allow"
+        Action = [
+          "secretsmanager:GetSecretValue"
+        ]
+        Resource = aws_secretsmanager_secret.jwt_keyring.arn
+      },
       {
         Effect = "Allow"
         Action = [
           "dynamodb:GetItem",
+          "dynamodb:BatchGetItem",
           "dynamodb:PutItem",
           "dynamodb:UpdateItem",
           "dynamodb:DeleteItem",
@@ -345,8 +457,17 @@ resource "aws_iam_role_policy" "lambda_policy" {
         ]
         Resource = [
           aws_dynamodb_table.idempotency_table.arn,
-          aws_dynamodb_table.user_spend_table.arn
+          aws_dynamodb_table.user_spend_table.arn,
+          aws_dynamodb_table.user_keys_table.arn,
+          aws_dynamodb_table.token_revocations_table.arn
+        ]
+      },
+      {
+        Effect = "Allow"
+        Action = [
+          "ses:SendEmail"
         ]
+        Resource = aws_sesv2_email_identity.mail_from.arn
       },
       {
         Effect = "Allow"
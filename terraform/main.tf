@@ -143,9 +143,91 @@ resource "aws_lambda_function" "journal_entry" {
     variables = {
       DATABASE_URL = "postgres://postgres:${var.db_password}@${aws_db_instance.postgres.endpoint}/postgres?sslmode=disable"
       JWT_SECRET   = var.jwt_secret
+      JWT_KEYRING_SECRET_ID = aws_secretsmanager_secret.jwt_keyring.arn
+      JWT_LEGACY_SECRET_UNTIL = var.jwt_legacy_secret_until
       JWT_ISSUER   = "therma-api"
       JWT_TTL      = "1h"
       KMS_KEY_ID   = aws_kms_key.phi_encryption_key.key_id
+      USER_KEY_STORE = "dynamodb"
+      REVOCATION_STORE = "dynamodb"
+      COGNITO_USER_POOL_ID = var.cognito_user_pool_id
+      COGNITO_CLIENT_IDS   = var.cognito_client_ids
+      BLIND_INDEX_KEY_CIPHERTEXT = aws_kms_ciphertext.blind_index_key.ciphertext_blob
+      IDEMPOTENCY_STORE = var.idempotency_store
+    }
+  }
+}
+
+resource "aws_lambda_function" "account" {
+  filename         = "../bin/account.zip"
+  function_name    = "account"
+  role            = aws_iam_role.lambda_role.arn
+  handler         = "bootstrap"
+  runtime         = "provided.al2"
+  timeout         = 30
+
+  environment {
+    variables = {
+      DATABASE_URL = "postgres://postgres:${var.db_password}@${aws_db_instance.postgres.endpoint}/postgres?sslmode=disable"
+      JWT_SECRET   = var.jwt_secret
+      JWT_KEYRING_SECRET_ID = aws_secretsmanager_secret.jwt_keyring.arn
+      JWT_LEGACY_SECRET_UNTIL = var.jwt_legacy_secret_until
+      JWT_ISSUER   = "therma-api"
+      KMS_KEY_ID   = aws_kms_key.phi_encryption_key.key_id
+      USER_KEY_STORE = "dynamodb"
+      REVOCATION_STORE = "dynamodb"
+      COGNITO_USER_POOL_ID = var.cognito_user_pool_id
+      COGNITO_CLIENT_IDS   = var.cognito_client_ids
+    }
+  }
+}
+
+resource "aws_lambda_function" "auth" {
+  filename         = "../bin/auth.zip"
+  function_name    = "auth"
+  role            = aws_iam_role.lambda_role.arn
+  handler         = "bootstrap"
+  runtime         = "provided.al2"
+  timeout         = 30
+
+  environment {
+    variables = {
+      DATABASE_URL = "postgres://postgres:${var.db_password}@${aws_db_instance.postgres.endpoint}/postgres?sslmode=disable"
+      JWT_SECRET   = var.jwt_secret
+      JWT_KEYRING_SECRET_ID = aws_secretsmanager_secret.jwt_keyring.arn
+      JWT_LEGACY_SECRET_UNTIL = var.jwt_legacy_secret_until
+      JWT_ISSUER   = "therma-api"
+      JWT_TTL      = "1h"
+      BCRYPT_COST  = "12"
+      REFRESH_TOKEN_TTL = "720h"
+      REVOCATION_STORE = "dynamodb"
+      KMS_KEY_ID   = aws_kms_key.phi_encryption_key.key_id
+      USER_KEY_STORE = "dynamodb"
+      TOTP_ISSUER  = "Therma"
+      MAILER       = "ses"
+      MAIL_FROM    = var.mail_from
+      APP_BASE_URL = var.app_base_url
+    }
+  }
+}
+
+resource "aws_lambda_function" "authorizer" {
+  filename         = "../bin/authorizer.zip"
+  function_name    = "authorizer"
+  role            = aws_iam_role.lambda_role.arn
+  handler         = "bootstrap"
+  runtime         = "provided.al2"
+  timeout         = 10
+
+  environment {
+    variables = {
+      JWT_SECRET   = var.jwt_secret
+      JWT_KEYRING_SECRET_ID = aws_secretsmanager_secret.jwt_keyring.arn
+      JWT_LEGACY_SECRET_UNTIL = var.jwt_legacy_secret_until
+      JWT_ISSUER   = "therma-api"
+      REVOCATION_STORE = "dynamodb"
+      COGNITO_USER_POOL_ID = var.cognito_user_pool_id
+      COGNITO_CLIENT_IDS   = var.cognito_client_ids
     }
   }
 }
@@ -232,6 +314,27 @@ resource "aws_api_gateway_rest_api" "therma_api" {
   name = "therma-api"
 }
 
+# Validates bearer tokens once per request (or per cached token) and passes
+# the principal to the business Lambdas. Results are cached by token for
+# five minutes; the Lambdas recheck revocation, so logout still takes
+# effect within REVOCATION_CACHE_TTL.
+resource "aws_api_gateway_authorizer" "token" {
+  name                             = "therma-token-authorizer"
+  rest_api_id                      = aws_api_gateway_rest_api.therma_api.id
+  authorizer_uri                   = aws_lambda_function.authorizer.invoke_arn
+  type                             = "REQUEST"
+  identity_source                  = "method.request.header.Authorization"
+  authorizer_result_ttl_in_seconds = 300
+}
+
+resource "aws_lambda_permission" "apigw_authorizer" {
+  statement_id  = "AllowAPIGatewayInvokeAuthorizer"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.authorizer.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_api_gateway_rest_api.therma_api.execution_arn}/authorizers/${aws_api_gateway_authorizer.token.id}"
+}
+
 resource "aws_api_gateway_resource" "journal_entries" {
   rest_api_id = aws_api_gateway_rest_api.therma_api.id
   parent_id   = aws_api_gateway_rest_api.therma_api.root_resource_id
@@ -242,7 +345,8 @@ resource "aws_api_gateway_method" "journal_entries_post" {
   rest_api_id   = aws_api_gateway_rest_api.therma_api.id
   resource_id   = aws_api_gateway_resource.journal_entries.id
   http_method   = "POST"
-  authorization = "NONE"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
 }
 
 resource "aws_api_gateway_integration" "journal_entries_integration" {
@@ -254,6 +358,108 @@ resource "aws_api_gateway_integration" "journal_entries_integration" {
   uri                     = aws_lambda_function.journal_entry.invoke_arn
 }
 
+resource "aws_api_gateway_method" "journal_entries_get" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.journal_entries.id
+  http_method   = "GET"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+}
+
+resource "aws_api_gateway_integration" "journal_entries_get_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.journal_entries.id
+  http_method             = aws_api_gateway_method.journal_entries_get.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.journal_entry.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "journal_entry" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.journal_entries.id
+  path_part   = "{id}"
+}
+
+resource "aws_api_gateway_method" "journal_entry" {
+  for_each = toset(["GET", "PATCH", "DELETE"])
+
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.journal_entry.id
+  http_method   = each.key
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+
+  request_parameters = {
+    "method.request.path.id" = true
+  }
+}
+
+resource "aws_api_gateway_integration" "journal_entry_integration" {
+  for_each = aws_api_gateway_method.journal_entry
+
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.journal_entry.id
+  http_method             = each.value.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.journal_entry.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "journal_shares" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_rest_api.therma_api.root_resource_id
+  path_part   = "journal-shares"
+}
+
+resource "aws_api_gateway_method" "journal_shares_get" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.journal_shares.id
+  http_method   = "GET"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+}
+
+resource "aws_api_gateway_integration" "journal_shares_get_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.journal_shares.id
+  http_method             = aws_api_gateway_method.journal_shares_get.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.journal_entry.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "journal_share" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.journal_shares.id
+  path_part   = "{clinicianId}"
+}
+
+resource "aws_api_gateway_method" "journal_share" {
+  for_each = toset(["PUT", "DELETE"])
+
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.journal_share.id
+  http_method   = each.key
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+
+  request_parameters = {
+    "method.request.path.clinicianId" = true
+  }
+}
+
+resource "aws_api_gateway_integration" "journal_share_integration" {
+  for_each = aws_api_gateway_method.journal_share
+
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.journal_share.id
+  http_method             = each.value.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.journal_entry.invoke_arn
+}
+
 resource "aws_lambda_permission" "apigw_lambda" {
   statement_id  = "AllowAPIGatewayInvoke"
   action        = "lambda:InvokeFunction"
@@ -262,10 +468,350 @@ resource "aws_lambda_permission" "apigw_lambda" {
   source_arn    = "${aws_api_gateway_rest_api.therma_api.execution_arn}/*/*"
 }
 
+resource "aws_api_gateway_resource" "account" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_rest_api.therma_api.root_resource_id
+  path_part   = "account"
+}
+
+resource "aws_api_gateway_method" "account_delete" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.account.id
+  http_method   = "DELETE"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+}
+
+resource "aws_api_gateway_integration" "account_delete_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.account.id
+  http_method             = aws_api_gateway_method.account_delete.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.account.invoke_arn
+}
+
+resource "aws_lambda_permission" "apigw_account" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.account.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_api_gateway_rest_api.therma_api.execution_arn}/*/*"
+}
+
+resource "aws_api_gateway_resource" "auth" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_rest_api.therma_api.root_resource_id
+  path_part   = "auth"
+}
+
+resource "aws_api_gateway_resource" "auth_signup" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "signup"
+}
+
+resource "aws_api_gateway_method" "auth_signup_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_signup.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_signup_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_signup.id
+  http_method             = aws_api_gateway_method.auth_signup_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_login" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "login"
+}
+
+resource "aws_api_gateway_method" "auth_login_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_login.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_login_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_login.id
+  http_method             = aws_api_gateway_method.auth_login_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_refresh" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "refresh"
+}
+
+resource "aws_api_gateway_method" "auth_refresh_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_refresh.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_refresh_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_refresh.id
+  http_method             = aws_api_gateway_method.auth_refresh_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_logout" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "logout"
+}
+
+resource "aws_api_gateway_method" "auth_logout_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_logout.id
+  http_method   = "POST"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+}
+
+resource "aws_api_gateway_integration" "auth_logout_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_logout.id
+  http_method             = aws_api_gateway_method.auth_logout_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_logout_all" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "logout-all"
+}
+
+resource "aws_api_gateway_method" "auth_logout_all_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_logout_all.id
+  http_method   = "POST"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+}
+
+resource "aws_api_gateway_integration" "auth_logout_all_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_logout_all.id
+  http_method             = aws_api_gateway_method.auth_logout_all_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_mfa" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "mfa"
+}
+
+# Authenticated in the handler: the authorizer rejects mfa_pending tokens
+resource "aws_api_gateway_resource" "auth_mfa_enroll" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth_mfa.id
+  path_part   = "enroll"
+}
+
+resource "aws_api_gateway_method" "auth_mfa_enroll_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_mfa_enroll.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_mfa_enroll_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_mfa_enroll.id
+  http_method             = aws_api_gateway_method.auth_mfa_enroll_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+# Authenticated in the handler: the authorizer rejects mfa_pending tokens
+resource "aws_api_gateway_resource" "auth_mfa_activate" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth_mfa.id
+  path_part   = "activate"
+}
+
+resource "aws_api_gateway_method" "auth_mfa_activate_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_mfa_activate.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_mfa_activate_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_mfa_activate.id
+  http_method             = aws_api_gateway_method.auth_mfa_activate_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+# Authenticated in the handler: the authorizer rejects mfa_pending tokens
+resource "aws_api_gateway_resource" "auth_mfa_challenge" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth_mfa.id
+  path_part   = "challenge"
+}
+
+resource "aws_api_gateway_method" "auth_mfa_challenge_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_mfa_challenge.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_mfa_challenge_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_mfa_challenge.id
+  http_method             = aws_api_gateway_method.auth_mfa_challenge_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_verify_email" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "verify-email"
+}
+
+resource "aws_api_gateway_method" "auth_verify_email_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_verify_email.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_verify_email_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_verify_email.id
+  http_method             = aws_api_gateway_method.auth_verify_email_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_verify_email_resend" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth_verify_email.id
+  path_part   = "resend"
+}
+
+resource "aws_api_gateway_method" "auth_verify_email_resend_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_verify_email_resend.id
+  http_method   = "POST"
+  authorization = "CUSTOM"
+  authorizer_id = aws_api_gateway_authorizer.token.id
+}
+
+resource "aws_api_gateway_integration" "auth_verify_email_resend_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_verify_email_resend.id
+  http_method             = aws_api_gateway_method.auth_verify_email_resend_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_password_reset" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth.id
+  path_part   = "password-reset"
+}
+
+resource "aws_api_gateway_method" "auth_password_reset_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_password_reset.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_password_reset_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_password_reset.id
+  http_method             = aws_api_gateway_method.auth_password_reset_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_api_gateway_resource" "auth_password_reset_request" {
+  rest_api_id = aws_api_gateway_rest_api.therma_api.id
+  parent_id   = aws_api_gateway_resource.auth_password_reset.id
+  path_part   = "request"
+}
+
+resource "aws_api_gateway_method" "auth_password_reset_request_post" {
+  rest_api_id   = aws_api_gateway_rest_api.therma_api.id
+  resource_id   = aws_api_gateway_resource.auth_password_reset_request.id
+  http_method   = "POST"
+  authorization = "NONE"
+}
+
+resource "aws_api_gateway_integration" "auth_password_reset_request_integration" {
+  rest_api_id             = aws_api_gateway_rest_api.therma_api.id
+  resource_id             = aws_api_gateway_resource.auth_password_reset_request.id
+  http_method             = aws_api_gateway_method.auth_password_reset_request_post.http_method
+  integration_http_method = "POST"
+  type                    = "AWS_PROXY"
+  uri                     = aws_lambda_function.auth.invoke_arn
+}
+
+resource "aws_lambda_permission" "apigw_auth" {
+  statement_id  = "AllowAPIGatewayInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.auth.function_name
+  principal     = "apigateway.amazonaws.com"
+  source_arn    = "${aws_api_gateway_rest_api.therma_api.execution_arn}/*/*"
+}
+
 resource "aws_api_gateway_deployment" "therma_api" {
   rest_api_id = aws_api_gateway_rest_api.therma_api.id
   stage_name  = "prod"
-  depends_on  = [aws_api_gateway_integration.journal_entries_integration]
+  depends_on = [
+    aws_api_gateway_integration.journal_entries_integration,
+    aws_api_gateway_integration.journal_entries_get_integration,
+    aws_api_gateway_integration.journal_entry_integration,
+    aws_api_gateway_integration.journal_shares_get_integration,
+    aws_api_gateway_integration.journal_share_integration,
+    aws_api_gateway_integration.account_delete_integration,
+    aws_api_gateway_integration.auth_signup_integration,
+    aws_api_gateway_integration.auth_login_integration,
+    aws_api_gateway_integration.auth_refresh_integration,
+    aws_api_gateway_integration.auth_logout_integration,
+    aws_api_gateway_integration.auth_logout_all_integration,
+    aws_api_gateway_integration.auth_mfa_enroll_integration,
+    aws_api_gateway_integration.auth_mfa_activate_integration,
+    aws_api_gateway_integration.auth_mfa_challenge_integration,
+    aws_api_gateway_integration.auth_verify_email_integration,
+    aws_api_gateway_integration.auth_verify_email_resend_integration,
+    aws_api_gateway_integration.auth_password_reset_integration,
+    aws_api_gateway_integration.auth_password_reset_request_integration,
+  ]
 }
 
 # KMS Key for PHI Encryption
@@ -10,8 +10,44 @@ variable "jwt_secret" {
   sensitive   = true
 }
 
+variable "jwt_legacy_secret_until" {
+  description = "RFC 3339 time until which tokens without a kid are still verified with jwt_secret; empty retires it"
+  type        = string
+  default     = ""
+}
+
 variable "environment" {
   description = "Environment name"
   type        = string
   default     = "dev"
 }
+
+variable "cognito_user_pool_id" {
+  description = "Cognito user pool whose RS256 tokens the API accepts; empty to accept only HS256 tokens"
+  type        = string
+  default     = ""
+}
+
+variable "cognito_client_ids" {
+  description = "Comma-separated Cognito app client IDs whose tokens are accepted"
+  type        = string
+  default     = ""
+}
+
+variable "mail_from" {
+  description = "Sender address of account emails; verified as an SES identity"
+  type        = string
+  default     = "no-reply@therma.app"
+}
+
+variable "app_base_url" {
+  description = "Base URL of the app that email verification and password reset links open"
+  type        = string
+  default     = "https://app.therma.app"
+}
+
+variable "idempotency_store" {
+  description = "Where idempotency keys are kept: dynamodb, or postgres to claim them in the same transaction as the writes"
+  type        = string
+  default     = "dynamodb"
+}